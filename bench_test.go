@@ -2,7 +2,10 @@ package smt
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"hash"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -34,3 +37,236 @@ func BenchmarkSparseMerkleTree_Delete(b *testing.B) {
 		_, _ = smt.Delete([]byte(s))
 	}
 }
+
+func BenchmarkSparseMerkleTree_UpdateLongPrefix(b *testing.B) {
+	benchmarkUpdateLongPrefix(b)
+}
+
+func BenchmarkSparseMerkleTree_UpdateLongPrefixExtensionNodes(b *testing.B) {
+	benchmarkUpdateLongPrefix(b, WithExtensionNodes())
+}
+
+// benchmarkUpdateLongPrefix updates keys whose paths share all but their last
+// 32 bits, and reports the number of node writes and hashes per update.
+func benchmarkUpdateLongPrefix(b *testing.B, options ...Option) {
+	h := &countingHasher{Hash: newDummyHasher(sha256.New())}
+	smn := &countingMapStore{MapStore: NewSimpleMap()}
+	smt := NewSparseMerkleTree(smn, NewSimpleMap(), h, options...)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		key := make([]byte, h.Size()+4)
+		binary.BigEndian.PutUint32(key[len(key)-4:], uint32(i))
+		_, _ = smt.Update(key, key)
+	}
+	b.ReportMetric(float64(smn.writes)/float64(b.N), "writes/op")
+	b.ReportMetric(float64(h.sums)/float64(b.N), "hashes/op")
+}
+
+// denseTreeSize is the number of keys in the trees of the dense benchmarks.
+const denseTreeSize = 100000
+
+func BenchmarkSparseMerkleTree_UpdateDense(b *testing.B) {
+	smt, smn := denseTree()
+	smn.reads, smn.writes = 0, 0
+	run := nextDenseRun()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = smt.Update([]byte(strconv.Itoa(i%denseTreeSize)), denseValue(run, i))
+	}
+	b.ReportMetric(float64(smn.reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(smn.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSparseMerkleHexTree_UpdateDense(b *testing.B) {
+	smht, smn := denseHexTree()
+	smn.reads, smn.writes = 0, 0
+	run := nextDenseRun()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = smht.Update([]byte(strconv.Itoa(i%denseTreeSize)), denseValue(run, i))
+	}
+	b.ReportMetric(float64(smn.reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(smn.writes)/float64(b.N), "writes/op")
+}
+
+func BenchmarkSparseMerkleTree_ProveDense(b *testing.B) {
+	smt, smn := denseTree()
+	smn.reads = 0
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	var proofSize int
+	for i := 0; i < b.N; i++ {
+		proof, _ := smt.Prove([]byte(strconv.Itoa(i % denseTreeSize)))
+		for _, sideNode := range proof.SideNodes {
+			proofSize += len(sideNode)
+		}
+	}
+	b.ReportMetric(float64(smn.reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(proofSize)/float64(b.N), "proofbytes/op")
+}
+
+func BenchmarkSparseMerkleHexTree_ProveDense(b *testing.B) {
+	smht, smn := denseHexTree()
+	smn.reads = 0
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	var proofSize int
+	for i := 0; i < b.N; i++ {
+		proof, _ := smht.Prove([]byte(strconv.Itoa(i % denseTreeSize)))
+		for _, siblings := range proof.SideNodes {
+			for _, sideNode := range siblings {
+				proofSize += len(sideNode)
+			}
+		}
+	}
+	b.ReportMetric(float64(smn.reads)/float64(b.N), "reads/op")
+	b.ReportMetric(float64(proofSize)/float64(b.N), "proofbytes/op")
+}
+
+var (
+	denseTreeOnce    sync.Once
+	denseNodes       *countingMapStore
+	denseSMT         *SparseMerkleTree
+	denseHexTreeOnce sync.Once
+	denseHexNodes    *countingMapStore
+	denseHexSMHT     *SparseMerkleHexTree
+	denseRuns        int
+)
+
+// denseTree returns a dense tree and the store of its nodes. The tree is built
+// once, instead of on every run of the benchmarks.
+func denseTree() (*SparseMerkleTree, *countingMapStore) {
+	denseTreeOnce.Do(func() {
+		denseNodes = &countingMapStore{MapStore: NewSimpleMap()}
+		denseSMT = NewSparseMerkleTree(denseNodes, NewSimpleMap(), sha256.New())
+		for i := 0; i < denseTreeSize; i++ {
+			s := strconv.Itoa(i)
+			_, _ = denseSMT.Update([]byte(s), []byte(s))
+		}
+	})
+	return denseSMT, denseNodes
+}
+
+// denseHexTree returns a dense hex tree and the store of its nodes, built like
+// the tree of denseTree.
+func denseHexTree() (*SparseMerkleHexTree, *countingMapStore) {
+	denseHexTreeOnce.Do(func() {
+		denseHexNodes = &countingMapStore{MapStore: NewSimpleMap()}
+		denseHexSMHT = NewSparseMerkleHexTree(denseHexNodes, NewSimpleMap(), sha256.New())
+		for i := 0; i < denseTreeSize; i++ {
+			s := strconv.Itoa(i)
+			_, _ = denseHexSMHT.Update([]byte(s), []byte(s))
+		}
+	})
+	return denseHexSMHT, denseHexNodes
+}
+
+// nextDenseRun numbers the runs of the dense update benchmarks.
+func nextDenseRun() int {
+	denseRuns++
+	return denseRuns
+}
+
+// denseValue returns the value of the update i of a run of the dense update
+// benchmarks. The trees are shared by the runs, so every update sets a new
+// value, and none is skipped for setting the value a key already has.
+func denseValue(run int, i int) []byte {
+	return []byte(strconv.Itoa(run) + "/" + strconv.Itoa(i))
+}
+
+// countingMapStore is a MapStore that counts reads and writes.
+type countingMapStore struct {
+	MapStore
+	reads, writes int
+}
+
+func (s *countingMapStore) Get(key []byte) ([]byte, error) {
+	s.reads++
+	return s.MapStore.Get(key)
+}
+
+func (s *countingMapStore) Set(key []byte, value []byte) error {
+	s.writes++
+	return s.MapStore.Set(key, value)
+}
+
+// countingHasher is a hasher that counts digests.
+type countingHasher struct {
+	hash.Hash
+	sums int
+}
+
+func (h *countingHasher) Sum(b []byte) []byte {
+	h.sums++
+	return h.Hash.Sum(b)
+}
+
+var (
+	denseProofItems     []ProofItem
+	denseProofItemsOnce sync.Once
+)
+
+// proofItems returns membership proofs for the keys of a dense tree.
+func proofItems() []ProofItem {
+	denseProofItemsOnce.Do(func() {
+		denseProofItems = newProofItems()
+	})
+	return denseProofItems
+}
+
+func newProofItems() []ProofItem {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < denseTreeSize; i++ {
+		s := strconv.Itoa(i)
+		_, _ = smt.Update([]byte(s), []byte(s))
+	}
+	items := make([]ProofItem, denseTreeSize)
+	for i := range items {
+		s := strconv.Itoa(i)
+		proof, _ := smt.Prove([]byte(s))
+		items[i] = ProofItem{Proof: proof, Root: smt.Root(), Key: []byte(s), Value: []byte(s)}
+	}
+	return items
+}
+
+func BenchmarkVerifyProof(b *testing.B) {
+	items := proofItems()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		item := items[i%len(items)]
+		VerifyProof(item.Proof, item.Root, item.Key, item.Value, sha256.New())
+	}
+}
+
+func BenchmarkVerifier_Verify(b *testing.B) {
+	items := proofItems()
+	v := NewVerifier(sha256.New)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		item := items[i%len(items)]
+		v.Verify(item.Proof, item.Root, item.Key, item.Value)
+	}
+}
+
+func BenchmarkVerifier_VerifyAll(b *testing.B) {
+	items := proofItems()
+	v := NewVerifier(sha256.New)
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i += len(items) {
+		v.VerifyAll(items, 0)
+	}
+}
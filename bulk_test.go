@@ -20,10 +20,20 @@ func TestSparseMerkleTree(t *testing.T) {
 	}
 }
 
+// Test all tree operations in bulk, on a tree with extension nodes.
+func TestSparseMerkleTreeExtensionNodes(t *testing.T) {
+	for i := 0; i < 5; i++ {
+		bulkOperations(t, 200, 100, 100, 50, WithExtensionNodes())
+	}
+	for i := 0; i < 5; i++ {
+		bulkOperations(t, 200, 100, 100, 500, WithExtensionNodes())
+	}
+}
+
 // Test all tree operations in bulk, with specified ratio probabilities of insert, update and delete.
-func bulkOperations(t *testing.T, operations int, insert int, update int, delete int) {
+func bulkOperations(t *testing.T, operations int, insert int, update int, delete int, options ...Option) {
 	smn, smv := NewSimpleMap(), NewSimpleMap()
-	smt := NewSparseMerkleTree(smn, smv, sha256.New())
+	smt := NewSparseMerkleTree(smn, smv, sha256.New(), options...)
 
 	max := insert + update + delete
 	kv := make(map[string]string)
@@ -74,11 +84,11 @@ func bulkOperations(t *testing.T, operations int, insert int, update int, delete
 			}
 		}
 
-		bulkCheckAll(t, smt, &kv)
+		bulkCheckAll(t, smt, &kv, options...)
 	}
 }
 
-func bulkCheckAll(t *testing.T, smt *SparseMerkleTree, kv *map[string]string) {
+func bulkCheckAll(t *testing.T, smt *SparseMerkleTree, kv *map[string]string, options ...Option) {
 	for k, v := range *kv {
 		value, err := smt.Get([]byte(k))
 		if err != nil {
@@ -93,14 +103,14 @@ func bulkCheckAll(t *testing.T, smt *SparseMerkleTree, kv *map[string]string) {
 		if err != nil {
 			t.Errorf("error: %v", err)
 		}
-		if !VerifyProof(proof, smt.Root(), []byte(k), []byte(v), smt.th.hasher) {
+		if !VerifyProof(proof, smt.Root(), []byte(k), []byte(v), smt.th.hasher, options...) {
 			t.Error("Merkle proof failed to verify")
 		}
 		compactProof, err := smt.ProveCompact([]byte(k))
 		if err != nil {
 			t.Errorf("error: %v", err)
 		}
-		if !VerifyCompactProof(compactProof, smt.Root(), []byte(k), []byte(v), smt.th.hasher) {
+		if !VerifyCompactProof(compactProof, smt.Root(), []byte(k), []byte(v), smt.th.hasher, options...) {
 			t.Error("Merkle proof failed to verify")
 		}
 
@@ -0,0 +1,202 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// ErrInvalidChunk is returned when restoring a chunk that does not verify
+// against the root being restored.
+var ErrInvalidChunk = errors.New("invalid chunk")
+
+// SparseMerkleChunk is a chunk of the leaves of a tree, for state sync. The
+// chunks of a tree cover the path space from the first path to the last path
+// without gaps, in path order, and each chunk holds all the leaves in its part
+// of the path space.
+type SparseMerkleChunk struct {
+	// Start and End are the first and last paths covered by the chunk.
+	Start, End []byte
+
+	// Paths are the paths of the leaves in the chunk, in increasing order.
+	Paths [][]byte
+
+	// Values are the values of the leaves in the chunk, as stored by the
+	// tree, in the same order as Paths.
+	Values [][]byte
+
+	// StartProof and EndProof are Merkle proofs for Start and End, which
+	// prove that the chunk holds all the leaves between them.
+	StartProof, EndProof SparseMerkleProof
+}
+
+// ExportChunks splits the leaves of the tree at a root into chunks, in path
+// order, and calls fn with each chunk. The paths and values of a chunk take up
+// at most maxSize bytes, unless a single leaf is larger. Only one chunk is held
+// in memory at a time. Chunks cannot be exported from trees with extension
+// nodes.
+func (smt *SparseMerkleTree) ExportChunks(root []byte, maxSize int, fn func(chunk SparseMerkleChunk) error) error {
+	if smt.th.extensions {
+		return ErrRangeProofUnsupported
+	}
+
+	pathSize := smt.th.pathSize()
+	first := make([]byte, pathSize)
+	last := bytes.Repeat([]byte{0xff}, pathSize)
+
+	chunk := SparseMerkleChunk{Start: first}
+	var size int
+	emit := func(end []byte) error {
+		chunk.End = end
+		var err error
+		if chunk.StartProof, err = smt.proveForPath(chunk.Start, root, false); err != nil {
+			return err
+		}
+		if chunk.EndProof, err = smt.proveForPath(chunk.End, root, false); err != nil {
+			return err
+		}
+		return fn(chunk)
+	}
+
+	err := smt.rangeLeaves(root, 0, make([]byte, pathSize), first, last, func(path []byte, valueHash []byte) error {
+		value, err := smt.valueForHash(path, valueHash)
+		if err != nil {
+			return err
+		}
+		if len(chunk.Paths) > 0 && size+len(path)+len(value) > maxSize {
+			// The next chunk starts right after the last leaf of this one.
+			end := chunk.Paths[len(chunk.Paths)-1]
+			if err := emit(end); err != nil {
+				return err
+			}
+			chunk = SparseMerkleChunk{Start: nextPath(end)}
+			size = 0
+		}
+		chunk.Paths = append(chunk.Paths, path)
+		chunk.Values = append(chunk.Values, value)
+		size += len(path) + len(value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return emit(last)
+}
+
+// VerifyChunk verifies that a chunk holds all the leaves of the tree with a
+// root between its start and end paths.
+func VerifyChunk(chunk SparseMerkleChunk, root []byte, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, options)
+	return verifyChunk(chunk, root, th)
+}
+
+func verifyChunk(chunk SparseMerkleChunk, root []byte, th *treeHasher) bool {
+	if th.extensions || len(chunk.Paths) != len(chunk.Values) {
+		return false
+	}
+	valueHashes := make([][]byte, len(chunk.Values))
+	for i, value := range chunk.Values {
+		valueHash, ok := th.storedValueHash(value)
+		if !ok {
+			return false
+		}
+		valueHashes[i] = valueHash
+	}
+	return verifyRange(chunk.StartProof, chunk.EndProof, chunk.Paths, valueHashes, root, chunk.Start, chunk.End, th)
+}
+
+// Restorer rebuilds a tree from the chunks of a root, as exported by
+// ExportChunks.
+type Restorer struct {
+	smt  *SparseMerkleTree
+	root []byte
+
+	builder *treeBuilder
+	// next is the start path of the next chunk to insert, or nil once the
+	// last chunk was inserted.
+	next []byte
+	// pending holds the verified chunks that arrived before the chunks that
+	// come before them, by start path.
+	pending map[string]SparseMerkleChunk
+	// err is the error that failed the restoration once the chunks were
+	// inserted, which is returned by every later call to Add.
+	err error
+}
+
+// NewRestorer creates a restorer that rebuilds the tree at a root in the stores
+// of the tree, which must be empty. The tree must have the same hasher and
+// options as the exported tree.
+func (smt *SparseMerkleTree) NewRestorer(root []byte) *Restorer {
+	return &Restorer{
+		smt:     smt,
+		root:    root,
+		builder: newTreeBuilder(smt),
+		next:    make([]byte, smt.th.pathSize()),
+		pending: make(map[string]SparseMerkleChunk),
+	}
+}
+
+// Add verifies a chunk against the root being restored, and inserts it into
+// the tree. Chunks may be added in any order; chunks that were already added
+// are ignored. Add returns true once all the chunks are added and the root of
+// the tree matches, after which the root of the tree is set to it. If the
+// root does not match, the restoration failed, and Add keeps returning
+// ErrInvalidChunk.
+func (r *Restorer) Add(chunk SparseMerkleChunk) (bool, error) {
+	if r.err != nil {
+		return false, r.err
+	}
+	if r.next == nil {
+		return true, nil
+	}
+	if !verifyChunk(chunk, r.root, &r.smt.th) {
+		return false, ErrInvalidChunk
+	}
+	if bytes.Compare(chunk.Start, r.next) < 0 {
+		return false, nil
+	}
+	r.pending[string(chunk.Start)] = chunk
+
+	// Insert the chunks that follow on from the inserted chunks.
+	for r.next != nil {
+		chunk, ok := r.pending[string(r.next)]
+		if !ok {
+			return false, nil
+		}
+		delete(r.pending, string(r.next))
+		for i, path := range chunk.Paths {
+			if err := r.builder.add(path, chunk.Values[i]); err != nil {
+				return false, err
+			}
+		}
+		if bytes.Equal(chunk.End, bytes.Repeat([]byte{0xff}, len(chunk.End))) {
+			r.next = nil
+		} else {
+			r.next = nextPath(chunk.End)
+		}
+	}
+
+	root, err := r.builder.root()
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(root, r.root) {
+		r.err = ErrInvalidChunk
+		return false, r.err
+	}
+	r.smt.SetRoot(root)
+	return true, nil
+}
+
+// nextPath returns the path that follows a path, which must not be the last
+// path.
+func nextPath(path []byte) []byte {
+	next := append([]byte(nil), path...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
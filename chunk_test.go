@@ -0,0 +1,149 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Test restoring trees from chunks added in any order.
+func TestSparseMerkleTreeChunks(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithDepth(12)}, {WithOrderedKeys()}} {
+		for _, n := range []int{0, 1, 300} {
+			smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+			for i := 0; i < n; i++ {
+				key := make([]byte, 32)
+				rand.Read(key)
+				smt.Update(key, []byte(strconv.Itoa(i)))
+			}
+			root := smt.Root()
+
+			var chunks []SparseMerkleChunk
+			err := smt.ExportChunks(root, 1000, func(chunk SparseMerkleChunk) error {
+				var size int
+				for i, path := range chunk.Paths {
+					size += len(path) + len(chunk.Values[i])
+				}
+				if size > 1000 {
+					t.Errorf("expected chunk of at most 1000 bytes, got %d", size)
+				}
+				if !VerifyChunk(chunk, root, sha256.New(), options...) {
+					t.Error("valid chunk failed to verify")
+				}
+				chunks = append(chunks, chunk)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("returned error when exporting chunks: %v", err)
+			}
+			if n == 300 && len(chunks) < 10 {
+				t.Errorf("expected at least 10 chunks, got %d", len(chunks))
+			}
+
+			restored := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+			restorer := restored.NewRestorer(root)
+			rand.Shuffle(len(chunks), func(i, j int) {
+				chunks[i], chunks[j] = chunks[j], chunks[i]
+			})
+			for i, chunk := range chunks {
+				done, err := restorer.Add(chunk)
+				if err != nil {
+					t.Errorf("returned error when adding chunk: %v", err)
+				}
+				if done != (i == len(chunks)-1) {
+					t.Errorf("expected restore to be done only after the last chunk, got %v after chunk %d", done, i)
+				}
+				// Chunks that were already added are ignored.
+				if _, err := restorer.Add(chunks[0]); err != nil {
+					t.Errorf("returned error when adding chunk again: %v", err)
+				}
+			}
+			if !bytes.Equal(root, restored.Root()) {
+				t.Error("restored root differs from exported root")
+			}
+			for k, v := range smt.nodes.(*SimpleMap).m {
+				if !bytes.Equal(v, restored.nodes.(*SimpleMap).m[k]) {
+					t.Error("restored nodes differ from exported nodes")
+					break
+				}
+			}
+		}
+	}
+}
+
+// Test that invalid chunks are rejected.
+func TestSparseMerkleTreeChunksInvalid(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	root := smt.Root()
+	var chunks []SparseMerkleChunk
+	smt.ExportChunks(root, 500, func(chunk SparseMerkleChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	restorer := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).NewRestorer(root)
+
+	// A changed value.
+	chunk := chunks[1]
+	chunk.Values = append([][]byte(nil), chunk.Values...)
+	chunk.Values[0] = []byte("changed")
+	if _, err := restorer.Add(chunk); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected ErrInvalidChunk when adding changed chunk, got: %v", err)
+	}
+
+	// A missing leaf.
+	chunk = chunks[1]
+	chunk.Paths, chunk.Values = chunk.Paths[1:], chunk.Values[1:]
+	if _, err := restorer.Add(chunk); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected ErrInvalidChunk when adding chunk with missing leaf, got: %v", err)
+	}
+
+	// A chunk that claims more of the path space than it proves.
+	chunk = chunks[1]
+	chunk.End = chunks[2].End
+	if _, err := restorer.Add(chunk); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected ErrInvalidChunk when adding chunk with wrong end, got: %v", err)
+	}
+
+	// A chunk of another root.
+	smt.Update([]byte("1"), []byte("changed"))
+	err := smt.ExportChunks(smt.Root(), 500, func(chunk SparseMerkleChunk) error {
+		if _, err := restorer.Add(chunk); !errors.Is(err, ErrInvalidChunk) {
+			t.Errorf("expected ErrInvalidChunk when adding chunk of another root, got: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("returned error when exporting chunks: %v", err)
+	}
+
+	// A restoration whose root does not match once all the chunks are
+	// inserted keeps failing.
+	restorer = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).NewRestorer(root)
+	restorer.builder = newTreeBuilder(NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithExtensionNodes()))
+	for i, chunk := range chunks {
+		done, err := restorer.Add(chunk)
+		if i < len(chunks)-1 {
+			if done || err != nil {
+				t.Errorf("expected restoration to be pending when adding chunk %d, got: %v, %v", i, done, err)
+			}
+		} else if done || !errors.Is(err, ErrInvalidChunk) {
+			t.Errorf("expected ErrInvalidChunk when adding last chunk with mismatched root, got: %v, %v", done, err)
+		}
+	}
+	if done, err := restorer.Add(chunks[0]); done || !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected ErrInvalidChunk when adding chunk after mismatched root, got: %v, %v", done, err)
+	}
+
+	// Chunks cannot be exported from trees with extension nodes.
+	smt = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithExtensionNodes())
+	if err := smt.ExportChunks(smt.Root(), 500, func(SparseMerkleChunk) error { return nil }); !errors.Is(err, ErrRangeProofUnsupported) {
+		t.Errorf("expected ErrRangeProofUnsupported when exporting chunks with extension nodes, got: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+// Package client fetches values from a server of package server, and verifies
+// their proofs against a trusted root before returning them.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/celestiaorg/smt"
+	"github.com/celestiaorg/smt/server"
+)
+
+// ErrNoRoot is returned when getting a value without a trusted root to verify
+// its proof against.
+var ErrNoRoot = errors.New("no trusted root")
+
+// StatusError is returned when the server responds with an error.
+type StatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("server returned status %d: %s", e.StatusCode, e.Message)
+}
+
+// Option is a function that configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with an http.Client, instead of
+// http.DefaultClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithTreeOptions verifies proofs with the options of the served tree.
+func WithTreeOptions(options ...smt.Option) Option {
+	return func(c *Client) {
+		c.treeOptions = options
+	}
+}
+
+// Client is a client of a server of package server. Every value it returns
+// has had its proof verified with smt.VerifyProof.
+type Client struct {
+	baseURL     string
+	newHasher   func() hash.Hash
+	httpClient  *http.Client
+	treeOptions []smt.Option
+}
+
+// New creates a Client of the server at a base URL, whose tree hashes with the
+// hashers that newHasher returns.
+func New(baseURL string, newHasher func() hash.Hash, options ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		newHasher:  newHasher,
+		httpClient: http.DefaultClient,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Root returns the current root of the tree of the server. It is not verified,
+// so it must not be trusted unless it is checked by other means.
+func (c *Client) Root(ctx context.Context) ([]byte, error) {
+	var response server.RootResponse
+	if err := c.fetch(ctx, "/root", nil, &response); err != nil {
+		return nil, err
+	}
+	return response.Root, nil
+}
+
+// Get gets the value of a key at a trusted root, and verifies its proof.
+// smt.ErrBadProof is returned if the proof fails to verify.
+func (c *Client) Get(ctx context.Context, key []byte, root []byte) ([]byte, error) {
+	if len(root) == 0 {
+		return nil, ErrNoRoot
+	}
+	var response server.ProofResponse
+	if err := c.fetch(ctx, "/prove", url.Values{"key": {hex.EncodeToString(key)}, "root": {hex.EncodeToString(root)}}, &response); err != nil {
+		return nil, err
+	}
+	if err := c.verify(response, key, root); err != nil {
+		return nil, err
+	}
+	return response.Value, nil
+}
+
+// GetCompact gets the value of a key at a trusted root like Get, with a compact
+// proof.
+func (c *Client) GetCompact(ctx context.Context, key []byte, root []byte) ([]byte, error) {
+	if len(root) == 0 {
+		return nil, ErrNoRoot
+	}
+	var response server.CompactProofResponse
+	if err := c.fetch(ctx, "/prove-compact", url.Values{"key": {hex.EncodeToString(key)}, "root": {hex.EncodeToString(root)}}, &response); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(root, response.Root) || !bytes.Equal(key, response.Key) ||
+		!smt.VerifyCompactProof(response.Proof, root, key, response.Value, c.newHasher(), c.treeOptions...) {
+		return nil, smt.ErrBadProof
+	}
+	return response.Value, nil
+}
+
+// GetMulti gets the values of keys at a trusted root like Get, in the order of
+// the keys. The keys are sent in as few requests as the server allows.
+func (c *Client) GetMulti(ctx context.Context, keys [][]byte, root []byte) ([][]byte, error) {
+	if len(root) == 0 {
+		return nil, ErrNoRoot
+	}
+	values := make([][]byte, 0, len(keys))
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > server.MaxMultiKeys {
+			batch = batch[:server.MaxMultiKeys]
+		}
+		keys = keys[len(batch):]
+
+		params := url.Values{"root": {hex.EncodeToString(root)}}
+		for _, key := range batch {
+			params.Add("key", hex.EncodeToString(key))
+		}
+		var response server.MultiProofResponse
+		if err := c.fetch(ctx, "/prove-multi", params, &response); err != nil {
+			return nil, err
+		}
+		if len(response.Proofs) != len(batch) {
+			return nil, smt.ErrBadProof
+		}
+		for i, proof := range response.Proofs {
+			if err := c.verify(proof, batch[i], root); err != nil {
+				return nil, err
+			}
+			values = append(values, proof.Value)
+		}
+	}
+	return values, nil
+}
+
+// verify verifies that a response proves the value of a key at a root.
+func (c *Client) verify(response server.ProofResponse, key []byte, root []byte) error {
+	if !bytes.Equal(root, response.Root) || !bytes.Equal(key, response.Key) ||
+		!smt.VerifyProof(response.Proof, root, key, response.Value, c.newHasher(), c.treeOptions...) {
+		return smt.ErrBadProof
+	}
+	return nil
+}
+
+// fetch gets a path of the server with query parameters, and decodes the JSON
+// response.
+func (c *Client) fetch(ctx context.Context, path string, params url.Values, response interface{}) error {
+	u := c.baseURL + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var errorResponse server.ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+		return &StatusError{StatusCode: resp.StatusCode, Message: errorResponse.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
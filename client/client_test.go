@@ -0,0 +1,110 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/celestiaorg/smt"
+	"github.com/celestiaorg/smt/server"
+)
+
+func TestClient(t *testing.T) {
+	tree := smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New(), smt.WithHistory())
+	var keys [][]byte
+	for i := 0; i < server.MaxMultiKeys+10; i++ {
+		key := []byte(strconv.Itoa(i))
+		keys = append(keys, key)
+		tree.Update(key, []byte("value"+strconv.Itoa(i)))
+	}
+	oldRoot := tree.Root()
+	tree.Update([]byte("0"), []byte("newValue"))
+	ts := httptest.NewServer(server.New(tree))
+	defer ts.Close()
+
+	ctx := context.Background()
+	c := New(ts.URL, sha256.New)
+	root, err := c.Root(ctx)
+	if err != nil {
+		t.Fatalf("returned error when getting root: %v", err)
+	}
+	if !bytes.Equal(tree.Root(), root) {
+		t.Error("did not get root of tree")
+	}
+
+	value, err := c.Get(ctx, []byte("0"), root)
+	if err != nil || !bytes.Equal([]byte("newValue"), value) {
+		t.Errorf("did not get value of key, got %q and error: %v", value, err)
+	}
+	value, err = c.GetCompact(ctx, []byte("0"), oldRoot)
+	if err != nil || !bytes.Equal([]byte("value0"), value) {
+		t.Errorf("did not get value of key at old root, got %q and error: %v", value, err)
+	}
+	value, err = c.Get(ctx, []byte("missing"), root)
+	if err != nil || len(value) != 0 {
+		t.Errorf("did not get empty value of missing key, got %q and error: %v", value, err)
+	}
+
+	values, err := c.GetMulti(ctx, keys, oldRoot)
+	if err != nil {
+		t.Errorf("returned error when getting multiple keys: %v", err)
+	}
+	if len(values) != len(keys) {
+		t.Fatalf("expected %d values, got %d", len(keys), len(values))
+	}
+	for i, value := range values {
+		if !bytes.Equal([]byte("value"+strconv.Itoa(i)), value) {
+			t.Errorf("did not get value of key %d", i)
+		}
+	}
+
+	if _, err := c.Get(ctx, []byte("0"), nil); !errors.Is(err, ErrNoRoot) {
+		t.Errorf("expected ErrNoRoot when getting key without root, got: %v", err)
+	}
+	var statusError *StatusError
+	if _, err := c.Get(ctx, []byte("0"), bytes.Repeat([]byte{1}, 32)); !errors.As(err, &statusError) || statusError.StatusCode != http.StatusNotFound {
+		t.Errorf("expected StatusError with status %d when getting key at unknown root, got: %v", http.StatusNotFound, err)
+	}
+}
+
+// Test that values are not returned if their proofs fail to verify.
+func TestClientBadProof(t *testing.T) {
+	tree := smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New())
+	tree.Update([]byte("testKey"), []byte("testValue"))
+	tree.Update([]byte("testKey2"), []byte("testValue2"))
+	s := server.New(tree)
+
+	// The server lies about the value of every key.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := httptest.NewRecorder()
+		s.ServeHTTP(recorder, r)
+		var response map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &response)
+		if _, ok := response["value"]; ok {
+			response["value"] = []byte("forgedValue")
+		}
+		if proofs, ok := response["proofs"].([]interface{}); ok {
+			proofs[len(proofs)-1].(map[string]interface{})["value"] = []byte("forgedValue")
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	c := New(ts.URL, sha256.New)
+	if _, err := c.Get(ctx, []byte("testKey"), tree.Root()); !errors.Is(err, smt.ErrBadProof) {
+		t.Errorf("expected ErrBadProof when getting forged value, got: %v", err)
+	}
+	if _, err := c.GetCompact(ctx, []byte("testKey"), tree.Root()); !errors.Is(err, smt.ErrBadProof) {
+		t.Errorf("expected ErrBadProof when getting forged value with compact proof, got: %v", err)
+	}
+	if _, err := c.GetMulti(ctx, [][]byte{[]byte("testKey"), []byte("testKey2")}, tree.Root()); !errors.Is(err, smt.ErrBadProof) {
+		t.Errorf("expected ErrBadProof when getting forged values, got: %v", err)
+	}
+}
@@ -15,9 +15,9 @@ type DeepSparseMerkleSubTree struct {
 }
 
 // NewDeepSparseMerkleSubTree creates a new deep Sparse Merkle subtree on an empty MapStore.
-func NewDeepSparseMerkleSubTree(nodes, values MapStore, hasher hash.Hash, root []byte) *DeepSparseMerkleSubTree {
+func NewDeepSparseMerkleSubTree(nodes, values MapStore, hasher hash.Hash, root []byte, options ...Option) *DeepSparseMerkleSubTree {
 	return &DeepSparseMerkleSubTree{
-		SparseMerkleTree: ImportSparseMerkleTree(nodes, values, hasher, root),
+		SparseMerkleTree: ImportSparseMerkleTree(nodes, values, hasher, root, options...),
 	}
 }
 
@@ -28,13 +28,13 @@ func NewDeepSparseMerkleSubTree(nodes, values MapStore, hasher hash.Hash, root [
 // If the leaf may be updated (e.g. during a state transition fraud proof),
 // an updatable proof should be used. See SparseMerkleTree.ProveUpdatable.
 func (dsmst *DeepSparseMerkleSubTree) AddBranch(proof SparseMerkleProof, key []byte, value []byte) error {
-	result, updates := verifyProofWithUpdates(proof, dsmst.Root(), key, value, dsmst.th.hasher)
+	result, updates := verifyProofWithUpdates(proof, dsmst.Root(), dsmst.th.path(key), dsmst.th.valueHash(value), &dsmst.th)
 	if !result {
 		return ErrBadProof
 	}
 
 	if !bytes.Equal(value, defaultValue) { // Membership proof.
-		if err := dsmst.values.Set(dsmst.th.path(key), value); err != nil {
+		if err := dsmst.storeValue(dsmst.th.path(key), value, dsmst.th.valueHash(value)); err != nil {
 			return err
 		}
 	}
@@ -64,6 +64,10 @@ func (dsmst *DeepSparseMerkleSubTree) AddBranch(proof SparseMerkleProof, key []b
 // Use if a key was _not_ previously added with AddBranch, otherwise use Get.
 // Errors if the key cannot be reached by descending.
 func (smt *SparseMerkleTree) GetDescend(key []byte) ([]byte, error) {
+	if err := smt.checkKey(key); err != nil {
+		return nil, err
+	}
+
 	// Get tree's root
 	root := smt.Root()
 
@@ -80,17 +84,27 @@ func (smt *SparseMerkleTree) GetDescend(key []byte) ([]byte, error) {
 			return nil, err
 		} else if smt.th.isLeaf(currentData) {
 			// We've reached the end. Is this the actual leaf?
-			p, _ := smt.th.parseLeaf(currentData)
+			p, valueHash := smt.th.parseLeaf(currentData)
 			if !bytes.Equal(path, p) {
 				// Nope. Therefore the key is actually empty.
 				return defaultValue, nil
 			}
 			// Otherwise, yes. Return the value.
-			value, err := smt.values.Get(path)
+			value, err := smt.leafValue(path, valueHash)
 			if err != nil {
 				return nil, err
 			}
 			return value, nil
+		} else if smt.th.isExtension(currentData) {
+			start, end, extensionPath, child := smt.th.parseExtension(currentData)
+			if start+countCommonBits(path, extensionPath, start, end) != end {
+				// The path leaves the extension node; the key is empty.
+				return defaultValue, nil
+			}
+			// Skip the chain of inner nodes that the extension node stands for.
+			currentHash = child
+			i = end - 1
+			continue
 		}
 
 		leftNode, rightNode := smt.th.parseNode(currentData)
@@ -106,10 +120,20 @@ func (smt *SparseMerkleTree) GetDescend(key []byte) ([]byte, error) {
 		}
 	}
 
-	// The following lines of code should only be reached if the path is 256
-	// nodes high, which should be very unlikely if the underlying hash function
-	// is collision-resistant.
-	value, err := smt.values.Get(path)
+	// The following lines of code should only be reached if the path is as
+	// high as the depth of the tree, which should be very unlikely if the
+	// underlying hash function is collision-resistant and the tree has the
+	// default depth.
+	currentData, err := smt.nodes.Get(currentHash)
+	if err != nil {
+		return nil, err
+	}
+	p, valueHash := smt.th.parseLeaf(currentData)
+	if !bytes.Equal(path, p) {
+		// A different key takes the truncated path of this key.
+		return defaultValue, nil
+	}
+	value, err := smt.leafValue(path, valueHash)
 	if err != nil {
 		return nil, err
 	}
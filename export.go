@@ -0,0 +1,349 @@
+package smt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"math"
+)
+
+// ErrInvalidExport is returned when importing a stream that is malformed, that
+// was exported from a tree with a different hasher or options, or whose leaves
+// do not match the root in its header.
+var ErrInvalidExport = errors.New("invalid export stream")
+
+// exportMagic starts every export stream.
+var exportMagic = []byte("SMTX")
+
+// exportVersion is the version of the export stream format.
+const exportVersion = 1
+
+const (
+	exportFlagSumTree = 1 << iota
+	exportFlagExtensions
+	exportFlagOrderedKeys
+)
+
+const (
+	exportEnd  = 0
+	exportLeaf = 1
+)
+
+// Export writes the leaves of the tree at a root to w as a stream, in path
+// order. The stream starts with a header naming the format version, the
+// hasher, the depth of the tree and the root, and holds the path and value of
+// every leaf. Only the right edge of the tree is held in memory while reading
+// it, so trees of any size can be exported.
+func (smt *SparseMerkleTree) Export(root []byte, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if err := smt.writeExportHeader(bw, root); err != nil {
+		return err
+	}
+
+	pathSize := smt.th.pathSize()
+	start := make([]byte, pathSize)
+	end := bytes.Repeat([]byte{0xff}, pathSize)
+	var lenBuf [binary.MaxVarintLen64]byte
+	err := smt.rangeLeaves(root, 0, make([]byte, pathSize), start, end, func(path []byte, valueHash []byte) error {
+		value, err := smt.valueForHash(path, valueHash)
+		if err != nil {
+			return err
+		}
+		if err := bw.WriteByte(exportLeaf); err != nil {
+			return err
+		}
+		if _, err := bw.Write(path); err != nil {
+			return err
+		}
+		n := binary.PutUvarint(lenBuf[:], uint64(len(value)))
+		if _, err := bw.Write(lenBuf[:n]); err != nil {
+			return err
+		}
+		_, err = bw.Write(value)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := bw.WriteByte(exportEnd); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Export writes the leaves of the tree at a root to w as a stream, in path
+// order. See SparseMerkleTree.Export.
+func (smst *SparseMerkleSumTree) Export(root []byte, w io.Writer) error {
+	return smst.smt.Export(root, w)
+}
+
+// Import creates a tree on empty MapStores from a stream written by Export,
+// with the same hasher and options as the exported tree. The tree is built as
+// the leaves are read, holding only its right edge in memory, and its root is
+// checked against the root in the header of the stream. If an error is
+// returned, the stores may hold part of the tree.
+func Import(r io.Reader, nodes, values MapStore, hasher hash.Hash, options ...Option) (*SparseMerkleTree, error) {
+	smt := NewSparseMerkleTree(nodes, values, hasher, options...)
+	if err := smt.importStream(r); err != nil {
+		return nil, err
+	}
+	return smt, nil
+}
+
+// ImportSum creates a sum tree on empty MapStores from a stream written by
+// Export. See Import.
+func ImportSum(r io.Reader, nodes, values MapStore, hasher hash.Hash, options ...Option) (*SparseMerkleSumTree, error) {
+	smst := NewSparseMerkleSumTree(nodes, values, hasher, options...)
+	if err := smst.smt.importStream(r); err != nil {
+		return nil, err
+	}
+	return smst, nil
+}
+
+func (smt *SparseMerkleTree) exportFlags() byte {
+	var flags byte
+	if smt.th.sumTree {
+		flags |= exportFlagSumTree
+	}
+	if smt.th.extensions {
+		flags |= exportFlagExtensions
+	}
+	if smt.th.orderedKeys {
+		flags |= exportFlagOrderedKeys
+	}
+	return flags
+}
+
+func (smt *SparseMerkleTree) writeExportHeader(w *bufio.Writer, root []byte) error {
+	hasherID := smt.th.hasherID()
+	header := make([]byte, 0, len(exportMagic)+6+len(hasherID)+len(root))
+	header = append(header, exportMagic...)
+	header = append(header, exportVersion, smt.exportFlags())
+	header = append(header, hasherID...)
+	header = append(header, byte(smt.th.pathSize()>>8), byte(smt.th.pathSize()))
+	header = append(header, byte(smt.depth()>>8), byte(smt.depth()))
+	header = append(header, root...)
+	_, err := w.Write(header)
+	return err
+}
+
+// readExportHeader reads the header of an export stream, checks that it was
+// exported from a tree like this one, and returns its root.
+func (smt *SparseMerkleTree) readExportHeader(r *bufio.Reader) ([]byte, error) {
+	fixed := make([]byte, len(exportMagic)+3)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, ErrInvalidExport
+	}
+	if !bytes.Equal(fixed[:len(exportMagic)], exportMagic) ||
+		fixed[len(exportMagic)] != exportVersion ||
+		fixed[len(exportMagic)+1] != smt.exportFlags() {
+		return nil, ErrInvalidExport
+	}
+
+	// The size of the digests of the hasher is the first byte of its ID.
+	hasherID := smt.th.hasherID()
+	if fixed[len(exportMagic)+2] != hasherID[0] {
+		return nil, ErrInvalidExport
+	}
+	rest := make([]byte, len(hasherID)-1+4+smt.th.nodeSize())
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, ErrInvalidExport
+	}
+	digest, rest := rest[:len(hasherID)-1], rest[len(hasherID)-1:]
+	if !bytes.Equal(digest, hasherID[1:]) ||
+		int(binary.BigEndian.Uint16(rest)) != smt.th.pathSize() ||
+		int(binary.BigEndian.Uint16(rest[2:])) != smt.depth() {
+		return nil, ErrInvalidExport
+	}
+	return rest[4:], nil
+}
+
+func (smt *SparseMerkleTree) importStream(r io.Reader) error {
+	br := bufio.NewReader(r)
+	root, err := smt.readExportHeader(br)
+	if err != nil {
+		return err
+	}
+
+	b := newTreeBuilder(smt)
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return ErrInvalidExport
+		}
+		if marker == exportEnd {
+			break
+		}
+		if marker != exportLeaf {
+			return ErrInvalidExport
+		}
+		path := make([]byte, smt.th.pathSize())
+		if _, err := io.ReadFull(br, path); err != nil {
+			return ErrInvalidExport
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return ErrInvalidExport
+		}
+		value, err := readExportValue(br, size)
+		if err != nil {
+			return err
+		}
+		if err := b.add(path, value); err != nil {
+			return err
+		}
+	}
+
+	builtRoot, err := b.root()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(builtRoot, root) {
+		return ErrInvalidExport
+	}
+	smt.SetRoot(builtRoot)
+	return nil
+}
+
+// readExportValue reads a value of a size read from an export stream. The value
+// grows as it is read, so that a corrupt size cannot allocate more memory than
+// the stream holds.
+func readExportValue(r io.Reader, size uint64) ([]byte, error) {
+	if size > math.MaxInt64 {
+		return nil, ErrInvalidExport
+	}
+	var value bytes.Buffer
+	if n, err := io.CopyN(&value, r, int64(size)); err != nil || n != int64(size) {
+		return nil, ErrInvalidExport
+	}
+	return value.Bytes(), nil
+}
+
+// treeBuilder builds a tree in its stores from its leaves in path order. It
+// holds only the subtrees on the right edge of the tree built so far, which
+// are at most as many as the depth of the tree.
+type treeBuilder struct {
+	smt      *SparseMerkleTree
+	stack    []builderNode
+	lastPath []byte
+}
+
+// builderNode is a subtree on the right edge of a tree being built.
+type builderNode struct {
+	node []byte
+	// path is the path of a leaf in the subtree.
+	path []byte
+	// split is the depth of the first bit at which the paths of the leaves
+	// in the subtree differ, or -1 if the subtree is a single leaf.
+	split int
+	// shared is the number of bits that the paths in the subtree share with
+	// the paths in the subtree before it on the stack.
+	shared int
+}
+
+func newTreeBuilder(smt *SparseMerkleTree) *treeBuilder {
+	return &treeBuilder{smt: smt}
+}
+
+// add adds a leaf to the tree, which must come after all the leaves added so
+// far in path order.
+func (b *treeBuilder) add(path []byte, value []byte) error {
+	var shared int
+	if b.lastPath != nil {
+		if bytes.Compare(path, b.lastPath) <= 0 {
+			return ErrInvalidExport
+		}
+		shared = countCommonPrefix(path, b.lastPath)
+		if shared >= b.smt.depth() {
+			return ErrPathCollision
+		}
+	}
+	b.lastPath = path
+
+	// Every subtree that shares more bits with the one before it than with
+	// the new leaf is complete.
+	for len(b.stack) > 1 && b.stack[len(b.stack)-1].shared > shared {
+		if err := b.merge(); err != nil {
+			return err
+		}
+	}
+
+	valueHash, ok := b.smt.th.storedValueHash(value)
+	if !ok {
+		return ErrInvalidExport
+	}
+	if err := b.smt.storeValue(path, value, valueHash); err != nil {
+		return err
+	}
+	node, data := b.smt.th.digestLeaf(path, valueHash)
+	if err := b.smt.nodes.Set(node, data); err != nil {
+		return err
+	}
+	b.stack = append(b.stack, builderNode{node: node, path: path, split: -1, shared: shared})
+	return nil
+}
+
+// root completes the tree and returns its root.
+func (b *treeBuilder) root() ([]byte, error) {
+	if len(b.stack) == 0 {
+		return b.smt.th.placeholder(), nil
+	}
+	for len(b.stack) > 1 {
+		if err := b.merge(); err != nil {
+			return nil, err
+		}
+	}
+	return b.child(b.stack[0], 0)
+}
+
+// merge joins the two subtrees on top of the stack under an inner node.
+func (b *treeBuilder) merge() error {
+	left, right := b.stack[len(b.stack)-2], b.stack[len(b.stack)-1]
+	split := right.shared
+	leftNode, err := b.child(left, split+1)
+	if err != nil {
+		return err
+	}
+	rightNode, err := b.child(right, split+1)
+	if err != nil {
+		return err
+	}
+	node, data := b.smt.th.digestNode(leftNode, rightNode)
+	if err := b.smt.nodes.Set(node, data); err != nil {
+		return err
+	}
+	b.stack = append(b.stack[:len(b.stack)-2], builderNode{node: node, path: left.path, split: split, shared: left.shared})
+	return nil
+}
+
+// child returns the node of a subtree as a child at a depth, above the chain
+// of inner nodes with placeholder siblings that leads down to its split.
+func (b *treeBuilder) child(n builderNode, depth int) ([]byte, error) {
+	if n.split <= depth {
+		// Leaves bubble up, and inner nodes at the depth need no chain.
+		return n.node, nil
+	}
+	if b.smt.th.extensions {
+		node, data := b.smt.th.digestExtension(depth, n.split, n.path, n.node)
+		if err := b.smt.nodes.Set(node, data); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	node := n.node
+	for i := n.split - 1; i >= depth; i-- {
+		var data []byte
+		if getBitAtFromMSB(n.path, i) == right {
+			node, data = b.smt.th.digestNode(b.smt.th.placeholder(), node)
+		} else {
+			node, data = b.smt.th.digestNode(node, b.smt.th.placeholder())
+		}
+		if err := b.smt.nodes.Set(node, data); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
@@ -0,0 +1,167 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Test that imported trees are the same as the exported trees.
+func TestSparseMerkleTreeExportImport(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithExtensionNodes()}, {WithDepth(12)}, {WithOrderedKeys()}, {WithContentAddressedValues()}} {
+		for _, n := range []int{0, 1, 2, 200} {
+			smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+			for i := 0; i < n; i++ {
+				key := make([]byte, 32)
+				rand.Read(key)
+				smt.Update(key, []byte(strconv.Itoa(i)))
+			}
+
+			var buf bytes.Buffer
+			if err := smt.Export(smt.Root(), &buf); err != nil {
+				t.Errorf("returned error when exporting tree: %v", err)
+			}
+			imported, err := Import(&buf, NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+			if err != nil {
+				t.Errorf("returned error when importing tree: %v", err)
+				continue
+			}
+			if !bytes.Equal(smt.Root(), imported.Root()) {
+				t.Error("imported root differs from exported root")
+			}
+			if len(smt.nodes.(*SimpleMap).m) != len(imported.nodes.(*SimpleMap).m) ||
+				len(smt.values.(*SimpleMap).m) != len(imported.values.(*SimpleMap).m) {
+				t.Error("imported stores differ from exported stores")
+			}
+			for k, v := range smt.nodes.(*SimpleMap).m {
+				if !bytes.Equal(v, imported.nodes.(*SimpleMap).m[k]) {
+					t.Error("imported nodes differ from exported nodes")
+					break
+				}
+			}
+			for k, v := range smt.values.(*SimpleMap).m {
+				if !bytes.Equal(v, imported.values.(*SimpleMap).m[k]) {
+					t.Error("imported values differ from exported values")
+					break
+				}
+			}
+		}
+	}
+}
+
+// Test exporting a sum tree, and a tree at an older root.
+func TestSparseMerkleTreeExportOlderRoot(t *testing.T) {
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithHistory())
+	for i := 0; i < 50; i++ {
+		s := strconv.Itoa(i)
+		smst.Update([]byte(s), []byte(s), uint64(i))
+	}
+	oldRoot := smst.Root()
+	for i := 0; i < 50; i += 2 {
+		smst.Delete([]byte(strconv.Itoa(i)))
+	}
+
+	var buf bytes.Buffer
+	if err := smst.Export(oldRoot, &buf); err != nil {
+		t.Errorf("returned error when exporting sum tree: %v", err)
+	}
+	imported, err := ImportSum(&buf, NewSimpleMap(), NewSimpleMap(), sha256.New())
+	if err != nil {
+		t.Fatalf("returned error when importing sum tree: %v", err)
+	}
+	if !bytes.Equal(oldRoot, imported.Root()) {
+		t.Error("imported root differs from exported root")
+	}
+	value, weight, err := imported.Get([]byte("10"))
+	if err != nil {
+		t.Errorf("returned error when getting key from imported tree: %v", err)
+	}
+	if !bytes.Equal([]byte("10"), value) || weight != 10 {
+		t.Error("did not get correct value and weight from imported tree")
+	}
+}
+
+// Test that invalid streams are not imported.
+func TestSparseMerkleTreeImportInvalid(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	var buf bytes.Buffer
+	if err := smt.Export(smt.Root(), &buf); err != nil {
+		t.Errorf("returned error when exporting tree: %v", err)
+	}
+	stream := buf.Bytes()
+
+	// A different hasher.
+	if _, err := Import(bytes.NewReader(stream), NewSimpleMap(), NewSimpleMap(), sha512.New()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing with different hasher, got: %v", err)
+	}
+	if _, err := Import(bytes.NewReader(stream), NewSimpleMap(), NewSimpleMap(), sha256.New224()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing with hasher of same type, got: %v", err)
+	}
+	// Different options.
+	if _, err := Import(bytes.NewReader(stream), NewSimpleMap(), NewSimpleMap(), sha256.New(), WithExtensionNodes()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing with different options, got: %v", err)
+	}
+	if _, err := Import(bytes.NewReader(stream), NewSimpleMap(), NewSimpleMap(), sha256.New(), WithOrderedKeys()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing with ordered keys, got: %v", err)
+	}
+	// A changed value.
+	tampered := append([]byte(nil), stream...)
+	tampered[len(tampered)-2] ^= 1
+	if _, err := Import(bytes.NewReader(tampered), NewSimpleMap(), NewSimpleMap(), sha256.New()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing changed stream, got: %v", err)
+	}
+	// A truncated stream.
+	if _, err := Import(bytes.NewReader(stream[:len(stream)-1]), NewSimpleMap(), NewSimpleMap(), sha256.New()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing truncated stream, got: %v", err)
+	}
+
+	// Leaves with values longer than the stream.
+	buf.Reset()
+	NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).Export(smt.th.placeholder(), &buf)
+	header := buf.Bytes()[:buf.Len()-1]
+	for _, size := range []uint64{1 << 62, math.MaxUint64} {
+		oversized := append([]byte(nil), header...)
+		oversized = append(oversized, exportLeaf)
+		oversized = append(oversized, make([]byte, sha256.Size)...)
+		var lenBuf [binary.MaxVarintLen64]byte
+		oversized = append(oversized, lenBuf[:binary.PutUvarint(lenBuf[:], size)]...)
+		oversized = append(oversized, "value"...)
+		if _, err := Import(bytes.NewReader(oversized), NewSimpleMap(), NewSimpleMap(), sha256.New()); !errors.Is(err, ErrInvalidExport) {
+			t.Errorf("expected ErrInvalidExport when importing value of size %d, got: %v", size, err)
+		}
+	}
+}
+
+// Test that the tree builder holds at most one subtree per level of the tree.
+func TestTreeBuilderBoundedMemory(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	b := newTreeBuilder(smt)
+	var maxStack int
+	for i := 0; i < 256; i++ {
+		// Paths that share ever longer prefixes keep every subtree open.
+		path := make([]byte, 32)
+		for j := 0; j < i/8; j++ {
+			path[j] = 0xff
+		}
+		path[i/8] = ^byte(0xff >> uint(i%8))
+		if err := b.add(path, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("returned error when adding leaf: %v", err)
+		}
+		if len(b.stack) > maxStack {
+			maxStack = len(b.stack)
+		}
+	}
+	if maxStack > smt.depth() {
+		t.Errorf("expected at most %d subtrees held, got %d", smt.depth(), maxStack)
+	}
+}
@@ -0,0 +1,599 @@
+// Package filestore implements a persistent, log-structured smt.MapStore on
+// files.
+//
+// Every write is appended as a record to a data file in a directory, and an
+// index of the latest record of every key is kept in memory, and rebuilt from
+// the data files when the store is opened. A record that was not written in
+// full at the end of the last data file, for instance because of a crash, is
+// discarded when the store is opened again.
+//
+// The space of records that were overwritten or deleted is reclaimed by
+// compaction, which copies the live records of older data files to the
+// current one and removes the older files.
+package filestore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/celestiaorg/smt"
+)
+
+// ErrCorrupt is returned when opening a store with a data file that has an
+// invalid record before its end, or is not the last data file.
+var ErrCorrupt = errors.New("corrupt data file")
+
+// ErrClosed is returned when using a store that was closed.
+var ErrClosed = errors.New("store closed")
+
+// ErrTooLarge is returned when setting a key or value whose size does not fit
+// in a record.
+var ErrTooLarge = errors.New("key or value too large")
+
+const (
+	// headerSize is the size of the header of a record: a checksum of the
+	// rest of the record, the kind of record, and the sizes of the key and
+	// value.
+	headerSize = 4 + 1 + 4 + 4
+	// maxFieldSize is the largest size of a key or value in a record.
+	maxFieldSize = math.MaxUint32
+
+	dataFileSuffix = ".data"
+)
+
+// The kinds of records.
+const (
+	recordSet = iota + 1
+	recordDelete
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy is when the data files of a store are synced to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs the current data file after every write.
+	SyncAlways SyncPolicy = iota
+	// SyncNever leaves syncing to the operating system, except when a data
+	// file is completed, compacted or closed. Writes that were not synced may
+	// be lost in a crash of the operating system, but not in a crash of the
+	// process. Sync can be called to sync writes at chosen points.
+	SyncNever
+)
+
+// Option is a function that configures a Store.
+type Option func(*Store)
+
+// WithSyncPolicy sets when the data files are synced to stable storage. The
+// default is SyncAlways.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(s *Store) {
+		s.syncPolicy = policy
+	}
+}
+
+// WithMaxFileSize sets the size after which a new data file is started. The
+// default is 64 MiB. Only data files that are no longer written to are
+// compacted.
+func WithMaxFileSize(size int64) Option {
+	return func(s *Store) {
+		s.maxFileSize = size
+	}
+}
+
+// WithCompactionThreshold sets the fraction of the size of a data file taken
+// by overwritten and deleted records, from which it is compacted. The default
+// is 0.5.
+func WithCompactionThreshold(threshold float64) Option {
+	return func(s *Store) {
+		s.compactionThreshold = threshold
+	}
+}
+
+// WithCompactionInterval compacts the store in the background at an interval,
+// until it is closed.
+func WithCompactionInterval(interval time.Duration) Option {
+	return func(s *Store) {
+		s.compactionInterval = interval
+	}
+}
+
+// Store is a persistent smt.MapStore on the data files of a directory. It is
+// safe for concurrent use.
+type Store struct {
+	dir                 string
+	syncPolicy          SyncPolicy
+	maxFileSize         int64
+	compactionThreshold float64
+	compactionInterval  time.Duration
+
+	mu     sync.RWMutex
+	files  []*dataFile
+	index  keyIndex
+	closed bool
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// dataFile is a data file of a store.
+type dataFile struct {
+	id   uint64
+	f    *os.File
+	size int64
+	// dead is the size of the records of the file that were overwritten or
+	// deleted, and of its deletion records.
+	dead int64
+}
+
+// location is the location of the latest record of a key.
+type location struct {
+	file   *dataFile
+	offset int64
+	size   uint32
+}
+
+// Open opens the store in a directory, creating the directory if it does not
+// exist.
+func Open(dir string, options ...Option) (*Store, error) {
+	s := &Store{
+		dir:                 dir,
+		syncPolicy:          SyncAlways,
+		maxFileSize:         64 << 20,
+		compactionThreshold: 0.5,
+		index:               make(keyIndex),
+	}
+	for _, option := range options {
+		option(s)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	if s.compactionInterval > 0 {
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+		go s.compactInBackground()
+	}
+	return s, nil
+}
+
+// Get gets the value for a key.
+func (s *Store) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	loc, ok := s.index[string(key)]
+	if !ok {
+		return nil, &smt.InvalidKeyError{Key: key}
+	}
+	value := make([]byte, loc.size)
+	if _, err := loc.file.f.ReadAt(value, loc.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Set updates the value for a key.
+func (s *Store) Set(key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if uint64(len(key)) > maxFieldSize || uint64(len(value)) > maxFieldSize {
+		return ErrTooLarge
+	}
+	if err := s.append(recordSet, key, value); err != nil {
+		return err
+	}
+	return s.syncIfAlways()
+}
+
+// Delete deletes a key.
+func (s *Store) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if _, ok := s.index[string(key)]; !ok {
+		return &smt.InvalidKeyError{Key: key}
+	}
+	if err := s.append(recordDelete, key, nil); err != nil {
+		return err
+	}
+	return s.syncIfAlways()
+}
+
+// Iterate calls fn with every key that starts with a prefix and its value, in
+// increasing order of key, until fn returns false. Keys that are set or
+// deleted during the iteration may or may not be seen.
+func (s *Store) Iterate(prefix []byte, fn func(key []byte, value []byte) bool) error {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return ErrClosed
+	}
+	var keys []string
+	for key := range s.index {
+		if strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := s.Get([]byte(key))
+		if err != nil {
+			var invalidKeyError *smt.InvalidKeyError
+			if errors.As(err, &invalidKeyError) {
+				// The key was deleted during the iteration.
+				continue
+			}
+			return err
+		}
+		if !fn([]byte(key), value) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Sync syncs the current data file to stable storage.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return s.active().f.Sync()
+}
+
+// Close syncs and closes the data files of the store, after stopping the
+// background compaction.
+func (s *Store) Close() error {
+	if s.stop != nil {
+		s.stopOnce.Do(func() {
+			close(s.stop)
+			<-s.done
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	err := s.active().f.Sync()
+	if closeErr := s.closeFiles(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Compact compacts the data files that are no longer written to, and whose
+// overwritten and deleted records take at least the compaction threshold of
+// their size. Their live records are copied to the current data file, and
+// they are removed.
+func (s *Store) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+
+	var compacted []*dataFile
+	for _, file := range s.files[:len(s.files)-1] {
+		if file.size > 0 && float64(file.dead) >= s.compactionThreshold*float64(file.size) {
+			compacted = append(compacted, file)
+		}
+	}
+	if len(compacted) == 0 {
+		return nil
+	}
+
+	for _, file := range compacted {
+		if err := s.copyLiveRecords(file); err != nil {
+			return err
+		}
+	}
+	// The copies must be stable before the files are removed.
+	if err := s.active().f.Sync(); err != nil {
+		return err
+	}
+	for _, file := range compacted {
+		if err := s.removeFile(file); err != nil {
+			return err
+		}
+	}
+	return syncDir(s.dir)
+}
+
+// copyLiveRecords appends the records of a data file that are the latest of
+// their key to the current data file. Deletion records are also copied while
+// an older data file is kept, which may have records of their keys.
+func (s *Store) copyLiveRecords(file *dataFile) error {
+	older := s.files[0] != file
+	return scanRecords(file.f, func(offset int64, kind byte, key []byte, value []byte) error {
+		loc, ok := s.index[string(key)]
+		switch {
+		case kind == recordSet && ok && loc.file == file && loc.offset == offset+headerSize+int64(len(key)):
+			return s.append(recordSet, key, value)
+		case kind == recordDelete && !ok && older:
+			return s.append(recordDelete, key, nil)
+		}
+		return nil
+	})
+}
+
+// compactInBackground compacts the store at the compaction interval until it
+// is closed.
+func (s *Store) compactInBackground() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.compactionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			// Errors are returned again by the writes that follow.
+			_ = s.Compact()
+		}
+	}
+}
+
+// load opens the data files of the directory, and builds the index from their
+// records.
+func (s *Store) load() error {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, info := range infos {
+		name := info.Name()
+		if !strings.HasSuffix(name, dataFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, dataFileSuffix), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for i, id := range ids {
+		f, err := os.OpenFile(s.fileName(id), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		file := &dataFile{id: id, f: f}
+		s.files = append(s.files, file)
+
+		err = scanRecords(f, func(offset int64, kind byte, key []byte, value []byte) error {
+			file.size = offset + recordSize(len(key), len(value))
+			s.index.apply(file, offset, kind, key, value)
+			return nil
+		})
+		if errors.Is(err, errTornRecord) {
+			if i != len(ids)-1 {
+				return fmt.Errorf("%w: %s", ErrCorrupt, f.Name())
+			}
+			// The last record was not written in full.
+			if err := f.Truncate(file.size); err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if len(s.files) == 0 || s.active().size >= s.maxFileSize {
+		return s.startFile()
+	}
+	return nil
+}
+
+// append appends a record to the current data file, and updates the index.
+func (s *Store) append(kind byte, key []byte, value []byte) error {
+	if s.active().size >= s.maxFileSize {
+		if err := s.active().f.Sync(); err != nil {
+			return err
+		}
+		if err := s.startFile(); err != nil {
+			return err
+		}
+	}
+
+	file := s.active()
+	record := encodeRecord(kind, key, value)
+	if _, err := file.f.WriteAt(record, file.size); err != nil {
+		return err
+	}
+	offset := file.size
+	file.size += int64(len(record))
+	s.index.apply(file, offset, kind, key, value)
+	return nil
+}
+
+// startFile starts a new data file.
+func (s *Store) startFile() error {
+	var id uint64
+	if len(s.files) > 0 {
+		id = s.active().id + 1
+	}
+	f, err := os.OpenFile(s.fileName(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, &dataFile{id: id, f: f})
+	return syncDir(s.dir)
+}
+
+// removeFile closes and removes a data file.
+func (s *Store) removeFile(file *dataFile) error {
+	for i, f := range s.files {
+		if f == file {
+			s.files = append(s.files[:i], s.files[i+1:]...)
+			break
+		}
+	}
+	if err := file.f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(file.f.Name())
+}
+
+func (s *Store) active() *dataFile {
+	return s.files[len(s.files)-1]
+}
+
+func (s *Store) syncIfAlways() error {
+	if s.syncPolicy == SyncAlways {
+		return s.active().f.Sync()
+	}
+	return nil
+}
+
+func (s *Store) closeFiles() error {
+	var err error
+	for _, file := range s.files {
+		if closeErr := file.f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *Store) fileName(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%016x%s", id, dataFileSuffix))
+}
+
+// keyIndex is the location of the latest record of every key.
+type keyIndex map[string]location
+
+// apply updates the index with a record at an offset of a data file, and
+// counts the records that it makes dead.
+func (idx keyIndex) apply(file *dataFile, offset int64, kind byte, key []byte, value []byte) {
+	if old, ok := idx[string(key)]; ok {
+		old.file.dead += recordSize(len(key), int(old.size))
+	}
+	if kind == recordDelete {
+		delete(idx, string(key))
+		file.dead += recordSize(len(key), 0)
+		return
+	}
+	idx[string(key)] = location{
+		file:   file,
+		offset: offset + headerSize + int64(len(key)),
+		size:   uint32(len(value)),
+	}
+}
+
+var errTornRecord = errors.New("torn record")
+
+// scanRecords calls fn with every record of a data file and its offset, in
+// order. errTornRecord is returned if the file ends with an invalid record,
+// and ErrCorrupt if an invalid record is followed by more data.
+func scanRecords(f *os.File, fn func(offset int64, kind byte, key []byte, value []byte) error) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := io.NewSectionReader(f, 0, info.Size())
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return errTornRecord
+			}
+			return err
+		}
+		keySize, valueSize := binary.BigEndian.Uint32(header[5:9]), binary.BigEndian.Uint32(header[9:13])
+		if offset+recordSize(int(keySize), int(valueSize)) > info.Size() {
+			return errTornRecord
+		}
+		body := make([]byte, int64(keySize)+int64(valueSize))
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return errTornRecord
+			}
+			return err
+		}
+		crc := crc32.Update(crc32.Checksum(header[4:], crcTable), crcTable, body)
+		kind := header[4]
+		if crc != binary.BigEndian.Uint32(header) || (kind != recordSet && kind != recordDelete) {
+			if offset+recordSize(int(keySize), int(valueSize)) < info.Size() {
+				return fmt.Errorf("%w: %s at offset %d", ErrCorrupt, f.Name(), offset)
+			}
+			return errTornRecord
+		}
+
+		if err := fn(offset, kind, body[:keySize], body[keySize:]); err != nil {
+			return err
+		}
+		offset += headerSize + int64(len(body))
+	}
+}
+
+func encodeRecord(kind byte, key []byte, value []byte) []byte {
+	record := make([]byte, recordSize(len(key), len(value)))
+	record[4] = kind
+	binary.BigEndian.PutUint32(record[5:9], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[9:13], uint32(len(value)))
+	copy(record[headerSize:], key)
+	copy(record[headerSize+len(key):], value)
+	binary.BigEndian.PutUint32(record, crc32.Checksum(record[4:], crcTable))
+	return record
+}
+
+func recordSize(keySize int, valueSize int) int64 {
+	return headerSize + int64(keySize) + int64(valueSize)
+}
+
+// syncDir syncs a directory, so that the files that were created in it or
+// removed from it are stable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,319 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/celestiaorg/smt"
+	"github.com/celestiaorg/smt/smttest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatalf("returned error when creating directory: %v", err)
+	}
+	return dir
+}
+
+func dirSize(t *testing.T, dir string) int64 {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("returned error when reading directory: %v", err)
+	}
+	var size int64
+	for _, info := range infos {
+		size += info.Size()
+	}
+	return size
+}
+
+// Test that writes are kept when the store is opened again.
+func TestStore(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := Open(dir, WithMaxFileSize(1000), WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatalf("returned error when opening store: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		s.Set([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i)))
+	}
+	for i := 0; i < 100; i += 2 {
+		if err := s.Delete([]byte(strconv.Itoa(i))); err != nil {
+			t.Errorf("returned error when deleting key: %v", err)
+		}
+	}
+	s.Set([]byte("1"), []byte("newValue"))
+
+	var invalidKeyError *smt.InvalidKeyError
+	if err := s.Delete([]byte("0")); !errors.As(err, &invalidKeyError) {
+		t.Errorf("expected InvalidKeyError when deleting missing key, got: %v", err)
+	}
+	var keys []string
+	err = s.Iterate([]byte("9"), func(key []byte, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("returned error when iterating: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"9", "91", "93", "95", "97", "99"}, keys) {
+		t.Errorf("expected keys of odd numbers from 9 when iterating, got %v", keys)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("returned error when closing store: %v", err)
+	}
+	if _, err := s.Get([]byte("1")); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed when getting key from closed store, got: %v", err)
+	}
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatalf("returned error when reopening store: %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		value, err := s.Get([]byte(strconv.Itoa(i)))
+		switch {
+		case i == 1:
+			if !bytes.Equal([]byte("newValue"), value) {
+				t.Error("did not get overwritten value after reopening store")
+			}
+		case i%2 == 0:
+			if !errors.As(err, &invalidKeyError) {
+				t.Errorf("expected InvalidKeyError when getting deleted key, got: %v", err)
+			}
+		default:
+			if !bytes.Equal([]byte("value"+strconv.Itoa(i)), value) {
+				t.Error("did not get value after reopening store")
+			}
+		}
+	}
+}
+
+// Test that a record that was not written in full is discarded.
+func TestStoreTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _ := Open(dir)
+	s.Set([]byte("testKey"), []byte("testValue"))
+	s.Set([]byte("testKey2"), []byte("testValue2"))
+	s.Close()
+
+	// Cut the last record short.
+	name := filepath.Join(dir, "0000000000000000.data")
+	info, _ := os.Stat(name)
+	os.Truncate(name, info.Size()-3)
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("returned error when opening store with torn record: %v", err)
+	}
+	if value, _ := s.Get([]byte("testKey")); !bytes.Equal([]byte("testValue"), value) {
+		t.Error("did not get value of complete record")
+	}
+	if _, err := s.Get([]byte("testKey2")); err == nil {
+		t.Error("did not discard torn record")
+	}
+	s.Set([]byte("testKey3"), []byte("testValue3"))
+	s.Close()
+
+	s, _ = Open(dir)
+	defer s.Close()
+	if value, _ := s.Get([]byte("testKey3")); !bytes.Equal([]byte("testValue3"), value) {
+		t.Error("did not get value written after torn record")
+	}
+}
+
+// Test that a store with an invalid record before the end of its last data
+// file is not opened.
+func TestStoreCorruptRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _ := Open(dir)
+	s.Set([]byte("testKey"), []byte("testValue"))
+	s.Set([]byte("testKey2"), []byte("testValue2"))
+	s.Close()
+
+	// Flip a byte of the value of the first record.
+	name := filepath.Join(dir, "0000000000000000.data")
+	f, _ := os.OpenFile(name, os.O_RDWR, 0644)
+	f.WriteAt([]byte{'x'}, headerSize+int64(len("testKey")))
+	f.Close()
+	info, _ := os.Stat(name)
+
+	if _, err := Open(dir); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt when opening store with corrupt record, got: %v", err)
+	}
+	if newInfo, _ := os.Stat(name); newInfo.Size() != info.Size() {
+		t.Error("truncated data file with corrupt record")
+	}
+}
+
+// Test that keys and values too large for a record are not set.
+func TestStoreTooLarge(t *testing.T) {
+	if strconv.IntSize < 64 {
+		t.Skip("slices cannot be larger than records on 32-bit platforms")
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _ := Open(dir)
+	defer s.Close()
+	// The slice is not written to, so its memory is not used.
+	size := uint64(math.MaxUint32) + 1
+	large := make([]byte, size)
+	if err := s.Set(large, []byte("testValue")); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge when setting key too large, got: %v", err)
+	}
+	if err := s.Set([]byte("testKey"), large); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("expected ErrTooLarge when setting value too large, got: %v", err)
+	}
+	if size := dirSize(t, dir); size != 0 {
+		t.Errorf("expected empty data file after setting keys and values too large, got size %d", size)
+	}
+}
+
+// Test that compaction reclaims space, and keeps deleted keys deleted.
+func TestStoreCompact(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _ := Open(dir, WithMaxFileSize(500))
+	for i := 0; i < 200; i++ {
+		s.Set([]byte(strconv.Itoa(i)), bytes.Repeat([]byte{byte(i)}, 20))
+	}
+	for i := 0; i < 200; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		s.Delete([]byte(strconv.Itoa(i)))
+	}
+	size := dirSize(t, dir)
+	if err := s.Compact(); err != nil {
+		t.Errorf("returned error when compacting store: %v", err)
+	}
+	if compacted := dirSize(t, dir); compacted > size/2 {
+		t.Errorf("expected compaction to reclaim at least half of %d bytes, got %d bytes", size, compacted)
+	}
+	s.Close()
+
+	s, _ = Open(dir)
+	defer s.Close()
+	for i := 0; i < 200; i++ {
+		value, err := s.Get([]byte(strconv.Itoa(i)))
+		if i%10 == 0 && !bytes.Equal(bytes.Repeat([]byte{byte(i)}, 20), value) {
+			t.Error("did not get value after compacting store")
+		}
+		if i%10 != 0 && err == nil {
+			t.Error("got deleted key after compacting store")
+		}
+	}
+}
+
+// Test a tree on stores that are reopened, and compacted in the background.
+func TestStoreTree(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	options := []Option{WithMaxFileSize(4096), WithSyncPolicy(SyncNever), WithCompactionInterval(time.Millisecond)}
+	nodes, _ := Open(filepath.Join(dir, "nodes"), options...)
+	values, _ := Open(filepath.Join(dir, "values"), options...)
+	tree := smt.NewSparseMerkleTree(nodes, values, sha256.New())
+	for i := 0; i < 500; i++ {
+		s := strconv.Itoa(i % 50)
+		if _, err := tree.Update([]byte(s), []byte(strconv.Itoa(i))); err != nil {
+			t.Errorf("returned error when updating tree: %v", err)
+		}
+	}
+	root := tree.Root()
+	nodes.Close()
+	values.Close()
+
+	nodes, _ = Open(filepath.Join(dir, "nodes"))
+	values, _ = Open(filepath.Join(dir, "values"))
+	defer nodes.Close()
+	defer values.Close()
+	tree = smt.ImportSparseMerkleTree(nodes, values, sha256.New(), root)
+	for i := 450; i < 500; i++ {
+		key := []byte(strconv.Itoa(i % 50))
+		value, err := tree.Get(key)
+		if err != nil {
+			t.Errorf("returned error when getting key from reopened tree: %v", err)
+		}
+		if !bytes.Equal([]byte(strconv.Itoa(i)), value) {
+			t.Error("did not get correct value from reopened tree")
+		}
+		proof, err := tree.Prove(key)
+		if err != nil || !smt.VerifyProof(proof, root, key, value, sha256.New()) {
+			t.Error("proof from reopened tree failed to verify")
+		}
+	}
+}
+
+// Test that deletions are kept when their data file is compacted before the
+// data file of the deleted record.
+func TestStoreCompactDeletion(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, _ := Open(dir, WithMaxFileSize(500))
+	s.Set([]byte("deletedKey"), []byte("value"))
+	for i := 0; i < 30; i++ {
+		s.Set([]byte(strconv.Itoa(i)), []byte("value"))
+	}
+	// The deletion goes to a data file whose other records are overwritten.
+	s.Delete([]byte("deletedKey"))
+	for i := 0; i < 40; i++ {
+		s.Set([]byte("overwrittenKey"), []byte(strconv.Itoa(i)))
+	}
+	if err := s.Compact(); err != nil {
+		t.Errorf("returned error when compacting store: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "0000000000000000.data")); err != nil {
+		t.Error("compacted data file with few overwritten records")
+	}
+	s.Close()
+
+	s, _ = Open(dir)
+	defer s.Close()
+	if _, err := s.Get([]byte("deletedKey")); err == nil {
+		t.Error("got deleted key after compacting store")
+	}
+	if value, _ := s.Get([]byte("overwrittenKey")); !bytes.Equal([]byte("39"), value) {
+		t.Error("did not get overwritten value after compacting store")
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var stores []*Store
+	defer func() {
+		for _, s := range stores {
+			s.Close()
+		}
+	}()
+	smttest.TestMapStore(t, func(t *testing.T) smt.MapStore {
+		s, err := Open(filepath.Join(dir, strconv.Itoa(len(stores))), WithSyncPolicy(SyncNever))
+		if err != nil {
+			t.Fatalf("returned error when opening store: %v", err)
+		}
+		stores = append(stores, s)
+		return s
+	})
+}
@@ -0,0 +1,425 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// SparseMerkleHexTree is a Sparse Merkle tree in which every inner node has 16
+// children, one per 4-bit nibble of the path. Lookups read roughly 4x fewer
+// nodes than in a SparseMerkleTree, in exchange for proofs that carry up to 15
+// sibling nodes per level.
+type SparseMerkleHexTree struct {
+	th            treeHasher
+	nodes, values MapStore
+	root          []byte
+}
+
+// NewSparseMerkleHexTree creates a new hexary Sparse Merkle tree on an empty MapStore.
+func NewSparseMerkleHexTree(nodes, values MapStore, hasher hash.Hash) *SparseMerkleHexTree {
+	smht := SparseMerkleHexTree{
+		th:     *newTreeHasher(hasher),
+		nodes:  nodes,
+		values: values,
+	}
+	smht.SetRoot(smht.th.placeholder())
+
+	return &smht
+}
+
+// ImportSparseMerkleHexTree imports a hexary Sparse Merkle tree from a non-empty MapStore.
+func ImportSparseMerkleHexTree(nodes, values MapStore, hasher hash.Hash, root []byte) *SparseMerkleHexTree {
+	return &SparseMerkleHexTree{
+		th:     *newTreeHasher(hasher),
+		nodes:  nodes,
+		values: values,
+		root:   root,
+	}
+}
+
+// Root gets the root of the tree.
+func (smht *SparseMerkleHexTree) Root() []byte {
+	return smht.root
+}
+
+// SetRoot sets the root of the tree.
+func (smht *SparseMerkleHexTree) SetRoot(root []byte) {
+	smht.root = root
+}
+
+// depth returns the depth of the tree in nibbles.
+func (smht *SparseMerkleHexTree) depth() int {
+	return smht.th.pathSize() * 2
+}
+
+// Get gets the value of a key from the tree.
+func (smht *SparseMerkleHexTree) Get(key []byte) ([]byte, error) {
+	if bytes.Equal(smht.Root(), smht.th.placeholder()) {
+		// The tree is empty, return the default value.
+		return defaultValue, nil
+	}
+
+	value, err := smht.values.Get(smht.th.path(key))
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			// If key isn't found, return default value
+			return defaultValue, nil
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// Has returns true if the value at the given key is non-default, false
+// otherwise.
+func (smht *SparseMerkleHexTree) Has(key []byte) (bool, error) {
+	val, err := smht.Get(key)
+	return !bytes.Equal(defaultValue, val), err
+}
+
+// Update sets a new value for a key in the tree, and sets and returns the new root of the tree.
+func (smht *SparseMerkleHexTree) Update(key []byte, value []byte) ([]byte, error) {
+	newRoot, err := smht.UpdateForRoot(key, value, smht.Root())
+	if err != nil {
+		return nil, err
+	}
+	smht.SetRoot(newRoot)
+	return newRoot, nil
+}
+
+// Delete deletes a value from tree. It returns the new root of the tree.
+func (smht *SparseMerkleHexTree) Delete(key []byte) ([]byte, error) {
+	return smht.Update(key, defaultValue)
+}
+
+// DeleteForRoot deletes a value from tree at a specific root. It returns the new root of the tree.
+func (smht *SparseMerkleHexTree) DeleteForRoot(key, root []byte) ([]byte, error) {
+	return smht.UpdateForRoot(key, defaultValue, root)
+}
+
+// UpdateForRoot sets a new value for a key in the tree at a specific root, and returns the new root.
+func (smht *SparseMerkleHexTree) UpdateForRoot(key []byte, value []byte, root []byte) ([]byte, error) {
+	path := smht.th.path(key)
+	levels, pathNodes, oldLeafData, err := smht.levelsForRoot(path, root)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(value, defaultValue) {
+		// Delete operation.
+		newRoot, err := smht.deleteWithLevels(path, levels, pathNodes, oldLeafData)
+		if errors.Is(err, errKeyAlreadyEmpty) {
+			// This key is already empty; return the old root.
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := smht.values.Delete(path); err != nil {
+			return nil, err
+		}
+		return newRoot, nil
+	}
+
+	// Insert or update operation.
+	return smht.updateWithLevels(path, value, levels, pathNodes, oldLeafData)
+}
+
+func (smht *SparseMerkleHexTree) updateWithLevels(path []byte, value []byte, levels [][][]byte, pathNodes [][]byte, oldLeafData []byte) ([]byte, error) {
+	valueHash := smht.th.digest(value)
+	currentHash, currentData := smht.th.digestLeaf(path, valueHash)
+
+	// The leaf goes at the position where the path ended, below the last
+	// inner node of the path.
+	n := len(levels)
+	if oldLeafData != nil {
+		actualPath, oldValueHash := smht.th.parseLeaf(oldLeafData)
+		if bytes.Equal(path, actualPath) {
+			if bytes.Equal(oldValueHash, valueHash) {
+				// The value is unchanged; return the old root.
+				return pathNodes[0], nil
+			}
+			// The leaf is being updated; delete the old leaf.
+			if err := smht.nodes.Delete(pathNodes[n]); err != nil {
+				return nil, err
+			}
+		} else {
+			// The position is taken by a different leaf. Create the inner
+			// nodes down to the first nibble where the two paths differ,
+			// where both leaves become children of the same node.
+			if err := smht.nodes.Set(currentHash, currentData); err != nil {
+				return nil, err
+			}
+			commonPrefixCount := countCommonPrefix(path, actualPath) / 4
+			children := smht.emptyChildren()
+			children[getNibbleAtFromMSB(path, commonPrefixCount)] = currentHash
+			children[getNibbleAtFromMSB(actualPath, commonPrefixCount)] = pathNodes[n]
+			currentHash, currentData = smht.th.digestHexNode(children)
+			for i := commonPrefixCount - 1; i >= n; i-- {
+				if err := smht.nodes.Set(currentHash, currentData); err != nil {
+					return nil, err
+				}
+				children := smht.emptyChildren()
+				children[getNibbleAtFromMSB(path, i)] = currentHash
+				currentHash, currentData = smht.th.digestHexNode(children)
+			}
+		}
+	}
+	if err := smht.nodes.Set(currentHash, currentData); err != nil {
+		return nil, err
+	}
+
+	// Rebuild the inner nodes of the path bottom-up, deleting the old ones.
+	for i := n - 1; i >= 0; i-- {
+		if err := smht.nodes.Delete(pathNodes[i]); err != nil {
+			return nil, err
+		}
+		children := append([][]byte(nil), levels[i]...)
+		children[getNibbleAtFromMSB(path, i)] = currentHash
+		currentHash, currentData = smht.th.digestHexNode(children)
+		if err := smht.nodes.Set(currentHash, currentData); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := smht.values.Set(path, value); err != nil {
+		return nil, err
+	}
+
+	return currentHash, nil
+}
+
+func (smht *SparseMerkleHexTree) deleteWithLevels(path []byte, levels [][][]byte, pathNodes [][]byte, oldLeafData []byte) ([]byte, error) {
+	if oldLeafData == nil {
+		// This key is already empty as it is a placeholder; return an error.
+		return nil, errKeyAlreadyEmpty
+	}
+	if actualPath, _ := smht.th.parseLeaf(oldLeafData); !bytes.Equal(path, actualPath) {
+		// This key is already empty as a different key was found its place; return an error.
+		return nil, errKeyAlreadyEmpty
+	}
+
+	// All nodes above the leaf are orphaned.
+	for _, node := range pathNodes {
+		if err := smht.nodes.Delete(node); err != nil {
+			return nil, err
+		}
+	}
+
+	// Rebuild the inner nodes of the path bottom-up. As long as the current
+	// node is a leaf or a placeholder, an inner node that is left with a
+	// single leaf child is replaced by that leaf, so that leaves bubble up
+	// to the shallowest depth at which they are unique.
+	currentHash := smht.th.placeholder()
+	var currentData []byte
+	bubbling := true
+	for i := len(levels) - 1; i >= 0; i-- {
+		nibble := getNibbleAtFromMSB(path, i)
+		children := append([][]byte(nil), levels[i]...)
+		children[nibble] = currentHash
+
+		if bubbling {
+			count, only := 0, 0
+			for j, child := range children {
+				if !bytes.Equal(child, smht.th.placeholder()) {
+					count++
+					only = j
+				}
+			}
+			if count == 0 {
+				currentHash = smht.th.placeholder()
+				continue
+			}
+			if count == 1 {
+				if only == nibble {
+					// The only child is the current leaf.
+					continue
+				}
+				onlyData, err := smht.nodes.Get(children[only])
+				if err != nil {
+					return nil, err
+				}
+				if smht.th.isLeaf(onlyData) {
+					currentHash = children[only]
+					continue
+				}
+			}
+			bubbling = false
+		}
+
+		currentHash, currentData = smht.th.digestHexNode(children)
+		if err := smht.nodes.Set(currentHash, currentData); err != nil {
+			return nil, err
+		}
+	}
+
+	return currentHash, nil
+}
+
+// levelsForRoot gets the children of every inner node on a given path from a
+// given root, starting from the root. It also returns the hashes of the nodes
+// on the path, starting from the root, and the data of the leaf that the path
+// ends at.
+//
+// If the path ends at a placeholder, the leaf data is nil.
+func (smht *SparseMerkleHexTree) levelsForRoot(path []byte, root []byte) ([][][]byte, [][]byte, []byte, error) {
+	var levels [][][]byte
+	pathNodes := [][]byte{root}
+
+	if bytes.Equal(root, smht.th.placeholder()) {
+		return levels, pathNodes, nil, nil
+	}
+
+	currentData, err := smht.nodes.Get(root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i := 0; i < smht.depth() && !smht.th.isLeaf(currentData); i++ {
+		children := smht.th.parseHexNode(currentData)
+		nodeHash := children[getNibbleAtFromMSB(path, i)]
+		levels = append(levels, children)
+		pathNodes = append(pathNodes, nodeHash)
+
+		if bytes.Equal(nodeHash, smht.th.placeholder()) {
+			// If the node is a placeholder, we've reached the end.
+			return levels, pathNodes, nil, nil
+		}
+
+		currentData, err = smht.nodes.Get(nodeHash)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return levels, pathNodes, currentData, nil
+}
+
+func (smht *SparseMerkleHexTree) emptyChildren() [][]byte {
+	children := make([][]byte, hexArity)
+	for i := range children {
+		children[i] = smht.th.placeholder()
+	}
+	return children
+}
+
+// SparseMerkleHexProof is a Merkle proof for an element in a SparseMerkleHexTree.
+type SparseMerkleHexProof struct {
+	// SideNodes is an array of the sibling nodes of each inner node leading
+	// up to the leaf of the proof, starting from the bottom. Every level has
+	// 15 sibling nodes, in the order of their nibble.
+	SideNodes [][][]byte
+
+	// NonMembershipLeafData is the data of the unrelated leaf at the position
+	// of the key being proven, in the case of a non-membership proof. For
+	// membership proofs, is nil.
+	NonMembershipLeafData []byte
+}
+
+// Prove generates a Merkle proof for a key against the current root.
+func (smht *SparseMerkleHexTree) Prove(key []byte) (SparseMerkleHexProof, error) {
+	return smht.ProveForRoot(key, smht.Root())
+}
+
+// ProveForRoot generates a Merkle proof for a key, against a specific node.
+func (smht *SparseMerkleHexTree) ProveForRoot(key []byte, root []byte) (SparseMerkleHexProof, error) {
+	path := smht.th.path(key)
+	levels, _, leafData, err := smht.levelsForRoot(path, root)
+	if err != nil {
+		return SparseMerkleHexProof{}, err
+	}
+
+	sideNodes := make([][][]byte, len(levels))
+	for i, children := range levels {
+		nibble := getNibbleAtFromMSB(path, i)
+		siblings := make([][]byte, 0, hexArity-1)
+		siblings = append(siblings, children[:nibble]...)
+		siblings = append(siblings, children[nibble+1:]...)
+		sideNodes[len(levels)-1-i] = siblings
+	}
+
+	// Deal with non-membership proofs. If the path ends at a placeholder, we
+	// do not need to add anything else to the proof.
+	var nonMembershipLeafData []byte
+	if leafData != nil {
+		if actualPath, _ := smht.th.parseLeaf(leafData); !bytes.Equal(actualPath, path) {
+			// This is a non-membership proof that involves showing a different leaf.
+			// Add the leaf data to the proof.
+			nonMembershipLeafData = leafData
+		}
+	}
+
+	return SparseMerkleHexProof{
+		SideNodes:             sideNodes,
+		NonMembershipLeafData: nonMembershipLeafData,
+	}, nil
+}
+
+func (proof *SparseMerkleHexProof) sanityCheck(th *treeHasher) bool {
+	// Check that the number of supplied levels does not exceed the depth of
+	// the tree, and that every level has the right number of siblings.
+	if len(proof.SideNodes) > th.pathSize()*2 {
+		return false
+	}
+	for _, siblings := range proof.SideNodes {
+		if len(siblings) != hexArity-1 {
+			return false
+		}
+		for _, v := range siblings {
+			if len(v) != th.nodeSize() {
+				return false
+			}
+		}
+	}
+
+	// Check that leaf data for non-membership proofs is the correct size.
+	if proof.NonMembershipLeafData != nil {
+		if len(proof.NonMembershipLeafData) != len(leafPrefix)+th.pathSize()+th.leafDataSize() ||
+			!th.isLeaf(proof.NonMembershipLeafData) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// VerifyHexProof verifies a Merkle proof for a key and value in a
+// SparseMerkleHexTree.
+func VerifyHexProof(proof SparseMerkleHexProof, root []byte, key []byte, value []byte, hasher hash.Hash) bool {
+	th := newTreeHasher(hasher)
+	path := th.path(key)
+
+	if !proof.sanityCheck(th) {
+		return false
+	}
+
+	// Determine what the leaf hash should be.
+	var currentHash []byte
+	if bytes.Equal(value, defaultValue) { // Non-membership proof.
+		if proof.NonMembershipLeafData == nil { // Leaf is a placeholder value.
+			currentHash = th.placeholder()
+		} else { // Leaf is an unrelated leaf.
+			actualPath, valueHash := th.parseLeaf(proof.NonMembershipLeafData)
+			if bytes.Equal(actualPath, path) {
+				// This is not an unrelated leaf; non-membership proof failed.
+				return false
+			}
+			currentHash, _ = th.digestLeaf(actualPath, valueHash)
+		}
+	} else { // Membership proof.
+		currentHash, _ = th.digestLeaf(path, th.digest(value))
+	}
+
+	// Recompute root.
+	for i, siblings := range proof.SideNodes {
+		nibble := getNibbleAtFromMSB(path, len(proof.SideNodes)-1-i)
+		children := make([][]byte, 0, hexArity)
+		children = append(children, siblings[:nibble]...)
+		children = append(children, currentHash)
+		children = append(children, siblings[nibble:]...)
+		currentHash, _ = th.digestHexNode(children)
+	}
+
+	return bytes.Equal(currentHash, root)
+}
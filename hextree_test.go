@@ -0,0 +1,254 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Test base case hexary tree update, get and delete operations with a few keys.
+func TestSparseMerkleHexTreeBasic(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smht := NewSparseMerkleHexTree(smn, smv, sha256.New())
+
+	value, err := smht.Get([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when getting empty key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) {
+		t.Error("did not get default value when getting empty key")
+	}
+
+	_, err = smht.Update([]byte("testKey"), []byte("testValue"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	root1 := smht.Root()
+	_, err = smht.Update([]byte("testKey2"), []byte("testValue2"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	_, err = smht.Update([]byte("testKey"), []byte("testValue3"))
+	if err != nil {
+		t.Errorf("returned error when updating non-empty key: %v", err)
+	}
+
+	value, err = smht.Get([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when getting non-empty key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue3"), value) {
+		t.Error("did not get correct value when getting non-empty key")
+	}
+	has, err := smht.Has([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("returned error when checking non-empty key: %v", err)
+	}
+	if !has {
+		t.Error("did not get 'true' when checking non-empty key")
+	}
+
+	// Test that a tree can be imported from a MapStore.
+	smht2 := ImportSparseMerkleHexTree(smn, smv, sha256.New(), smht.Root())
+	value, err = smht2.Get([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("returned error when getting non-empty key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue2"), value) {
+		t.Error("did not get correct value when getting non-empty key")
+	}
+
+	_, err = smht.Delete([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	_, err = smht.Update([]byte("testKey"), []byte("testValue"))
+	if err != nil {
+		t.Errorf("returned error when updating non-empty key: %v", err)
+	}
+	if !bytes.Equal(root1, smht.Root()) {
+		t.Error("tree root is not as expected after deleting key")
+	}
+
+	_, err = smht.Delete([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	if !bytes.Equal(smht.th.placeholder(), smht.Root()) {
+		t.Error("tree root is not the placeholder after deleting all keys")
+	}
+	if len(smn.m) != 0 || len(smv.m) != 0 {
+		t.Error("nodes or values left in stores after deleting all keys")
+	}
+}
+
+// Test that the root and the stored nodes of a hexary tree only depend on its
+// contents, including when keys share long path prefixes.
+func TestSparseMerkleHexTreeCanonical(t *testing.T) {
+	hasher := newDummyHasher(sha256.New())
+	keys := make([][]byte, 0, 50)
+	seen := make(map[string]bool)
+	for len(keys) < cap(keys) {
+		key := make([]byte, hasher.Size()+4)
+		// Keys share prefixes of various lengths.
+		rand.Read(key[4+rand.Intn(hasher.Size()):])
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			keys = append(keys, key)
+		}
+	}
+
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smht := NewSparseMerkleHexTree(smn, smv, hasher)
+	for _, key := range keys {
+		if _, err := smht.Update(key, key[4:]); err != nil {
+			t.Errorf("returned error when updating key: %v", err)
+		}
+	}
+	for _, key := range keys[:25] {
+		if _, err := smht.Delete(key); err != nil {
+			t.Errorf("returned error when deleting key: %v", err)
+		}
+	}
+
+	smn2, smv2 := NewSimpleMap(), NewSimpleMap()
+	smht2 := NewSparseMerkleHexTree(smn2, smv2, hasher)
+	for i := len(keys) - 1; i >= 25; i-- {
+		if _, err := smht2.Update(keys[i], keys[i][4:]); err != nil {
+			t.Errorf("returned error when updating key: %v", err)
+		}
+	}
+
+	if !bytes.Equal(smht.Root(), smht2.Root()) {
+		t.Error("roots differ for trees with the same contents")
+	}
+	if !reflect.DeepEqual(smn.m, smn2.m) {
+		t.Error("stored nodes differ for trees with the same contents")
+	}
+}
+
+// Test hexary tree membership and non-membership proofs.
+func TestSparseMerkleHexTreeProofs(t *testing.T) {
+	smht := NewSparseMerkleHexTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+
+	// Generate and verify a proof on an empty key.
+	proof, err := smht.Prove([]byte("testKey3"))
+	if err != nil {
+		t.Errorf("error returned when trying to prove non-inclusion: %v", err)
+	}
+	if !VerifyHexProof(proof, smht.Root(), []byte("testKey3"), defaultValue, sha256.New()) {
+		t.Error("valid proof on empty key failed to verify")
+	}
+
+	for i := 0; i < 100; i++ {
+		smht.Update([]byte{byte(i)}, []byte{byte(i), byte(i)})
+	}
+	root := smht.Root()
+
+	proof, err = smht.Prove([]byte{42})
+	if err != nil {
+		t.Errorf("error returned when trying to prove inclusion: %v", err)
+	}
+	if !VerifyHexProof(proof, root, []byte{42}, []byte{42, 42}, sha256.New()) {
+		t.Error("valid proof failed to verify")
+	}
+	if VerifyHexProof(proof, root, []byte{42}, []byte("badValue"), sha256.New()) {
+		t.Error("invalid proof verification returned true for wrong value")
+	}
+	if VerifyHexProof(proof, root, []byte{43}, []byte{42, 42}, sha256.New()) {
+		t.Error("invalid proof verification returned true for wrong key")
+	}
+
+	// Tamper with a side node.
+	tampered := SparseMerkleHexProof{SideNodes: make([][][]byte, len(proof.SideNodes))}
+	for i, siblings := range proof.SideNodes {
+		tampered.SideNodes[i] = append([][]byte{}, siblings...)
+	}
+	tampered.SideNodes[len(tampered.SideNodes)-1][0] = make([]byte, sha256.Size)
+	tampered.SideNodes[len(tampered.SideNodes)-1][0][0] = 1
+	if VerifyHexProof(tampered, root, []byte{42}, []byte{42, 42}, sha256.New()) {
+		t.Error("invalid proof verification returned true for tampered side node")
+	}
+
+	// Malformed proofs must not verify.
+	malformed := SparseMerkleHexProof{SideNodes: [][][]byte{proof.SideNodes[0][:14]}}
+	if VerifyHexProof(malformed, root, []byte{42}, []byte{42, 42}, sha256.New()) {
+		t.Error("invalid proof verification returned true for malformed level")
+	}
+	malformed = SparseMerkleHexProof{SideNodes: proof.SideNodes, NonMembershipLeafData: []byte{0}}
+	if VerifyHexProof(malformed, root, []byte{200}, defaultValue, sha256.New()) {
+		t.Error("invalid proof verification returned true for malformed leaf data")
+	}
+
+	// Non-membership proofs, showing either a placeholder or an unrelated leaf.
+	var unrelated, placeholder bool
+	for i := 100; i < 256; i++ {
+		proof, err = smht.Prove([]byte{byte(i)})
+		if err != nil {
+			t.Errorf("error returned when trying to prove non-inclusion: %v", err)
+		}
+		if !VerifyHexProof(proof, root, []byte{byte(i)}, defaultValue, sha256.New()) {
+			t.Error("valid non-membership proof failed to verify")
+		}
+		if VerifyHexProof(proof, root, []byte{byte(i)}, []byte{byte(i), byte(i)}, sha256.New()) {
+			t.Error("non-membership proof verification returned true for a value")
+		}
+		if proof.NonMembershipLeafData != nil {
+			unrelated = true
+		} else {
+			placeholder = true
+		}
+	}
+	if !unrelated || !placeholder {
+		t.Error("did not generate both kinds of non-membership proofs")
+	}
+
+	// A membership proof cannot be used to prove non-membership.
+	proof, _ = smht.Prove([]byte{42})
+	if VerifyHexProof(proof, root, []byte{42}, defaultValue, sha256.New()) {
+		t.Error("membership proof verified as non-membership proof")
+	}
+}
+
+// Test hexary tree operations in bulk against a map.
+func TestSparseMerkleHexTreeBulk(t *testing.T) {
+	smht := NewSparseMerkleHexTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	kv := make(map[string]string)
+
+	for i := 0; i < 300; i++ {
+		key := make([]byte, 1+rand.Intn(2))
+		rand.Read(key)
+		if rand.Intn(3) == 0 {
+			delete(kv, string(key))
+			if _, err := smht.Delete(key); err != nil {
+				t.Errorf("returned error when deleting key: %v", err)
+			}
+		} else {
+			val := make([]byte, 1+rand.Intn(8))
+			rand.Read(val)
+			kv[string(key)] = string(val)
+			if _, err := smht.Update(key, val); err != nil {
+				t.Errorf("returned error when updating key: %v", err)
+			}
+		}
+	}
+
+	for k, v := range kv {
+		value, err := smht.Get([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when getting key: %v", err)
+		}
+		if !bytes.Equal([]byte(v), value) {
+			t.Error("did not get correct value when getting key")
+		}
+		proof, err := smht.Prove([]byte(k))
+		if err != nil {
+			t.Errorf("error returned when trying to prove inclusion: %v", err)
+		}
+		if !VerifyHexProof(proof, smht.Root(), []byte(k), []byte(v), sha256.New()) {
+			t.Error("valid proof failed to verify")
+		}
+	}
+}
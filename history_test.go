@@ -0,0 +1,122 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+// Test reading a tree at older roots when it keeps its history.
+func TestSparseMerkleTreeGetForRoot(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithHistory())
+	values := []string{"testValue", "testValue2", "testValue3"}
+	var roots [][]byte
+	for _, value := range values {
+		smt.Update([]byte("testKey"), []byte(value))
+		smt.Update([]byte("otherKey"), []byte(value))
+		roots = append(roots, smt.Root())
+	}
+	smt.Delete([]byte("testKey"))
+	deletedRoot := smt.Root()
+
+	for i, root := range roots {
+		value, err := smt.GetForRoot([]byte("testKey"), root)
+		if err != nil {
+			t.Errorf("returned error when getting key at older root: %v", err)
+		}
+		if !bytes.Equal([]byte(values[i]), value) {
+			t.Error("did not get value of older root when getting key at older root")
+		}
+		has, err := smt.HasForRoot([]byte("testKey"), root)
+		if err != nil {
+			t.Errorf("returned error when checking key at older root: %v", err)
+		}
+		if !has {
+			t.Error("did not get 'true' when checking key at older root")
+		}
+
+		proof, err := smt.ProveForRoot([]byte("testKey"), root)
+		if err != nil {
+			t.Errorf("error returned when trying to prove inclusion at older root: %v", err)
+		}
+		if !VerifyProof(proof, root, []byte("testKey"), []byte(values[i]), sha256.New()) {
+			t.Error("valid proof at older root failed to verify")
+		}
+	}
+
+	value, err := smt.GetForRoot([]byte("testKey"), deletedRoot)
+	if err != nil {
+		t.Errorf("returned error when getting deleted key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) {
+		t.Error("did not get default value when getting deleted key")
+	}
+	has, err := smt.HasForRoot([]byte("testKey"), deletedRoot)
+	if err != nil {
+		t.Errorf("returned error when checking deleted key: %v", err)
+	}
+	if has {
+		t.Error("did not get 'false' when checking deleted key")
+	}
+	value, err = smt.GetForRoot([]byte("otherKey"), deletedRoot)
+	if err != nil {
+		t.Errorf("returned error when getting key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue3"), value) {
+		t.Error("did not get correct value when getting key")
+	}
+}
+
+// Test reading a tree at older roots when it does not keep its history.
+func TestSparseMerkleTreeGetForRootWithoutHistory(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	smt.Update([]byte("otherKey"), []byte("testValue"))
+	oldRoot := smt.Root()
+	smt.Update([]byte("testKey"), []byte("testValue2"))
+
+	value, err := smt.GetForRoot([]byte("testKey"), smt.Root())
+	if err != nil {
+		t.Errorf("returned error when getting key at current root: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue2"), value) {
+		t.Error("did not get correct value when getting key at current root")
+	}
+
+	// The nodes of the older root were deleted.
+	var invalidKeyError *InvalidKeyError
+	if _, err := smt.GetForRoot([]byte("testKey"), oldRoot); !errors.As(err, &invalidKeyError) {
+		t.Errorf("expected InvalidKeyError when getting key at pruned root, got: %v", err)
+	}
+
+	// The nodes of an older root are kept by a snapshot, but its values are
+	// not stored by hash.
+	snapshot := smt.Snapshot()
+	oldRoot = smt.Root()
+	smt.Update([]byte("testKey"), []byte("testValue3"))
+	if _, err := smt.GetForRoot([]byte("testKey"), oldRoot); !errors.Is(err, ErrValueNotFound) {
+		t.Errorf("expected ErrValueNotFound when getting replaced value, got: %v", err)
+	}
+	snapshot.Release()
+}
+
+// Test reading a sum tree at older roots.
+func TestSparseMerkleSumTreeGetForRoot(t *testing.T) {
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithHistory())
+	smst.Update([]byte("testKey"), []byte("testValue"), 5)
+	oldRoot := smst.Root()
+	smst.Update([]byte("testKey"), []byte("testValue"), 10)
+
+	value, weight, err := smst.GetForRoot([]byte("testKey"), oldRoot)
+	if err != nil {
+		t.Errorf("returned error when getting key at older root: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue"), value) || weight != 5 {
+		t.Error("did not get value and weight of older root when getting key at older root")
+	}
+	_, weight, _ = smst.GetForRoot([]byte("testKey"), smst.Root())
+	if weight != 10 {
+		t.Error("did not get current weight when getting key at current root")
+	}
+}
@@ -0,0 +1,213 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// ErrNoJournal is returned when recovering a tree that was not created with
+// WithJournal.
+var ErrNoJournal = errors.New("no journal")
+
+var (
+	// journalKey is the key of the entry of the operation that is being
+	// applied to the stores, in the journal.
+	journalKey = []byte("smt/journal")
+	// journalRootKey is the key of the root after the last operation that
+	// was applied to the stores, in the journal.
+	journalRootKey = []byte("smt/journal/root")
+)
+
+// The kinds of writes in a journal entry.
+const (
+	journalSetNode = iota + 1
+	journalDeleteNode
+	journalSetValue
+	journalDeleteValue
+)
+
+// journaled runs an operation that writes to the stores of the tree and
+// returns a root, and applies its writes to the stores through the journal.
+func (smt *SparseMerkleTree) journaled(op func() ([]byte, error)) ([]byte, error) {
+	nodes, values := newOverlayMapStore(smt.nodes), newOverlayMapStore(smt.values)
+	smt.nodes, smt.values = nodes, values
+	root, err := op()
+	smt.nodes, smt.values = nodes.parent, values.parent
+	if err != nil {
+		return nil, err
+	}
+	if err := smt.applyJournaled(nodes, values, root); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// applyJournaled applies the writes of an operation, kept in overlays over the
+// stores of the tree, to the stores. The writes are first recorded in the
+// journal with the root after the operation, so that they can be replayed by
+// Recover if they are interrupted.
+func (smt *SparseMerkleTree) applyJournaled(nodes, values *overlayMapStore, root []byte) error {
+	if len(nodes.sets)+len(nodes.deletes)+len(values.sets)+len(values.deletes) == 0 {
+		return nil
+	}
+	if err := smt.journal.Set(journalKey, smt.journalEntry(root, nodes, values)); err != nil {
+		return err
+	}
+	if err := nodes.flush(); err != nil {
+		return err
+	}
+	if err := values.flush(); err != nil {
+		return err
+	}
+	if err := smt.journal.Set(journalRootKey, root); err != nil {
+		return err
+	}
+	return smt.journal.Delete(journalKey)
+}
+
+// Recover completes the last operation on the tree if it was interrupted after
+// it was recorded in the journal, or discards it if it was interrupted while
+// it was recorded. The stores of the tree then match the root after the last
+// operation that completed, which is set as the root of the tree and
+// returned. The tree must have been created with WithJournal.
+func (smt *SparseMerkleTree) Recover() ([]byte, error) {
+	if smt.journal == nil {
+		return nil, ErrNoJournal
+	}
+	if smt.readOnly {
+		return nil, ErrReadOnly
+	}
+
+	entry, err := smt.journal.Get(journalKey)
+	if err == nil {
+		if err := smt.replayJournalEntry(entry); err != nil {
+			return nil, err
+		}
+		if err := smt.journal.Delete(journalKey); err != nil {
+			return nil, err
+		}
+	} else {
+		var invalidKeyError *InvalidKeyError
+		if !errors.As(err, &invalidKeyError) {
+			return nil, err
+		}
+	}
+
+	root, err := smt.journal.Get(journalRootKey)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			// No operation ever completed.
+			return smt.Root(), nil
+		}
+		return nil, err
+	}
+	smt.SetRoot(append([]byte(nil), root...))
+	return smt.Root(), nil
+}
+
+// Recover completes or discards the last operation on the tree. See
+// SparseMerkleTree.Recover.
+func (smst *SparseMerkleSumTree) Recover() ([]byte, error) {
+	return smst.smt.Recover()
+}
+
+// replayJournalEntry applies the writes of a journal entry to the stores, and
+// records its root as the root after the last operation that completed. Entries
+// that were not written in full are ignored, as none of their writes were
+// applied.
+func (smt *SparseMerkleTree) replayJournalEntry(entry []byte) error {
+	checksumSize := smt.th.hasher.Size()
+	if len(entry) < smt.th.nodeSize()+checksumSize {
+		return nil
+	}
+	body, checksum := entry[:len(entry)-checksumSize], entry[len(entry)-checksumSize:]
+	if !bytes.Equal(smt.th.digest(body), checksum) {
+		return nil
+	}
+	root, writes := body[:smt.th.nodeSize()], body[smt.th.nodeSize():]
+
+	for len(writes) > 0 {
+		kind := writes[0]
+		key, rest, ok := readJournalBytes(writes[1:])
+		if !ok {
+			return nil
+		}
+		writes = rest
+
+		var err error
+		switch kind {
+		case journalSetNode, journalSetValue:
+			var value []byte
+			value, writes, ok = readJournalBytes(writes)
+			if !ok {
+				return nil
+			}
+			store := smt.nodes
+			if kind == journalSetValue {
+				store = smt.values
+			}
+			err = store.Set(key, value)
+		case journalDeleteNode:
+			err = deleteIfExists(smt.nodes, key)
+		case journalDeleteValue:
+			err = deleteIfExists(smt.values, key)
+		default:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return smt.journal.Set(journalRootKey, root)
+}
+
+// journalEntry encodes the root after an operation and its writes, followed by
+// a checksum that tells whether the entry was written in full.
+func (smt *SparseMerkleTree) journalEntry(root []byte, nodes, values *overlayMapStore) []byte {
+	entry := append([]byte(nil), root...)
+	entry = appendJournalWrites(entry, journalSetNode, journalDeleteNode, nodes)
+	entry = appendJournalWrites(entry, journalSetValue, journalDeleteValue, values)
+	return append(entry, smt.th.digest(entry)...)
+}
+
+func appendJournalWrites(entry []byte, setKind, deleteKind byte, om *overlayMapStore) []byte {
+	keys := make([]string, 0, len(om.deletes))
+	for key := range om.deletes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry = append(entry, deleteKind)
+		entry = appendJournalBytes(entry, []byte(key))
+	}
+
+	keys = keys[:0]
+	for key := range om.sets {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry = append(entry, setKind)
+		entry = appendJournalBytes(entry, []byte(key))
+		entry = appendJournalBytes(entry, om.sets[key])
+	}
+	return entry
+}
+
+func appendJournalBytes(entry []byte, b []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	entry = append(entry, lenBuf[:n]...)
+	return append(entry, b...)
+}
+
+func readJournalBytes(entry []byte) ([]byte, []byte, bool) {
+	size, n := binary.Uvarint(entry)
+	if n <= 0 || uint64(len(entry)-n) < size {
+		return nil, nil, false
+	}
+	return entry[n : n+int(size)], entry[n+int(size):], true
+}
@@ -0,0 +1,146 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+var errCrash = errors.New("crash")
+
+// crashingMapStore is a MapStore that fails every write after a number of
+// writes to it and to the stores that share its count, as if the process
+// crashed.
+type crashingMapStore struct {
+	MapStore
+	writes *int
+}
+
+func (cm *crashingMapStore) Set(key []byte, value []byte) error {
+	if *cm.writes == 0 {
+		return errCrash
+	}
+	*cm.writes--
+	return cm.MapStore.Set(key, value)
+}
+
+func (cm *crashingMapStore) Delete(key []byte) error {
+	if *cm.writes == 0 {
+		return errCrash
+	}
+	*cm.writes--
+	return cm.MapStore.Delete(key)
+}
+
+func cloneSimpleMap(sm *SimpleMap) *SimpleMap {
+	return &SimpleMap{m: copySimpleMap(sm)}
+}
+
+// Test that the stores match the old or the new root after recovering from a
+// crash after every write of an operation.
+func TestSparseMerkleTreeJournal(t *testing.T) {
+	operations := map[string]func(*SparseMerkleTree) error{
+		"update": func(smt *SparseMerkleTree) error {
+			_, err := smt.Update([]byte("5"), []byte("newValue"))
+			return err
+		},
+		"insert": func(smt *SparseMerkleTree) error {
+			_, err := smt.Update([]byte("newKey"), []byte("newValue"))
+			return err
+		},
+		"delete": func(smt *SparseMerkleTree) error {
+			_, err := smt.Delete([]byte("5"))
+			return err
+		},
+		"transaction": func(smt *SparseMerkleTree) error {
+			tx := smt.Begin()
+			tx.Update([]byte("newKey"), []byte("newValue"))
+			tx.Delete([]byte("5"))
+			return tx.Commit()
+		},
+	}
+
+	for _, options := range [][]Option{nil, {WithExtensionNodes()}} {
+		for name, operation := range operations {
+			smn, smv, journal := NewSimpleMap(), NewSimpleMap(), NewSimpleMap()
+			smt := NewSparseMerkleTree(smn, smv, sha256.New(), append([]Option{WithJournal(journal)}, options...)...)
+			for i := 0; i < 20; i++ {
+				s := strconv.Itoa(i)
+				smt.Update([]byte(s), []byte(s))
+			}
+			oldRoot := smt.Root()
+
+			// The stores after the operation completes.
+			expectedNodes, expectedValues := cloneSimpleMap(smn), cloneSimpleMap(smv)
+			expected := ImportSparseMerkleTree(expectedNodes, expectedValues, sha256.New(), oldRoot, append([]Option{WithJournal(NewSimpleMap())}, options...)...)
+			if err := operation(expected); err != nil {
+				t.Fatalf("returned error when applying %s: %v", name, err)
+			}
+
+			for writes := 0; ; writes++ {
+				nodes, values, journalCopy := cloneSimpleMap(smn), cloneSimpleMap(smv), cloneSimpleMap(journal)
+				remaining := writes
+				crashing := ImportSparseMerkleTree(
+					&crashingMapStore{MapStore: nodes, writes: &remaining},
+					&crashingMapStore{MapStore: values, writes: &remaining},
+					sha256.New(), oldRoot,
+					append([]Option{WithJournal(&crashingMapStore{MapStore: journalCopy, writes: &remaining})}, options...)...,
+				)
+				opErr := operation(crashing)
+				if opErr != nil && !errors.Is(opErr, errCrash) {
+					t.Errorf("returned error when applying %s: %v", name, opErr)
+				}
+
+				recovered := ImportSparseMerkleTree(nodes, values, sha256.New(), oldRoot, append([]Option{WithJournal(journalCopy)}, options...)...)
+				root, err := recovered.Recover()
+				if err != nil {
+					t.Errorf("returned error when recovering from crash during %s: %v", name, err)
+				}
+				switch {
+				case bytes.Equal(root, oldRoot):
+					if !reflect.DeepEqual(smn.m, nodes.m) || !reflect.DeepEqual(smv.m, values.m) {
+						t.Errorf("stores differ from old root after recovering from crash after %d writes of %s", writes, name)
+					}
+				case bytes.Equal(root, expected.Root()):
+					if !reflect.DeepEqual(expectedNodes.m, nodes.m) || !reflect.DeepEqual(expectedValues.m, values.m) {
+						t.Errorf("stores differ from new root after recovering from crash after %d writes of %s", writes, name)
+					}
+				default:
+					t.Errorf("recovered unknown root after crash after %d writes of %s", writes, name)
+				}
+
+				if opErr == nil {
+					break
+				}
+			}
+		}
+	}
+}
+
+// Test that an entry that was not written in full is discarded.
+func TestSparseMerkleTreeJournalTornEntry(t *testing.T) {
+	smn, smv, journal := NewSimpleMap(), NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, sha256.New(), WithJournal(journal))
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	root := smt.Root()
+
+	journal.Set(journalKey, []byte("torn entry"))
+	recovered := ImportSparseMerkleTree(smn, smv, sha256.New(), nil, WithJournal(journal))
+	recoveredRoot, err := recovered.Recover()
+	if err != nil {
+		t.Errorf("returned error when recovering from torn entry: %v", err)
+	}
+	if !bytes.Equal(root, recoveredRoot) {
+		t.Error("did not recover last completed root after torn entry")
+	}
+	if _, err := journal.Get(journalKey); err == nil {
+		t.Error("did not discard torn entry")
+	}
+
+	if _, err := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).Recover(); !errors.Is(err, ErrNoJournal) {
+		t.Errorf("expected ErrNoJournal when recovering tree without journal, got: %v", err)
+	}
+}
@@ -1,16 +1,32 @@
 package smt
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 )
 
-// MapStore is a key-value store.
+// MapStore is a key-value store. Getting or deleting a key that is not set
+// returns an InvalidKeyError with the key. Stores copy the keys and values they
+// are given, which can be reused by the caller, while values that they return
+// must not be modified. Keys can be got from several goroutines at once, as
+// long as none is set or deleted at the same time. The smttest package tests
+// the contracts of stores.
 type MapStore interface {
 	Get(key []byte) ([]byte, error)     // Get gets the value for a key.
 	Set(key []byte, value []byte) error // Set updates the value for a key.
 	Delete(key []byte) error            // Delete deletes a key.
 }
 
+// IterableMapStore is a key-value store whose keys can be iterated over.
+type IterableMapStore interface {
+	MapStore
+	// Iterate calls fn with every key that starts with a prefix and its
+	// value, in increasing order of key, until fn returns false. Keys that
+	// are set or deleted during the iteration may or may not be seen.
+	Iterate(prefix []byte, fn func(key []byte, value []byte) bool) error
+}
+
 // InvalidKeyError is thrown when a key that does not exist is being accessed.
 type InvalidKeyError struct {
 	Key []byte
@@ -40,9 +56,9 @@ func (sm *SimpleMap) Get(key []byte) ([]byte, error) {
 	return nil, &InvalidKeyError{Key: key}
 }
 
-// Set updates the value for a key.
+// Set updates the value for a key. The value is copied.
 func (sm *SimpleMap) Set(key []byte, value []byte) error {
-	sm.m[string(key)] = value
+	sm.m[string(key)] = append([]byte(nil), value...)
 	return nil
 }
 
@@ -55,3 +71,26 @@ func (sm *SimpleMap) Delete(key []byte) error {
 	}
 	return &InvalidKeyError{Key: key}
 }
+
+// Iterate calls fn with every key that starts with a prefix and its value, in
+// increasing order of key, until fn returns false.
+func (sm *SimpleMap) Iterate(prefix []byte, fn func(key []byte, value []byte) bool) error {
+	var keys []string
+	for key := range sm.m {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, ok := sm.m[key]
+		if !ok {
+			// The key was deleted during the iteration.
+			continue
+		}
+		if !fn([]byte(key), value) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -46,4 +46,20 @@ func TestSimpleMap(t *testing.T) {
 	if err == nil {
 		t.Error("deleting a key did not return an error on a non-existent key")
 	}
+
+	// Tests for Iterate.
+	sm.Set([]byte("b"), []byte("2"))
+	sm.Set([]byte("a"), []byte("1"))
+	sm.Set([]byte("c"), []byte("3"))
+	var keys []byte
+	err = sm.Iterate(nil, func(key []byte, value []byte) bool {
+		keys = append(keys, key...)
+		return len(keys) < 2
+	})
+	if err != nil {
+		t.Error("iterating returned an error")
+	}
+	if !bytes.Equal(keys, []byte("ab")) {
+		t.Error("did not iterate over keys in order until stopped")
+	}
 }
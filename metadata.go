@@ -0,0 +1,122 @@
+package smt
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// ErrConfigMismatch is returned when opening a tree with a hasher or options
+// that differ from those it was committed with.
+var ErrConfigMismatch = errors.New("tree configuration mismatch")
+
+// ErrNoMetaStore is returned when committing a tree that was not opened with
+// OpenSparseMerkleTree.
+var ErrNoMetaStore = errors.New("no metadata store")
+
+// metaKey is the key of the metadata record in the metadata store.
+var metaKey = []byte("smt/meta")
+
+// metaEncodingVersion is the version of the encoding of the metadata record,
+// and of the nodes and values that it describes.
+const metaEncodingVersion = 1
+
+const (
+	metaFlagSumTree = 1 << iota
+	metaFlagExtensions
+	metaFlagOrderedKeys
+	metaFlagContentAddressed
+)
+
+// OpenSparseMerkleTree opens a Sparse Merkle tree from MapStores, at the root
+// and version of the metadata record in meta that was written on its last
+// commit. If meta is empty, a new tree is created on empty MapStores.
+// ErrConfigMismatch is returned if the tree was committed with a different
+// hasher or options.
+func OpenSparseMerkleTree(nodes, values, meta MapStore, hasher hash.Hash, options ...Option) (*SparseMerkleTree, error) {
+	smt := NewSparseMerkleTree(nodes, values, hasher, options...)
+	if err := smt.open(meta); err != nil {
+		return nil, err
+	}
+	return smt, nil
+}
+
+// OpenSparseMerkleSumTree opens a Sparse Merkle sum tree from MapStores. See
+// OpenSparseMerkleTree.
+func OpenSparseMerkleSumTree(nodes, values, meta MapStore, hasher hash.Hash, options ...Option) (*SparseMerkleSumTree, error) {
+	smst := NewSparseMerkleSumTree(nodes, values, hasher, options...)
+	if err := smst.smt.open(meta); err != nil {
+		return nil, err
+	}
+	return smst, nil
+}
+
+// Version returns the number of times the tree was committed.
+func (smt *SparseMerkleTree) Version() uint64 {
+	return smt.version
+}
+
+// Version returns the number of times the tree was committed.
+func (smst *SparseMerkleSumTree) Version() uint64 {
+	return smst.smt.Version()
+}
+
+func (smt *SparseMerkleTree) open(meta MapStore) error {
+	smt.meta = meta
+	smt.orphans = make(map[string][]byte)
+	record, err := meta.Get(metaKey)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			// The tree was never committed.
+			return nil
+		}
+		return err
+	}
+
+	config := smt.metaConfig()
+	if len(record) != len(config)+8+smt.th.nodeSize() || string(record[:len(config)]) != string(config) {
+		return ErrConfigMismatch
+	}
+	smt.version = binary.BigEndian.Uint64(record[len(config):])
+	smt.SetRoot(append([]byte(nil), record[len(config)+8:]...))
+	return nil
+}
+
+// metaRecord returns the metadata record of the tree at a version.
+func (smt *SparseMerkleTree) metaRecord(version uint64) []byte {
+	record := smt.metaConfig()
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], version)
+	record = append(record, b[:]...)
+	return append(record, smt.Root()...)
+}
+
+// metaConfig returns the configuration of the tree in its metadata record: the
+// encoding version, the options that change the nodes and values, the
+// hasher, and the size of paths and depth of the tree. The hasher is
+// identified by the size of its digests and its hash of no data.
+func (smt *SparseMerkleTree) metaConfig() []byte {
+	var flags byte
+	if smt.th.sumTree {
+		flags |= metaFlagSumTree
+	}
+	if smt.th.extensions {
+		flags |= metaFlagExtensions
+	}
+	if smt.th.orderedKeys {
+		flags |= metaFlagOrderedKeys
+	}
+	if smt.contentAddressed {
+		flags |= metaFlagContentAddressed
+	}
+
+	hasherID := smt.th.hasherID()
+	config := make([]byte, 0, 2+len(hasherID)+6)
+	config = append(config, metaEncodingVersion, flags)
+	config = append(config, hasherID...)
+	config = append(config, byte(smt.th.pathSize()>>8), byte(smt.th.pathSize()))
+	config = append(config, byte(smt.th.namespaceSize>>8), byte(smt.th.namespaceSize))
+	config = append(config, byte(smt.depth()>>8), byte(smt.depth()))
+	return config
+}
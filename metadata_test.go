@@ -0,0 +1,90 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// Test reopening a tree from its stores after committing it.
+func TestOpenSparseMerkleTree(t *testing.T) {
+	smn, smv, meta := NewSimpleMap(), NewSimpleMap(), NewSimpleMap()
+	smt, err := OpenSparseMerkleTree(smn, smv, meta, sha256.New())
+	if err != nil {
+		t.Fatalf("returned error when opening new tree: %v", err)
+	}
+	if !bytes.Equal(smt.th.placeholder(), smt.Root()) || smt.Version() != 0 {
+		t.Error("did not get empty tree when opening new tree")
+	}
+
+	for i := 0; i < 10; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	version, root, err := smt.Commit()
+	if err != nil {
+		t.Errorf("returned error when committing tree: %v", err)
+	}
+	if version != 1 || !bytes.Equal(root, smt.Root()) {
+		t.Error("did not get version and root of tree when committing tree")
+	}
+	// Uncommitted changes are not in the metadata record.
+	smt.Update([]byte("testKey"), []byte("testValue"))
+
+	reopened, err := OpenSparseMerkleTree(smn, smv, meta, sha256.New())
+	if err != nil {
+		t.Fatalf("returned error when reopening tree: %v", err)
+	}
+	if !bytes.Equal(root, reopened.Root()) {
+		t.Error("did not get committed root when reopening tree")
+	}
+	if reopened.Version() != 1 {
+		t.Errorf("expected version 1 when reopening tree, got %d", reopened.Version())
+	}
+	value, err := reopened.Get([]byte("5"))
+	if err != nil {
+		t.Errorf("returned error when getting key from reopened tree: %v", err)
+	}
+	if !bytes.Equal([]byte("5"), value) {
+		t.Error("did not get correct value when getting key from reopened tree")
+	}
+
+	if _, _, err := reopened.Commit(); err != nil {
+		t.Errorf("returned error when committing reopened tree: %v", err)
+	}
+	if reopened.Version() != 2 {
+		t.Errorf("expected version 2 after committing reopened tree, got %d", reopened.Version())
+	}
+}
+
+// Test that trees are not opened with a different configuration.
+func TestOpenSparseMerkleTreeConfigMismatch(t *testing.T) {
+	smn, smv, meta := NewSimpleMap(), NewSimpleMap(), NewSimpleMap()
+	smt, _ := OpenSparseMerkleTree(smn, smv, meta, sha512.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	smt.Commit()
+
+	if _, err := OpenSparseMerkleTree(smn, smv, meta, sha256.New()); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("expected ErrConfigMismatch when opening tree with different hasher, got: %v", err)
+	}
+	if _, err := OpenSparseMerkleTree(smn, smv, meta, sha512.New384()); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("expected ErrConfigMismatch when opening tree with hasher of same type, got: %v", err)
+	}
+	if _, err := OpenSparseMerkleTree(smn, smv, meta, sha512.New(), WithExtensionNodes()); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("expected ErrConfigMismatch when opening tree with different options, got: %v", err)
+	}
+	if _, err := OpenSparseMerkleSumTree(smn, smv, meta, sha512.New()); !errors.Is(err, ErrConfigMismatch) {
+		t.Errorf("expected ErrConfigMismatch when opening tree as sum tree, got: %v", err)
+	}
+	if _, err := OpenSparseMerkleTree(smn, smv, meta, sha512.New()); err != nil {
+		t.Errorf("returned error when opening tree with same configuration: %v", err)
+	}
+
+	// Trees that were not opened have nowhere to commit to.
+	if _, _, err := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).Commit(); !errors.Is(err, ErrNoMetaStore) {
+		t.Errorf("expected ErrNoMetaStore when committing tree without metadata store, got: %v", err)
+	}
+}
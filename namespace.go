@@ -0,0 +1,111 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// ErrInvalidNamespace is returned when a namespace is not the namespace size
+// of the tree.
+var ErrInvalidNamespace = errors.New("invalid namespace")
+
+// SparseMerkleNamespaceProof is a Merkle proof for all the leaves of a
+// namespace, in a tree with namespaces.
+type SparseMerkleNamespaceProof struct {
+	// Paths are the paths of the leaves in the namespace, in increasing
+	// order. The path of a key is its namespace followed by the hash of the
+	// key.
+	Paths [][]byte
+
+	// Values are the values of the leaves in the namespace, in the same
+	// order as Paths.
+	Values [][]byte
+
+	// PrefixProof is a Merkle proof for the subtree of the namespace.
+	PrefixProof SparseMerklePrefixProof
+}
+
+// GetNamespace gets all the leaves of a namespace from the tree, along with a
+// Merkle proof that they are all the leaves of the namespace, against the
+// current root. The tree must have been created with WithNamespaceSize.
+func (smt *SparseMerkleTree) GetNamespace(namespace []byte) (SparseMerkleNamespaceProof, error) {
+	return smt.GetNamespaceForRoot(namespace, smt.Root())
+}
+
+// GetNamespaceForRoot gets all the leaves of a namespace from the tree, along
+// with a Merkle proof that they are all the leaves of the namespace, against
+// a specific node.
+func (smt *SparseMerkleTree) GetNamespaceForRoot(namespace []byte, root []byte) (SparseMerkleNamespaceProof, error) {
+	if smt.th.namespaceSize == 0 || len(namespace) != smt.th.namespaceSize {
+		return SparseMerkleNamespaceProof{}, ErrInvalidNamespace
+	}
+
+	prefixProof, err := smt.ProvePrefixForRoot(namespace, len(namespace)*8, root)
+	if err != nil {
+		return SparseMerkleNamespaceProof{}, err
+	}
+
+	// The paths of the namespace are between the namespace followed by zero
+	// bytes and the namespace followed by 0xff bytes.
+	start := make([]byte, smt.th.pathSize())
+	end := bytes.Repeat([]byte{0xff}, smt.th.pathSize())
+	copy(start, namespace)
+	copy(end, namespace)
+
+	var paths, values [][]byte
+	err = smt.rangeLeaves(root, 0, make([]byte, smt.th.pathSize()), start, end, func(path []byte, valueHash []byte) error {
+		value, err := smt.valueForHash(path, valueHash)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		return SparseMerkleNamespaceProof{}, err
+	}
+
+	return SparseMerkleNamespaceProof{
+		Paths:       paths,
+		Values:      values,
+		PrefixProof: prefixProof,
+	}, nil
+}
+
+// VerifyNamespaceProof verifies a Merkle proof for the leaves of a namespace.
+// It checks that the paths and values of the proof are all the leaves of the
+// tree in that namespace.
+func VerifyNamespaceProof(proof SparseMerkleNamespaceProof, root []byte, namespace []byte, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, options)
+	return verifyNamespaceProof(proof, root, namespace, th)
+}
+
+func verifyNamespaceProof(proof SparseMerkleNamespaceProof, root []byte, namespace []byte, th *treeHasher) bool {
+	if th.namespaceSize == 0 || len(namespace) != th.namespaceSize {
+		return false
+	}
+	if !verifyPrefixProof(proof.PrefixProof, root, namespace, len(namespace)*8, th) {
+		return false
+	}
+
+	// Check that the paths are sorted and in the namespace.
+	if len(proof.Paths) != len(proof.Values) {
+		return false
+	}
+	valueHashes := make([][]byte, len(proof.Paths))
+	for i, path := range proof.Paths {
+		if len(path) != th.pathSize() || !bytes.HasPrefix(path, namespace) ||
+			(i > 0 && bytes.Compare(path, proof.Paths[i-1]) <= 0) {
+			return false
+		}
+		valueHashes[i] = th.valueHash(proof.Values[i])
+		if valueHashes[i] == nil {
+			return false
+		}
+	}
+
+	// The leaves must be exactly those of the subtree of the namespace.
+	return bytes.Equal(proof.PrefixProof.SubtreeRoot, th.subtreeRoot(proof.Paths, valueHashes, len(namespace)*8))
+}
@@ -0,0 +1,115 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// Test retrieving and proving whole namespaces.
+func TestSparseMerkleTreeNamespaces(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithNamespaceSize(2))
+	namespaces := [][]byte{{0, 0}, {0, 1}, {0x80, 0}, {0xff, 0xff}}
+	kv := make(map[string][]byte)
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 2+rand.Intn(8))
+		rand.Read(key)
+		copy(key, namespaces[rand.Intn(len(namespaces)-1)])
+		value := make([]byte, 1+rand.Intn(8))
+		rand.Read(value)
+		kv[string(key)] = value
+		if _, err := smt.Update(key, value); err != nil {
+			t.Errorf("returned error when updating key: %v", err)
+		}
+	}
+
+	// Keys are still proven one by one.
+	for k, v := range kv {
+		proof, err := smt.Prove([]byte(k))
+		if err != nil {
+			t.Errorf("error returned when trying to prove inclusion: %v", err)
+		}
+		if !VerifyProof(proof, smt.Root(), []byte(k), v, sha256.New(), WithNamespaceSize(2)) {
+			t.Error("valid proof failed to verify")
+		}
+		break
+	}
+
+	for _, namespace := range namespaces {
+		proof, err := smt.GetNamespace(namespace)
+		if err != nil {
+			t.Errorf("returned error when getting namespace: %v", err)
+		}
+		expected := make(map[string][]byte)
+		for k, v := range kv {
+			if bytes.HasPrefix([]byte(k), namespace) {
+				expected[string(smt.th.path([]byte(k)))] = v
+			}
+		}
+		if len(proof.Paths) != len(expected) {
+			t.Fatalf("expected %d leaves in namespace, got %d", len(expected), len(proof.Paths))
+		}
+		for i, path := range proof.Paths {
+			if !bytes.Equal(expected[string(path)], proof.Values[i]) {
+				t.Error("did not get correct leaves in namespace")
+			}
+		}
+		if !VerifyNamespaceProof(proof, smt.Root(), namespace, sha256.New(), WithNamespaceSize(2)) {
+			t.Error("valid namespace proof failed to verify")
+		}
+		if len(proof.Paths) == 0 {
+			if !bytes.Equal(proof.PrefixProof.SubtreeRoot, smt.th.placeholder()) {
+				t.Error("did not get placeholder subtree root for empty namespace")
+			}
+			continue
+		}
+
+		// Omitting a leaf of the namespace must not verify.
+		omitted := proof
+		omitted.Paths = proof.Paths[1:]
+		omitted.Values = proof.Values[1:]
+		if VerifyNamespaceProof(omitted, smt.Root(), namespace, sha256.New(), WithNamespaceSize(2)) {
+			t.Error("namespace proof with an omitted leaf returned true")
+		}
+
+		// Changing a value must not verify.
+		changed := proof
+		changed.Values = append([][]byte{}, proof.Values...)
+		changed.Values[0] = []byte("badValue")
+		if VerifyNamespaceProof(changed, smt.Root(), namespace, sha256.New(), WithNamespaceSize(2)) {
+			t.Error("namespace proof with a changed value returned true")
+		}
+
+		// Adding a leaf to the namespace must not verify.
+		added := proof
+		extra := smt.th.path(append(append([]byte{}, namespace...), "extraKey"...))
+		added.Paths = append([][]byte{extra}, proof.Paths...)
+		added.Values = append([][]byte{[]byte("value")}, proof.Values...)
+		if bytes.Compare(extra, proof.Paths[0]) < 0 && VerifyNamespaceProof(added, smt.Root(), namespace, sha256.New(), WithNamespaceSize(2)) {
+			t.Error("namespace proof with an added leaf returned true")
+		}
+
+		// The proof is for a single namespace.
+		if VerifyNamespaceProof(proof, smt.Root(), namespaces[len(namespaces)-1], sha256.New(), WithNamespaceSize(2)) {
+			t.Error("namespace proof verification returned true for wrong namespace")
+		}
+	}
+}
+
+// Test errors for keys and namespaces of trees with namespaces.
+func TestSparseMerkleTreeNamespacesErrors(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithNamespaceSize(2))
+	if _, err := smt.Update([]byte{0}, []byte("testValue")); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("expected ErrInvalidKeySize when updating key shorter than namespace, got: %v", err)
+	}
+	if _, err := smt.GetNamespace([]byte{0}); !errors.Is(err, ErrInvalidNamespace) {
+		t.Errorf("expected ErrInvalidNamespace when getting short namespace, got: %v", err)
+	}
+
+	smt = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	if _, err := smt.GetNamespace([]byte{0, 0}); !errors.Is(err, ErrInvalidNamespace) {
+		t.Errorf("expected ErrInvalidNamespace when getting namespace without namespaces, got: %v", err)
+	}
+}
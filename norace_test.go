@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package smt
+
+// raceEnabled is true when the tests run with the race detector, which makes
+// allocation counts vary.
+const raceEnabled = false
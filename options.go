@@ -1,4 +1,107 @@
 package smt
 
+import (
+	"fmt"
+	"hash"
+)
+
 // Option is a function that configures SMT.
 type Option func(*SparseMerkleTree)
+
+// WithDepth sets the depth of the tree in bits, which must not exceed the size
+// of the hasher output. Paths are truncated to that many bits when placing
+// leaves in the tree, so proofs have at most depth side nodes. Updating a key
+// whose truncated path is already taken by a different key fails with
+// ErrPathCollision.
+//
+// Trees with a custom depth must be verified with the same option.
+func WithDepth(depth int) Option {
+	return func(smt *SparseMerkleTree) {
+		if depth <= 0 || depth > smt.th.pathSize()*8 {
+			panic(fmt.Sprintf("smt: invalid depth %d", depth))
+		}
+		smt.th.depthBits = depth
+	}
+}
+
+// WithExtensionNodes collapses every chain of inner nodes that have a
+// placeholder sibling into a single extension node, in the style of a
+// Patricia tree. This saves a node write and a hash per bit of prefix shared
+// by the paths beneath the chain. Proofs keep the same format, with
+// placeholder side nodes for the collapsed levels.
+//
+// Trees with extension nodes must be verified with the same option.
+func WithExtensionNodes() Option {
+	return func(smt *SparseMerkleTree) {
+		smt.th.extensions = true
+	}
+}
+
+// WithOrderedKeys uses keys as paths as they are, instead of hashing them, so
+// that leaves are sorted by key and ranges of keys can be proven with
+// ProveRange. Keys must then be the size of the hasher output; other keys are
+// rejected with ErrInvalidKeySize. As paths are no longer random, an
+// adversary choosing keys can make the tree as deep as the size of the path.
+//
+// Trees with ordered keys must be verified with the same option.
+func WithOrderedKeys() Option {
+	return func(smt *SparseMerkleTree) {
+		smt.th.orderedKeys = true
+	}
+}
+
+// WithNamespaceSize prefixes the path of every key with its first size bytes,
+// its namespace, so that all the keys of a namespace are in the same subtree
+// and can be retrieved with GetNamespace. Keys shorter than a namespace are
+// rejected with ErrInvalidKeySize.
+//
+// Trees with namespaces must be verified with the same option.
+func WithNamespaceSize(size int) Option {
+	return func(smt *SparseMerkleTree) {
+		if size <= 0 {
+			panic(fmt.Sprintf("smt: invalid namespace size %d", size))
+		}
+		smt.th.namespaceSize = size
+	}
+}
+
+// WithHistory keeps the nodes that updates orphan, and also stores every value
+// by its hash, so that the tree can be read and proven at any older root with
+// GetForRoot and ProveForRoot. Stores then grow with every update.
+func WithHistory() Option {
+	return func(smt *SparseMerkleTree) {
+		smt.keepHistory = true
+	}
+}
+
+// WithContentAddressedValues stores every value once under the value hash that
+// its leaves commit to, with a count of the leaves that reference it, instead
+// of under the path of each key. Keys with the same value then share one copy
+// of it, and a value is deleted once no leaf references it. Trees whose values
+// were stored by path can be migrated with MigrateToContentAddressedValues.
+func WithContentAddressedValues() Option {
+	return func(smt *SparseMerkleTree) {
+		smt.contentAddressed = true
+	}
+}
+
+// WithJournal records the writes of every update in a journal before they are
+// applied to the stores, so that an update that is interrupted, for instance
+// by a crash, can be completed or discarded with Recover when the tree is
+// imported again. The journal store must be distinct from the node and value
+// stores.
+func WithJournal(journal MapStore) Option {
+	return func(smt *SparseMerkleTree) {
+		smt.journal = journal
+	}
+}
+
+// treeHasherWithOptions creates a tree hasher configured by options, for
+// working on proofs without a tree.
+func treeHasherWithOptions(hasher hash.Hash, options []Option) *treeHasher {
+	smt := SparseMerkleTree{th: *newTreeHasher(hasher)}
+	for _, option := range options {
+		option(&smt)
+	}
+	return &smt.th
+}
@@ -0,0 +1,98 @@
+package smt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrNotIterable is returned when iterating over a PrefixedMapStore whose
+// inner store is not an IterableMapStore.
+var ErrNotIterable = errors.New("store is not iterable")
+
+// The kinds of stores of a named tree, which end the prefixes of their keys.
+const (
+	namedTreeNodes = iota + 1
+	namedTreeValues
+	namedTreeMeta
+)
+
+// PrefixedMapStore is a MapStore whose keys are stored in an inner MapStore
+// with a prefix, so that several stores can share one inner store. Keys are
+// returned without the prefix.
+type PrefixedMapStore struct {
+	inner  MapStore
+	prefix []byte
+}
+
+// NewPrefixedMapStore creates a PrefixedMapStore that stores its keys in an
+// inner MapStore with a prefix. Stores that share an inner store only keep
+// apart if none of their prefixes is a prefix of another.
+func NewPrefixedMapStore(inner MapStore, prefix []byte) *PrefixedMapStore {
+	return &PrefixedMapStore{
+		inner:  inner,
+		prefix: append([]byte(nil), prefix...),
+	}
+}
+
+// NamedTreeStores returns the node, value and metadata stores of a named tree
+// in one inner MapStore, as PrefixedMapStores. The stores of trees with
+// different names never share keys, and can be passed to
+// OpenSparseMerkleTree.
+func NamedTreeStores(inner MapStore, name string) (nodes, values, meta *PrefixedMapStore) {
+	// The name is prefixed with its length, so that no name is a prefix of
+	// another.
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(name)))
+	prefix := append(lenBuf[:n:n], name...)
+
+	// NewPrefixedMapStore copies the prefix, so the next store can reuse it.
+	store := func(kind byte) *PrefixedMapStore {
+		return NewPrefixedMapStore(inner, append(prefix, kind))
+	}
+	return store(namedTreeNodes), store(namedTreeValues), store(namedTreeMeta)
+}
+
+// Get gets the value for a key.
+func (pm *PrefixedMapStore) Get(key []byte) ([]byte, error) {
+	value, err := pm.inner.Get(pm.innerKey(key))
+	return value, pm.innerError(key, err)
+}
+
+// Set updates the value for a key.
+func (pm *PrefixedMapStore) Set(key []byte, value []byte) error {
+	return pm.innerError(key, pm.inner.Set(pm.innerKey(key), value))
+}
+
+// Delete deletes a key.
+func (pm *PrefixedMapStore) Delete(key []byte) error {
+	return pm.innerError(key, pm.inner.Delete(pm.innerKey(key)))
+}
+
+// Iterate calls fn with every key that starts with a prefix and its value, in
+// increasing order of key, until fn returns false. ErrNotIterable is returned
+// if the inner store is not an IterableMapStore.
+func (pm *PrefixedMapStore) Iterate(prefix []byte, fn func(key []byte, value []byte) bool) error {
+	inner, ok := pm.inner.(IterableMapStore)
+	if !ok {
+		return ErrNotIterable
+	}
+	return inner.Iterate(pm.innerKey(prefix), func(key []byte, value []byte) bool {
+		return fn(key[len(pm.prefix):], value)
+	})
+}
+
+func (pm *PrefixedMapStore) innerKey(key []byte) []byte {
+	innerKey := make([]byte, 0, len(pm.prefix)+len(key))
+	innerKey = append(innerKey, pm.prefix...)
+	return append(innerKey, key...)
+}
+
+// innerError returns an error of the inner store, with the key of an
+// InvalidKeyError stripped of the prefix.
+func (pm *PrefixedMapStore) innerError(key []byte, err error) error {
+	var invalidKeyError *InvalidKeyError
+	if errors.As(err, &invalidKeyError) {
+		return &InvalidKeyError{Key: key}
+	}
+	return err
+}
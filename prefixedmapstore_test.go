@@ -0,0 +1,117 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestPrefixedMapStore(t *testing.T) {
+	inner := NewSimpleMap()
+	pm := NewPrefixedMapStore(inner, []byte("prefix/"))
+
+	for _, key := range []string{"b", "a2", "a1", "c"} {
+		if err := pm.Set([]byte(key), []byte("value-"+key)); err != nil {
+			t.Errorf("returned error when setting key: %v", err)
+		}
+	}
+	inner.Set([]byte("other/a3"), []byte("other"))
+
+	value, err := pm.Get([]byte("a1"))
+	if err != nil || !bytes.Equal([]byte("value-a1"), value) {
+		t.Error("did not get value of key")
+	}
+	if value, _ := inner.Get([]byte("prefix/a1")); !bytes.Equal([]byte("value-a1"), value) {
+		t.Error("did not store key with prefix in inner store")
+	}
+	if err := pm.Delete([]byte("c")); err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	var invalidKeyError *InvalidKeyError
+	if _, err := pm.Get([]byte("c")); !errors.As(err, &invalidKeyError) || !bytes.Equal([]byte("c"), invalidKeyError.Key) {
+		t.Errorf("expected InvalidKeyError with key without prefix when getting deleted key, got: %v", err)
+	}
+
+	var keys []string
+	err = pm.Iterate([]byte("a"), func(key []byte, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	if err != nil {
+		t.Errorf("returned error when iterating: %v", err)
+	}
+	if !reflect.DeepEqual([]string{"a1", "a2"}, keys) {
+		t.Errorf("expected keys [a1 a2] when iterating, got %v", keys)
+	}
+
+	notIterable := NewPrefixedMapStore(struct{ MapStore }{inner}, []byte("prefix/"))
+	if err := notIterable.Iterate(nil, func([]byte, []byte) bool { return true }); !errors.Is(err, ErrNotIterable) {
+		t.Errorf("expected ErrNotIterable when iterating over store that is not iterable, got: %v", err)
+	}
+}
+
+// Test that trees on the stores of different names never see each other's
+// keys.
+func TestNamedTreeStores(t *testing.T) {
+	backend := NewSimpleMap()
+	// Names that are prefixes of each other, or of their encodings.
+	names := []string{"", "a", "ab", "a\x01", "\x01a"}
+
+	roots := make(map[string][]byte)
+	for i, name := range names {
+		nodes, values, meta := NamedTreeStores(backend, name)
+		smt, err := OpenSparseMerkleTree(nodes, values, meta, sha256.New())
+		if err != nil {
+			t.Fatalf("returned error when opening tree %q: %v", name, err)
+		}
+		for j := 0; j < 10; j++ {
+			s := strconv.Itoa(j)
+			smt.Update([]byte(s), []byte(name+s))
+		}
+		smt.Delete([]byte(strconv.Itoa(i)))
+		_, roots[name], err = smt.Commit()
+		if err != nil {
+			t.Errorf("returned error when committing tree %q: %v", name, err)
+		}
+	}
+
+	var keys int
+	for i, name := range names {
+		nodes, values, meta := NamedTreeStores(backend, name)
+		for _, store := range []*PrefixedMapStore{nodes, values, meta} {
+			store.Iterate(nil, func(key []byte, value []byte) bool {
+				keys++
+				return true
+			})
+		}
+
+		smt, err := OpenSparseMerkleTree(nodes, values, meta, sha256.New())
+		if err != nil {
+			t.Fatalf("returned error when reopening tree %q: %v", name, err)
+		}
+		if !bytes.Equal(roots[name], smt.Root()) {
+			t.Errorf("did not get committed root when reopening tree %q", name)
+		}
+		for j := 0; j < 10; j++ {
+			s := strconv.Itoa(j)
+			value, err := smt.Get([]byte(s))
+			if err != nil {
+				t.Errorf("returned error when getting key from tree %q: %v", name, err)
+			}
+			expected := []byte(name + s)
+			if j == i {
+				expected = defaultValue
+			}
+			if !bytes.Equal(expected, value) {
+				t.Errorf("did not get correct value of key %s from tree %q", s, name)
+			}
+		}
+	}
+	// Every key of the backend is in the stores of exactly one tree.
+	if keys != len(backend.m) {
+		t.Errorf("expected %d keys in the stores of the trees, got %d", len(backend.m), keys)
+	}
+}
@@ -0,0 +1,166 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// ErrPrefixProofUnsupported is returned when proving a prefix in a tree with
+// extension nodes.
+var ErrPrefixProofUnsupported = errors.New("prefix proofs are not supported with extension nodes")
+
+// ErrInvalidPrefix is returned when a prefix is shorter than its number of
+// bits, or longer than the depth of the tree.
+var ErrInvalidPrefix = errors.New("invalid prefix")
+
+// SparseMerklePrefixProof is a Merkle proof for the subtree of all the paths
+// that start with a prefix.
+type SparseMerklePrefixProof struct {
+	// SideNodes is an array of the sibling nodes leading up to the subtree,
+	// in the same order as the side nodes of a SparseMerkleProof. There are
+	// fewer side nodes than bits in the prefix if a leaf or a placeholder is
+	// found above the subtree.
+	SideNodes [][]byte
+
+	// SubtreeRoot is the root of the subtree. It is a placeholder, made of
+	// zero bytes, if no path starts with the prefix. If a single path starts
+	// with the prefix, it is the hash of its leaf.
+	SubtreeRoot []byte
+
+	// LeafData is the data of the leaf found above the subtree, if any. It
+	// is the only leaf in the subtree if its path starts with the prefix, and
+	// the subtree is empty otherwise.
+	LeafData []byte
+}
+
+// ProvePrefix generates a Merkle proof for the subtree of the paths that start
+// with the first nbits bits of prefix, against the current root.
+func (smt *SparseMerkleTree) ProvePrefix(prefix []byte, nbits int) (SparseMerklePrefixProof, error) {
+	return smt.ProvePrefixForRoot(prefix, nbits, smt.Root())
+}
+
+// ProvePrefixForRoot generates a Merkle proof for the subtree of the paths
+// that start with the first nbits bits of prefix, against a specific node.
+func (smt *SparseMerkleTree) ProvePrefixForRoot(prefix []byte, nbits int, root []byte) (SparseMerklePrefixProof, error) {
+	if smt.th.extensions {
+		return SparseMerklePrefixProof{}, ErrPrefixProofUnsupported
+	}
+	if nbits < 0 || nbits > smt.depth() || len(prefix)*8 < nbits {
+		return SparseMerklePrefixProof{}, ErrInvalidPrefix
+	}
+
+	var sideNodes [][]byte
+	var leafData []byte
+	currentHash := root
+	for i := 0; i < nbits && !bytes.Equal(currentHash, smt.th.placeholder()); i++ {
+		currentData, err := smt.nodes.Get(currentHash)
+		if err != nil {
+			return SparseMerklePrefixProof{}, err
+		} else if smt.th.isLeaf(currentData) {
+			// If the node is a leaf, we've reached the end.
+			leafData = currentData
+			break
+		}
+
+		leftNode, rightNode := smt.th.parseNode(currentData)
+		if getBitAtFromMSB(prefix, i) == right {
+			sideNodes = append(sideNodes, leftNode)
+			currentHash = rightNode
+		} else {
+			sideNodes = append(sideNodes, rightNode)
+			currentHash = leftNode
+		}
+	}
+
+	subtreeRoot := currentHash
+	if leafData != nil {
+		if path, _ := smt.th.parseLeaf(leafData); comparePrefix(path, prefix, nbits) != 0 {
+			// The leaf is not in the subtree, which is empty.
+			subtreeRoot = smt.th.placeholder()
+		}
+	}
+
+	return SparseMerklePrefixProof{
+		SideNodes:   reverseByteSlices(sideNodes),
+		SubtreeRoot: subtreeRoot,
+		LeafData:    leafData,
+	}, nil
+}
+
+func (proof *SparseMerklePrefixProof) sanityCheck(th *treeHasher, nbits int) bool {
+	// Check that the number of supplied sidenodes does not exceed the number
+	// of bits in the prefix, and that all nodes are the right size.
+	if len(proof.SideNodes) > nbits || len(proof.SubtreeRoot) != th.nodeSize() {
+		return false
+	}
+	for _, v := range proof.SideNodes {
+		if len(v) != th.nodeSize() {
+			return false
+		}
+	}
+
+	// Leaf data is only found above the subtree.
+	if proof.LeafData != nil {
+		if len(proof.SideNodes) == nbits ||
+			len(proof.LeafData) != len(leafPrefix)+th.pathSize()+th.leafDataSize() ||
+			!th.isLeaf(proof.LeafData) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// VerifyPrefixProof verifies that proof.SubtreeRoot is the root of the subtree
+// of the paths that start with the first nbits bits of prefix. The subtree is
+// empty if its root is a placeholder.
+func VerifyPrefixProof(proof SparseMerklePrefixProof, root []byte, prefix []byte, nbits int, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, options)
+	return verifyPrefixProof(proof, root, prefix, nbits, th)
+}
+
+func verifyPrefixProof(proof SparseMerklePrefixProof, root []byte, prefix []byte, nbits int, th *treeHasher) bool {
+	if th.extensions || nbits < 0 || nbits > th.depth() || len(prefix)*8 < nbits {
+		return false
+	}
+	if !proof.sanityCheck(th, nbits) {
+		return false
+	}
+
+	// Determine what the node at the end of the side nodes should be.
+	var currentHash []byte
+	if len(proof.SideNodes) == nbits { // The node is the root of the subtree.
+		currentHash = proof.SubtreeRoot
+	} else if proof.LeafData == nil { // The node is a placeholder above the subtree.
+		if !bytes.Equal(proof.SubtreeRoot, th.placeholder()) {
+			return false
+		}
+		currentHash = th.placeholder()
+	} else { // The node is a leaf above the subtree.
+		path, valueHash := th.parseLeaf(proof.LeafData)
+		currentHash, _ = th.digestLeaf(path, valueHash)
+		subtreeRoot := th.placeholder()
+		if comparePrefix(path, prefix, nbits) == 0 {
+			// The leaf is the only one in the subtree.
+			subtreeRoot = currentHash
+		}
+		if !bytes.Equal(proof.SubtreeRoot, subtreeRoot) {
+			return false
+		}
+	}
+
+	// Recompute root.
+	for i, node := range proof.SideNodes {
+		if th.sumOverflows(node, currentHash) {
+			return false
+		}
+		if getBitAtFromMSB(prefix, len(proof.SideNodes)-1-i) == right {
+			currentHash, _ = th.digestNode(node, currentHash)
+		} else {
+			currentHash, _ = th.digestNode(currentHash, node)
+		}
+	}
+
+	return bytes.Equal(currentHash, root)
+}
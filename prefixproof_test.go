@@ -0,0 +1,164 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Test prefix proofs against the contents of a tree with ordered keys.
+func TestSparseMerkleTreePrefixProofs(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithOrderedKeys())
+	var keys, valueHashes [][]byte
+	for i := 0; i < 100; i++ {
+		key := make([]byte, sha256.Size)
+		// Keys share prefixes of various lengths, under a few prefixes.
+		key[0] = byte(rand.Intn(4)) << 4
+		rand.Read(key[1+rand.Intn(sha256.Size-1):])
+		if ok, _ := smt.Has(key); ok {
+			continue
+		}
+		value := make([]byte, 1+rand.Intn(8))
+		rand.Read(value)
+		if _, err := smt.Update(key, value); err != nil {
+			t.Errorf("returned error when updating key: %v", err)
+		}
+		keys = append(keys, key)
+		valueHashes = append(valueHashes, smt.th.digest(value))
+	}
+
+	for i := 0; i < 300; i++ {
+		prefix := make([]byte, sha256.Size)
+		if rand.Intn(2) == 0 {
+			copy(prefix, keys[rand.Intn(len(keys))])
+		} else {
+			rand.Read(prefix)
+		}
+		nbits := rand.Intn(smt.depth() + 1)
+
+		proof, err := smt.ProvePrefix(prefix, nbits)
+		if err != nil {
+			t.Errorf("returned error when proving prefix: %v", err)
+		}
+		if !VerifyPrefixProof(proof, smt.Root(), prefix, nbits, sha256.New(), WithOrderedKeys()) {
+			t.Error("valid prefix proof failed to verify")
+		}
+
+		// The subtree root must commit to the leaves with the prefix.
+		var subtreeKeys, subtreeValueHashes [][]byte
+		for _, j := range sortedIndices(keys) {
+			if comparePrefix(keys[j], prefix, nbits) == 0 {
+				subtreeKeys = append(subtreeKeys, keys[j])
+				subtreeValueHashes = append(subtreeValueHashes, valueHashes[j])
+			}
+		}
+		if !bytes.Equal(proof.SubtreeRoot, smt.th.subtreeRoot(subtreeKeys, subtreeValueHashes, nbits)) {
+			t.Error("subtree root does not match the leaves with the prefix")
+		}
+
+		// Tampering with the subtree root or the prefix must not verify.
+		tampered := proof
+		if bytes.Equal(proof.SubtreeRoot, smt.th.placeholder()) {
+			tampered.SubtreeRoot = smt.Root()
+		} else {
+			tampered.SubtreeRoot = smt.th.placeholder()
+		}
+		if VerifyPrefixProof(tampered, smt.Root(), prefix, nbits, sha256.New(), WithOrderedKeys()) {
+			t.Error("prefix proof with tampered subtree root returned true")
+		}
+		if nbits > 0 && len(proof.SideNodes) == nbits {
+			otherPrefix := append([]byte{}, prefix...)
+			flipBitAtFromMSB(otherPrefix, nbits-1)
+			if VerifyPrefixProof(proof, smt.Root(), otherPrefix, nbits, sha256.New(), WithOrderedKeys()) {
+				t.Error("prefix proof verification returned true for wrong prefix")
+			}
+		}
+	}
+}
+
+// Test prefix proofs showing that a prefix is empty.
+func TestSparseMerkleTreePrefixProofsEmpty(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithOrderedKeys())
+	key := make([]byte, sha256.Size)
+	prefix := make([]byte, 1)
+
+	// An empty tree has empty prefixes.
+	proof, err := smt.ProvePrefix(prefix, 8)
+	if err != nil {
+		t.Errorf("returned error when proving prefix: %v", err)
+	}
+	if !bytes.Equal(proof.SubtreeRoot, smt.th.placeholder()) || !VerifyPrefixProof(proof, smt.Root(), prefix, 8, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid proof of empty prefix failed to verify")
+	}
+
+	// A single leaf outside of the prefix, shown as leaf data.
+	key[0] = 0x01
+	smt.Update(key, []byte("testValue"))
+	proof, err = smt.ProvePrefix(prefix, 8)
+	if err != nil {
+		t.Errorf("returned error when proving prefix: %v", err)
+	}
+	if proof.LeafData == nil || !bytes.Equal(proof.SubtreeRoot, smt.th.placeholder()) {
+		t.Error("did not get leaf data when proving prefix with unrelated leaf")
+	}
+	if !VerifyPrefixProof(proof, smt.Root(), prefix, 8, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid proof of empty prefix failed to verify")
+	}
+
+	// The same leaf inside of a shorter prefix.
+	proof, err = smt.ProvePrefix(prefix, 7)
+	if err != nil {
+		t.Errorf("returned error when proving prefix: %v", err)
+	}
+	leafHash, _ := smt.th.digestLeaf(key, smt.th.digest([]byte("testValue")))
+	if !bytes.Equal(proof.SubtreeRoot, leafHash) || !VerifyPrefixProof(proof, smt.Root(), prefix, 7, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid proof of single leaf prefix failed to verify")
+	}
+	proof.SubtreeRoot = smt.th.placeholder()
+	if VerifyPrefixProof(proof, smt.Root(), prefix, 7, sha256.New(), WithOrderedKeys()) {
+		t.Error("proof of empty prefix returned true for non-empty prefix")
+	}
+
+	// A placeholder above the prefix.
+	key[0] = 0x02
+	smt.Update(key, []byte("testValue"))
+	proof, err = smt.ProvePrefix([]byte{0x40}, 8)
+	if err != nil {
+		t.Errorf("returned error when proving prefix: %v", err)
+	}
+	if len(proof.SideNodes) != 2 || proof.LeafData != nil || !VerifyPrefixProof(proof, smt.Root(), []byte{0x40}, 8, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid proof of empty prefix failed to verify")
+	}
+}
+
+// Test errors when proving prefixes.
+func TestSparseMerkleTreePrefixProofsErrors(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	if _, err := smt.ProvePrefix([]byte{0}, 9); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("expected ErrInvalidPrefix when proving short prefix, got: %v", err)
+	}
+	if _, err := smt.ProvePrefix(make([]byte, 64), 257); !errors.Is(err, ErrInvalidPrefix) {
+		t.Errorf("expected ErrInvalidPrefix when proving long prefix, got: %v", err)
+	}
+
+	smt = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithExtensionNodes())
+	if _, err := smt.ProvePrefix([]byte{0}, 8); !errors.Is(err, ErrPrefixProofUnsupported) {
+		t.Errorf("expected ErrPrefixProofUnsupported when proving prefix with extension nodes, got: %v", err)
+	}
+}
+
+// sortedIndices returns the indices of a slice of paths in increasing order
+// of the paths.
+func sortedIndices(paths [][]byte) []int {
+	indices := make([]int, len(paths))
+	for i := range indices {
+		indices[i] = i
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return bytes.Compare(paths[indices[i]], paths[indices[j]]) < 0
+	})
+	return indices
+}
@@ -13,7 +13,8 @@ type SparseMerkleProof struct {
 
 	// NonMembershipLeafData is the data of the unrelated leaf at the position
 	// of the key being proven, in the case of a non-membership proof. For
-	// membership proofs, is nil.
+	// membership proofs, is nil. In trees with extension nodes, it may also be
+	// the data of an extension node that the path of the key leaves.
 	NonMembershipLeafData []byte
 
 	// SiblingData is the data of the sibling node to the leaf being proven,
@@ -26,17 +27,20 @@ func (proof *SparseMerkleProof) sanityCheck(th *treeHasher) bool {
 	// cause the verifier to fatally exit (e.g. due to an index out-of-range
 	// error) or cause a CPU DoS attack.
 
-	// Check that the number of supplied sidenodes does not exceed the maximum possible.
-	if len(proof.SideNodes) > th.pathSize()*8 ||
+	// Check that the number of supplied sidenodes does not exceed the depth of the tree.
+	if len(proof.SideNodes) > th.depth() ||
 
 		// Check that leaf data for non-membership proofs is the correct size.
-		(proof.NonMembershipLeafData != nil && len(proof.NonMembershipLeafData) != len(leafPrefix)+th.pathSize()+th.hasher.Size()) {
+		(proof.NonMembershipLeafData != nil && !th.isExtension(proof.NonMembershipLeafData) && len(proof.NonMembershipLeafData) != len(leafPrefix)+th.pathSize()+th.leafDataSize()) ||
+
+		// Check that extension node data for non-membership proofs is the correct size.
+		(th.isExtension(proof.NonMembershipLeafData) && len(proof.NonMembershipLeafData) != th.extensionSize()) {
 		return false
 	}
 
 	// Check that all supplied sidenodes are the correct size.
 	for _, v := range proof.SideNodes {
-		if len(v) != th.hasher.Size() {
+		if len(v) != th.nodeSize() {
 			return false
 		}
 	}
@@ -46,7 +50,21 @@ func (proof *SparseMerkleProof) sanityCheck(th *treeHasher) bool {
 		return true
 	}
 
-	siblingHash := th.digest(proof.SiblingData)
+	if len(proof.SiblingData) < len(leafPrefix) {
+		return false
+	}
+	if th.isLeaf(proof.SiblingData) {
+		if len(proof.SiblingData) != len(leafPrefix)+th.pathSize()+th.leafDataSize() {
+			return false
+		}
+	} else if th.isExtension(proof.SiblingData) {
+		if len(proof.SiblingData) != th.extensionSize() {
+			return false
+		}
+	} else if len(proof.SiblingData) != len(nodePrefix)+2*th.nodeSize() {
+		return false
+	}
+	siblingHash := th.digestData(proof.SiblingData)
 	return bytes.Equal(proof.SideNodes[0], siblingHash)
 }
 
@@ -82,7 +100,7 @@ func (proof *SparseCompactMerkleProof) sanityCheck(th *treeHasher) bool {
 	// de-compacted proof should be executed.
 
 	// Compact proofs: check that NumSideNodes is within the right range.
-	if proof.NumSideNodes < 0 || proof.NumSideNodes > th.pathSize()*8 ||
+	if proof.NumSideNodes < 0 || proof.NumSideNodes > th.depth() ||
 
 		// Compact proofs: check that the length of the bit mask is as expected
 		// according to NumSideNodes.
@@ -97,17 +115,18 @@ func (proof *SparseCompactMerkleProof) sanityCheck(th *treeHasher) bool {
 	return true
 }
 
-// VerifyProof verifies a Merkle proof.
-func VerifyProof(proof SparseMerkleProof, root []byte, key []byte, value []byte, hasher hash.Hash) bool {
-	result, _ := verifyProofWithUpdates(proof, root, key, value, hasher)
+// VerifyProof verifies a Merkle proof. The options must match those of the
+// tree that generated the proof.
+func VerifyProof(proof SparseMerkleProof, root []byte, key []byte, value []byte, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, options)
+	result, _ := verifyProofWithUpdates(proof, root, th.path(key), th.valueHash(value), th)
 	return result
 }
 
-func verifyProofWithUpdates(proof SparseMerkleProof, root []byte, key []byte, value []byte, hasher hash.Hash) (bool, [][][]byte) {
-	th := newTreeHasher(hasher)
-	path := th.path(key)
-
-	if !proof.sanityCheck(th) {
+// verifyProofWithUpdates verifies a Merkle proof for a path, where valueHash
+// is the data committed to by the leaf, or nil for a non-membership proof.
+func verifyProofWithUpdates(proof SparseMerkleProof, root []byte, path []byte, valueHash []byte, th *treeHasher) (bool, [][][]byte) {
+	if len(path) != th.pathSize() || !proof.sanityCheck(th) {
 		return false, nil
 	}
 
@@ -115,9 +134,21 @@ func verifyProofWithUpdates(proof SparseMerkleProof, root []byte, key []byte, va
 
 	// Determine what the leaf hash should be.
 	var currentHash, currentData []byte
-	if bytes.Equal(value, defaultValue) { // Non-membership proof.
+	if valueHash == nil { // Non-membership proof.
 		if proof.NonMembershipLeafData == nil { // Leaf is a placeholder value.
 			currentHash = th.placeholder()
+		} else if th.isExtension(proof.NonMembershipLeafData) { // Path leaves an extension node.
+			start, end, extensionPath, child := th.parseExtension(proof.NonMembershipLeafData)
+			if start != len(proof.SideNodes) || end <= start || end > th.depth() ||
+				start+countCommonBits(path, extensionPath, start, end) == end {
+				// The path does not leave this extension node; non-membership proof failed.
+				return false, nil
+			}
+			currentHash, currentData = th.digestExtension(start, end, extensionPath, child)
+
+			update := make([][]byte, 2)
+			update[0], update[1] = currentHash, currentData
+			updates = append(updates, update)
 		} else { // Leaf is an unrelated leaf.
 			actualPath, valueHash := th.parseLeaf(proof.NonMembershipLeafData)
 			if bytes.Equal(actualPath, path) {
@@ -131,7 +162,6 @@ func verifyProofWithUpdates(proof SparseMerkleProof, root []byte, key []byte, va
 			updates = append(updates, update)
 		}
 	} else { // Membership proof.
-		valueHash := th.digest(value)
 		currentHash, currentData = th.digestLeaf(path, valueHash)
 		update := make([][]byte, 2)
 		update[0], update[1] = currentHash, currentData
@@ -139,10 +169,29 @@ func verifyProofWithUpdates(proof SparseMerkleProof, root []byte, key []byte, va
 	}
 
 	// Recompute root.
+	extensionLength := 0
 	for i := 0; i < len(proof.SideNodes); i++ {
-		node := make([]byte, th.pathSize())
+		node := make([]byte, th.nodeSize())
 		copy(node, proof.SideNodes[i])
 
+		if th.extensions && bytes.Equal(node, th.placeholder()) && !bytes.Equal(currentHash, th.placeholder()) {
+			// Placeholder siblings above a node are collapsed into an extension node.
+			extensionLength++
+			continue
+		}
+		if extensionLength > 0 {
+			start := len(proof.SideNodes) - i
+			currentHash, currentData = th.digestExtension(start, start+extensionLength, path, currentHash)
+			extensionLength = 0
+
+			update := make([][]byte, 2)
+			update[0], update[1] = currentHash, currentData
+			updates = append(updates, update)
+		}
+
+		if th.sumOverflows(node, currentHash) {
+			return false, nil
+		}
 		if getBitAtFromMSB(path, len(proof.SideNodes)-1-i) == right {
 			currentHash, currentData = th.digestNode(node, currentHash)
 		} else {
@@ -153,23 +202,32 @@ func verifyProofWithUpdates(proof SparseMerkleProof, root []byte, key []byte, va
 		update[0], update[1] = currentHash, currentData
 		updates = append(updates, update)
 	}
+	if extensionLength > 0 {
+		currentHash, currentData = th.digestExtension(0, extensionLength, path, currentHash)
+
+		update := make([][]byte, 2)
+		update[0], update[1] = currentHash, currentData
+		updates = append(updates, update)
+	}
 
 	return bytes.Equal(currentHash, root), updates
 }
 
 // VerifyCompactProof verifies a compacted Merkle proof.
-func VerifyCompactProof(proof SparseCompactMerkleProof, root []byte, key []byte, value []byte, hasher hash.Hash) bool {
-	decompactedProof, err := DecompactProof(proof, hasher)
+func VerifyCompactProof(proof SparseCompactMerkleProof, root []byte, key []byte, value []byte, hasher hash.Hash, options ...Option) bool {
+	decompactedProof, err := DecompactProof(proof, hasher, options...)
 	if err != nil {
 		return false
 	}
-	return VerifyProof(decompactedProof, root, key, value, hasher)
+	return VerifyProof(decompactedProof, root, key, value, hasher, options...)
 }
 
 // CompactProof compacts a proof, to reduce its size.
-func CompactProof(proof SparseMerkleProof, hasher hash.Hash) (SparseCompactMerkleProof, error) {
-	th := newTreeHasher(hasher)
+func CompactProof(proof SparseMerkleProof, hasher hash.Hash, options ...Option) (SparseCompactMerkleProof, error) {
+	return compactProof(proof, treeHasherWithOptions(hasher, options))
+}
 
+func compactProof(proof SparseMerkleProof, th *treeHasher) (SparseCompactMerkleProof, error) {
 	if !proof.sanityCheck(th) {
 		return SparseCompactMerkleProof{}, ErrBadProof
 	}
@@ -177,7 +235,7 @@ func CompactProof(proof SparseMerkleProof, hasher hash.Hash) (SparseCompactMerkl
 	bitMask := emptyBytes(int(math.Ceil(float64(len(proof.SideNodes)) / float64(8))))
 	var compactedSideNodes [][]byte
 	for i := 0; i < len(proof.SideNodes); i++ {
-		node := make([]byte, th.hasher.Size())
+		node := make([]byte, th.nodeSize())
 		copy(node, proof.SideNodes[i])
 		if bytes.Equal(node, th.placeholder()) {
 			setBitAtFromMSB(bitMask, i)
@@ -196,9 +254,11 @@ func CompactProof(proof SparseMerkleProof, hasher hash.Hash) (SparseCompactMerkl
 }
 
 // DecompactProof decompacts a proof, so that it can be used for VerifyProof.
-func DecompactProof(proof SparseCompactMerkleProof, hasher hash.Hash) (SparseMerkleProof, error) {
-	th := newTreeHasher(hasher)
+func DecompactProof(proof SparseCompactMerkleProof, hasher hash.Hash, options ...Option) (SparseMerkleProof, error) {
+	return decompactProof(proof, treeHasherWithOptions(hasher, options))
+}
 
+func decompactProof(proof SparseCompactMerkleProof, th *treeHasher) (SparseMerkleProof, error) {
 	if !proof.sanityCheck(th) {
 		return SparseMerkleProof{}, ErrBadProof
 	}
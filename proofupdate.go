@@ -0,0 +1,184 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+)
+
+// ErrProofUpdateUnsupported is returned when updating a proof of a tree with
+// extension nodes.
+var ErrProofUpdateUnsupported = errors.New("proof updates are not supported with extension nodes")
+
+// UpdateProof updates a Merkle proof for a key, after another key of the tree
+// is set to a new value, or deleted with the default value. otherProof is a
+// Merkle proof for the other key against the same root as myProof. The
+// returned proof is valid against the root of the tree after the update.
+//
+// To delete the other key, otherProof must be an updatable proof. See
+// SparseMerkleTree.ProveUpdatable.
+func UpdateProof(myProof SparseMerkleProof, myKey []byte, otherProof SparseMerkleProof, otherKey []byte, otherNewValue []byte, hasher hash.Hash, options ...Option) (SparseMerkleProof, error) {
+	// Rebuild the part of the tree that the proofs cover, and update the
+	// other key in it.
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), hasher, options...)
+	if smt.th.extensions {
+		return SparseMerkleProof{}, ErrProofUpdateUnsupported
+	}
+	if err := smt.checkKey(myKey); err != nil {
+		return SparseMerkleProof{}, err
+	}
+	if err := smt.checkKey(otherKey); err != nil {
+		return SparseMerkleProof{}, err
+	}
+	if !myProof.sanityCheck(&smt.th) || !otherProof.sanityCheck(&smt.th) {
+		return SparseMerkleProof{}, ErrBadProof
+	}
+
+	root, err := smt.addProofBranches(myProof, smt.th.path(myKey), otherProof, smt.th.path(otherKey))
+	if err != nil {
+		return SparseMerkleProof{}, err
+	}
+	newRoot, err := smt.UpdateForRoot(otherKey, otherNewValue, root)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			// The proofs do not cover a node that the update needs.
+			return SparseMerkleProof{}, ErrBadProof
+		}
+		return SparseMerkleProof{}, err
+	}
+	return smt.proveForPath(smt.th.path(myKey), newRoot, false)
+}
+
+// addProofBranches adds the nodes on the paths of two proofs against the same
+// root to the tree, and returns the root. The data of leaves that the proofs
+// do not show is made up: their hashes are only used as path nodes of the
+// proofs, never as side nodes, so the side nodes of the tree stay correct.
+func (smt *SparseMerkleTree) addProofBranches(myProof SparseMerkleProof, myPath []byte, otherProof SparseMerkleProof, otherPath []byte) ([]byte, error) {
+	myDepth, otherDepth := len(myProof.SideNodes), len(otherProof.SideNodes)
+	split := countCommonPrefix(myPath, otherPath)
+	if split > smt.depth() {
+		split = smt.depth()
+	}
+
+	if myDepth <= split {
+		// Both proofs end at the same leaf or placeholder.
+		if otherDepth != myDepth || !equalByteSlices(myProof.SideNodes, otherProof.SideNodes) {
+			return nil, ErrBadProof
+		}
+		leafData := otherProof.NonMembershipLeafData
+		if leafData == nil {
+			leafData = myProof.NonMembershipLeafData
+		} else if myProof.NonMembershipLeafData != nil && !bytes.Equal(leafData, myProof.NonMembershipLeafData) {
+			return nil, ErrBadProof
+		}
+		if leafData == nil && bytes.Equal(myPath, otherPath) {
+			// The key may be in the tree: if not, its leaf is in the
+			// place of a placeholder, with the same side nodes.
+			_, leafData = smt.th.digestLeaf(otherPath, make([]byte, smt.th.leafDataSize()))
+		}
+		hashes, data := smt.th.proofBranch(otherProof, otherPath, leafData)
+		if err := smt.addBranchNodes(hashes, data, 0, otherProof, otherPath); err != nil {
+			return nil, err
+		}
+		return hashes[0], nil
+	}
+
+	// The proofs share the side nodes above the depth at which their paths
+	// split, and each has the subtree of the other path there as a side node.
+	if otherDepth <= split || !equalByteSlices(myProof.SideNodes[myDepth-split:], otherProof.SideNodes[otherDepth-split:]) {
+		return nil, ErrBadProof
+	}
+	mySibling := myProof.SideNodes[myDepth-split-1]
+	otherSibling := otherProof.SideNodes[otherDepth-split-1]
+
+	myHashes, myData := smt.th.proofBranch(myProof, myPath, smt.th.proofLeafData(myProof, myPath, otherSibling, split+1))
+	otherHashes, otherData := smt.th.proofBranch(otherProof, otherPath, smt.th.proofLeafData(otherProof, otherPath, mySibling, split+1))
+	if err := smt.addBranchNodes(myHashes, myData, 0, myProof, myPath); err != nil {
+		return nil, err
+	}
+	// The subtree of the other path hangs below the path of my proof.
+	otherHashes[split+1] = mySibling
+	if err := smt.addBranchNodes(otherHashes, otherData, split+1, otherProof, otherPath); err != nil {
+		return nil, err
+	}
+	return myHashes[0], nil
+}
+
+// addBranchNodes adds the nodes on the path of a proof from a depth down to
+// the tree, along with the sibling data of the proof, and the value of the
+// leaf of the path if it has one.
+func (smt *SparseMerkleTree) addBranchNodes(hashes [][]byte, data [][]byte, depth int, proof SparseMerkleProof, path []byte) error {
+	for i := depth; i < len(hashes); i++ {
+		if data[i] == nil {
+			continue
+		}
+		if err := smt.nodes.Set(hashes[i], data[i]); err != nil {
+			return err
+		}
+	}
+	if proof.SiblingData != nil && len(proof.SideNodes) > 0 {
+		if err := smt.nodes.Set(proof.SideNodes[0], proof.SiblingData); err != nil {
+			return err
+		}
+	}
+
+	leafData := data[len(data)-1]
+	if leafData != nil {
+		if leafPath, _ := smt.th.parseLeaf(leafData); bytes.Equal(leafPath, path) {
+			// The value is only there to be replaced or removed.
+			return smt.values.Set(path, []byte{})
+		}
+	}
+	return nil
+}
+
+// proofLeafData returns the data of the leaf that a proof for a path ends at,
+// or nil if it ends at a placeholder, given the hash of the node at a depth on
+// the path. The data of the leaf of the path itself is made up.
+func (th *treeHasher) proofLeafData(proof SparseMerkleProof, path []byte, node []byte, depth int) []byte {
+	if proof.NonMembershipLeafData != nil {
+		return proof.NonMembershipLeafData
+	}
+	if hashes, _ := th.proofBranch(proof, path, nil); bytes.Equal(hashes[depth], node) {
+		return nil
+	}
+	_, data := th.digestLeaf(path, make([]byte, th.leafDataSize()))
+	return data
+}
+
+// proofBranch returns the hashes and data of the nodes on the path of a proof,
+// by depth, where leafData is the data of the leaf that the proof ends at, or
+// nil if it ends at a placeholder.
+func (th *treeHasher) proofBranch(proof SparseMerkleProof, path []byte, leafData []byte) ([][]byte, [][]byte) {
+	depth := len(proof.SideNodes)
+	hashes := make([][]byte, depth+1)
+	data := make([][]byte, depth+1)
+	if leafData == nil {
+		hashes[depth] = th.placeholder()
+	} else {
+		leafPath, valueHash := th.parseLeaf(leafData)
+		hashes[depth], data[depth] = th.digestLeaf(leafPath, valueHash)
+	}
+	for i, sideNode := range proof.SideNodes {
+		height := depth - 1 - i
+		if getBitAtFromMSB(path, height) == right {
+			hashes[height], data[height] = th.digestNode(sideNode, hashes[height+1])
+		} else {
+			hashes[height], data[height] = th.digestNode(hashes[height+1], sideNode)
+		}
+	}
+	return hashes, data
+}
+
+func equalByteSlices(a [][]byte, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
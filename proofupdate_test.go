@@ -0,0 +1,85 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Test that updated proofs are the proofs of the updated tree.
+func TestUpdateProof(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithDepth(8)}} {
+		for _, n := range []int{0, 1, 2, 3, 50} {
+			for trial := 0; trial < 20; trial++ {
+				smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+				for i := 0; i < n; i++ {
+					s := strconv.Itoa(i)
+					smt.Update([]byte(s), []byte(s))
+				}
+				root := smt.Root()
+
+				// Keys in the tree and keys out of it, updated and deleted.
+				myKey := []byte(strconv.Itoa(rand.Intn(n + 3)))
+				otherKey := []byte(strconv.Itoa(rand.Intn(n + 3)))
+				otherNewValue := []byte("newValue")
+				if rand.Intn(2) == 0 {
+					otherNewValue = defaultValue
+				}
+
+				myProof, _ := smt.ProveForRoot(myKey, root)
+				otherProof, _ := smt.ProveUpdatableForRoot(otherKey, root)
+				proof, err := UpdateProof(myProof, myKey, otherProof, otherKey, otherNewValue, sha256.New(), options...)
+				if errors.Is(err, ErrPathCollision) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("returned error when updating proof: %v", err)
+					continue
+				}
+
+				if _, err := smt.Update(otherKey, otherNewValue); err != nil {
+					t.Errorf("returned error when updating tree: %v", err)
+				}
+				expected, _ := smt.Prove(myKey)
+				if !reflect.DeepEqual(expected.SideNodes, proof.SideNodes) ||
+					!bytes.Equal(expected.NonMembershipLeafData, proof.NonMembershipLeafData) {
+					t.Errorf("updated proof differs from proof of updated tree (%d leaves, keys %s and %s)", n, myKey, otherKey)
+				}
+				myValue, _ := smt.Get(myKey)
+				if !VerifyProof(proof, smt.Root(), myKey, myValue, sha256.New(), options...) {
+					t.Error("updated proof failed to verify")
+				}
+			}
+		}
+	}
+}
+
+// Test that proofs against different roots are rejected.
+func TestUpdateProofInvalid(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 20; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	myProof, _ := smt.Prove([]byte("1"))
+	smt.Update([]byte("2"), []byte("changed"))
+	otherProof, _ := smt.Prove([]byte("3"))
+	if _, err := UpdateProof(myProof, []byte("1"), otherProof, []byte("3"), []byte("newValue"), sha256.New()); !errors.Is(err, ErrBadProof) {
+		t.Errorf("expected ErrBadProof when updating proof with proof of another root, got: %v", err)
+	}
+
+	// Deleting a key needs the data of its sibling.
+	myProof, _ = smt.Prove([]byte("1"))
+	otherProof, _ = smt.Prove([]byte("3"))
+	if _, err := UpdateProof(myProof, []byte("1"), otherProof, []byte("3"), defaultValue, sha256.New()); !errors.Is(err, ErrBadProof) {
+		t.Errorf("expected ErrBadProof when deleting key without updatable proof, got: %v", err)
+	}
+
+	if _, err := UpdateProof(myProof, []byte("1"), otherProof, []byte("3"), []byte("newValue"), sha256.New(), WithExtensionNodes()); !errors.Is(err, ErrProofUpdateUnsupported) {
+		t.Errorf("expected ErrProofUpdateUnsupported when updating proof with extension nodes, got: %v", err)
+	}
+}
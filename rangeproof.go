@@ -0,0 +1,312 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"sort"
+)
+
+// ErrRangeProofUnsupported is returned when proving a range of keys in a tree
+// without ordered keys, or with extension nodes. It is also returned when
+// exporting chunks from a tree with extension nodes.
+var ErrRangeProofUnsupported = errors.New("range proofs require ordered keys without extension nodes")
+
+// ErrInvalidRange is returned when the start key of a range is after its end
+// key.
+var ErrInvalidRange = errors.New("invalid range")
+
+// SparseMerkleRangeProof is a Merkle proof for all the leaves of a tree with
+// ordered keys whose keys are in a range.
+type SparseMerkleRangeProof struct {
+	// Keys are the keys of the leaves in the range, in increasing order.
+	Keys [][]byte
+
+	// Values are the values of the leaves in the range, in the same order
+	// as Keys.
+	Values [][]byte
+
+	// StartProof is a Merkle proof for the start key of the range.
+	StartProof SparseMerkleProof
+
+	// EndProof is a Merkle proof for the end key of the range.
+	EndProof SparseMerkleProof
+}
+
+// ProveRange generates a Merkle proof for the leaves whose keys are between
+// startKey and endKey, inclusive, against the current root. The tree must
+// have been created with WithOrderedKeys.
+func (smt *SparseMerkleTree) ProveRange(startKey []byte, endKey []byte) (SparseMerkleRangeProof, error) {
+	return smt.ProveRangeForRoot(startKey, endKey, smt.Root())
+}
+
+// ProveRangeForRoot generates a Merkle proof for the leaves whose keys are
+// between startKey and endKey, inclusive, against a specific node.
+func (smt *SparseMerkleTree) ProveRangeForRoot(startKey []byte, endKey []byte, root []byte) (SparseMerkleRangeProof, error) {
+	if !smt.th.orderedKeys || smt.th.extensions {
+		return SparseMerkleRangeProof{}, ErrRangeProofUnsupported
+	}
+	if err := smt.checkKey(startKey); err != nil {
+		return SparseMerkleRangeProof{}, err
+	}
+	if err := smt.checkKey(endKey); err != nil {
+		return SparseMerkleRangeProof{}, err
+	}
+	if bytes.Compare(startKey, endKey) > 0 {
+		return SparseMerkleRangeProof{}, ErrInvalidRange
+	}
+
+	startProof, err := smt.ProveForRoot(startKey, root)
+	if err != nil {
+		return SparseMerkleRangeProof{}, err
+	}
+	endProof, err := smt.ProveForRoot(endKey, root)
+	if err != nil {
+		return SparseMerkleRangeProof{}, err
+	}
+
+	var keys, values [][]byte
+	err = smt.rangeLeaves(root, 0, make([]byte, smt.th.pathSize()), startKey, endKey, func(path []byte, valueHash []byte) error {
+		value, err := smt.valueForHash(path, valueHash)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, path)
+		values = append(values, value)
+		return nil
+	})
+	if err != nil {
+		return SparseMerkleRangeProof{}, err
+	}
+
+	return SparseMerkleRangeProof{
+		Keys:       keys,
+		Values:     values,
+		StartProof: startProof,
+		EndProof:   endProof,
+	}, nil
+}
+
+// rangeLeaves calls fn with the path and value hash of every leaf beneath a
+// node at a depth whose path is between start and end, in increasing order.
+// prefix holds the path bits leading to the node.
+func (smt *SparseMerkleTree) rangeLeaves(node []byte, depth int, prefix []byte, start []byte, end []byte, fn func(path []byte, valueHash []byte) error) error {
+	if bytes.Equal(node, smt.th.placeholder()) {
+		return nil
+	}
+
+	data, err := smt.nodes.Get(node)
+	if err != nil {
+		return err
+	}
+	if smt.th.isLeaf(data) {
+		path, valueHash := smt.th.parseLeaf(data)
+		if bytes.Compare(path, start) >= 0 && bytes.Compare(path, end) <= 0 {
+			return fn(path, valueHash)
+		}
+		return nil
+	}
+	if smt.th.isExtension(data) {
+		// Only descend into the child if its subtree overlaps the range.
+		extensionStart, extensionEnd, extensionPath, child := smt.th.parseExtension(data)
+		childPrefix := append([]byte(nil), prefix...)
+		for i := extensionStart; i < extensionEnd; i++ {
+			if getBitAtFromMSB(extensionPath, i) == right {
+				setBitAtFromMSB(childPrefix, i)
+			}
+		}
+		if comparePrefix(childPrefix, start, extensionEnd) < 0 || comparePrefix(childPrefix, end, extensionEnd) > 0 {
+			return nil
+		}
+		return smt.rangeLeaves(child, extensionEnd, childPrefix, start, end, fn)
+	}
+
+	// Only descend into the children whose subtree overlaps the range.
+	leftNode, rightNode := smt.th.parseNode(data)
+	rightPrefix := append([]byte(nil), prefix...)
+	setBitAtFromMSB(rightPrefix, depth)
+	if comparePrefix(prefix, start, depth+1) >= 0 {
+		if err := smt.rangeLeaves(leftNode, depth+1, prefix, start, end, fn); err != nil {
+			return err
+		}
+	}
+	if comparePrefix(rightPrefix, end, depth+1) <= 0 {
+		if err := smt.rangeLeaves(rightNode, depth+1, rightPrefix, start, end, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifyRangeProof verifies a Merkle proof for the leaves whose keys are
+// between startKey and endKey, inclusive. It checks that the keys and values
+// of the proof are all the leaves of the tree in that range.
+func VerifyRangeProof(proof SparseMerkleRangeProof, root []byte, startKey []byte, endKey []byte, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, options)
+	return verifyRangeProof(proof, root, startKey, endKey, th)
+}
+
+func verifyRangeProof(proof SparseMerkleRangeProof, root []byte, start []byte, end []byte, th *treeHasher) bool {
+	if !th.orderedKeys || th.extensions {
+		return false
+	}
+	if len(proof.Keys) != len(proof.Values) {
+		return false
+	}
+	valueHashes := make([][]byte, len(proof.Keys))
+	for i, value := range proof.Values {
+		valueHashes[i] = th.valueHash(value)
+		if valueHashes[i] == nil {
+			return false
+		}
+	}
+	return verifyRange(proof.StartProof, proof.EndProof, proof.Keys, valueHashes, root, start, end, th)
+}
+
+// verifyRange checks that the leaves with the given paths and value hashes are
+// all the leaves of the tree whose paths are between start and end, from the
+// Merkle proofs for start and end.
+func verifyRange(startProof SparseMerkleProof, endProof SparseMerkleProof, paths [][]byte, valueHashes [][]byte, root []byte, start []byte, end []byte, th *treeHasher) bool {
+	if len(start) != th.pathSize() || len(end) != th.pathSize() || bytes.Compare(start, end) > 0 {
+		return false
+	}
+
+	// Check that the paths are sorted and in the range.
+	if len(paths) != len(valueHashes) {
+		return false
+	}
+	for i, path := range paths {
+		if len(path) != th.pathSize() || bytes.Compare(path, start) < 0 || bytes.Compare(path, end) > 0 ||
+			(i > 0 && bytes.Compare(path, paths[i-1]) <= 0) {
+			return false
+		}
+	}
+
+	// The proofs for the start and end paths are membership proofs if the
+	// paths are in the range.
+	var startValueHash, endValueHash []byte
+	if len(paths) > 0 && bytes.Equal(paths[0], start) {
+		startValueHash = valueHashes[0]
+	}
+	if len(paths) > 0 && bytes.Equal(paths[len(paths)-1], end) {
+		endValueHash = valueHashes[len(paths)-1]
+	}
+	if result, _ := verifyProofWithUpdates(startProof, root, start, startValueHash, th); !result {
+		return false
+	}
+	if result, _ := verifyProofWithUpdates(endProof, root, end, endValueHash, th); !result {
+		return false
+	}
+
+	// The paths of the start and end keys diverge below the node at this
+	// depth: everything between them is beneath its children.
+	divergence := countCommonPrefix(start, end)
+	if divergence > th.depth() {
+		divergence = th.depth()
+	}
+	startDepth := len(startProof.SideNodes)
+	endDepth := len(endProof.SideNodes)
+
+	if startDepth <= divergence || endDepth <= divergence {
+		// Both proofs end at the same leaf or placeholder, which holds the
+		// whole range.
+		leafPath, leafValueHash := rangeProofLeaf(startProof, start, startValueHash, th)
+		if startDepth > divergence {
+			leafPath, leafValueHash = rangeProofLeaf(endProof, end, endValueHash, th)
+		}
+		if leafPath == nil || bytes.Compare(leafPath, start) < 0 || bytes.Compare(leafPath, end) > 0 {
+			return len(paths) == 0
+		}
+		return len(paths) == 1 && bytes.Equal(paths[0], leafPath) && bytes.Equal(valueHashes[0], leafValueHash)
+	}
+
+	// Walk the leaves of the range in order, checking them against every
+	// subtree that the range covers: the leaf or placeholder that the start
+	// proof ends at, the right siblings of the start path and the left
+	// siblings of the end path below the divergence, and the leaf or
+	// placeholder that the end proof ends at.
+	k := 0
+	checkLeaf := func(leafPath []byte, leafValueHash []byte) bool {
+		if leafPath == nil || bytes.Compare(leafPath, start) < 0 || bytes.Compare(leafPath, end) > 0 {
+			return true
+		}
+		if k == len(paths) || !bytes.Equal(paths[k], leafPath) || !bytes.Equal(valueHashes[k], leafValueHash) {
+			return false
+		}
+		k++
+		return true
+	}
+	checkSubtree := func(sideNode []byte, prefix []byte, depth int) bool {
+		first := k
+		for k < len(paths) && comparePrefix(paths[k], prefix, depth) == 0 {
+			k++
+		}
+		return bytes.Equal(sideNode, th.subtreeRoot(paths[first:k], valueHashes[first:k], depth))
+	}
+
+	if !checkLeaf(rangeProofLeaf(startProof, start, startValueHash, th)) {
+		return false
+	}
+	for i := startDepth - 1; i > divergence; i-- {
+		if getBitAtFromMSB(start, i) != right {
+			prefix := append([]byte(nil), start...)
+			setBitAtFromMSB(prefix, i)
+			if !checkSubtree(startProof.SideNodes[startDepth-1-i], prefix, i+1) {
+				return false
+			}
+		}
+	}
+	for i := divergence + 1; i < endDepth; i++ {
+		if getBitAtFromMSB(end, i) == right {
+			prefix := append([]byte(nil), end...)
+			flipBitAtFromMSB(prefix, i)
+			if !checkSubtree(endProof.SideNodes[endDepth-1-i], prefix, i+1) {
+				return false
+			}
+		}
+	}
+	if !checkLeaf(rangeProofLeaf(endProof, end, endValueHash, th)) {
+		return false
+	}
+
+	return k == len(paths)
+}
+
+// rangeProofLeaf returns the path and value hash of the leaf that a verified
+// proof for a path ends at, or nil if it ends at a placeholder.
+func rangeProofLeaf(proof SparseMerkleProof, path []byte, valueHash []byte, th *treeHasher) ([]byte, []byte) {
+	if valueHash != nil {
+		return path, valueHash
+	}
+	if proof.NonMembershipLeafData != nil {
+		return th.parseLeaf(proof.NonMembershipLeafData)
+	}
+	return nil, nil
+}
+
+// subtreeRoot returns the root of the subtree at a depth that holds exactly
+// the leaves with the given paths and value hashes, sorted by path. It returns
+// nil if two of the paths cannot be told apart within the depth of the tree.
+func (th *treeHasher) subtreeRoot(paths [][]byte, valueHashes [][]byte, depth int) []byte {
+	switch len(paths) {
+	case 0:
+		return th.placeholder()
+	case 1:
+		hash, _ := th.digestLeaf(paths[0], valueHashes[0])
+		return hash
+	}
+	if depth >= th.depth() {
+		return nil
+	}
+
+	split := sort.Search(len(paths), func(i int) bool {
+		return getBitAtFromMSB(paths[i], depth) == right
+	})
+	leftNode := th.subtreeRoot(paths[:split], valueHashes[:split], depth+1)
+	rightNode := th.subtreeRoot(paths[split:], valueHashes[split:], depth+1)
+	if leftNode == nil || rightNode == nil {
+		return nil
+	}
+	hash, _ := th.digestNode(leftNode, rightNode)
+	return hash
+}
@@ -0,0 +1,185 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Test range proofs against the sorted contents of a tree with ordered keys.
+func TestSparseMerkleTreeRangeProofs(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithOrderedKeys())
+	kv := make(map[string][]byte)
+	for i := 0; i < 200; i++ {
+		key := make([]byte, sha256.Size)
+		// Keys share prefixes of various lengths.
+		key[0] = byte(rand.Intn(4))
+		rand.Read(key[1+rand.Intn(sha256.Size-1):])
+		value := make([]byte, 1+rand.Intn(8))
+		rand.Read(value)
+		kv[string(key)] = value
+		if _, err := smt.Update(key, value); err != nil {
+			t.Errorf("returned error when updating key: %v", err)
+		}
+	}
+	keys := make([]string, 0, len(kv))
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i := 0; i < 200; i++ {
+		start := make([]byte, sha256.Size)
+		end := make([]byte, sha256.Size)
+		switch rand.Intn(3) {
+		case 0: // Range bounded by existing keys.
+			a, b := rand.Intn(len(keys)), rand.Intn(len(keys))
+			if a > b {
+				a, b = b, a
+			}
+			copy(start, keys[a])
+			copy(end, keys[b])
+		case 1: // Range of random keys.
+			start[0], end[0] = byte(rand.Intn(4)), byte(rand.Intn(4))
+			rand.Read(start[1:])
+			rand.Read(end[1:])
+			if bytes.Compare(start, end) > 0 {
+				start, end = end, start
+			}
+		case 2: // Single key range.
+			copy(start, keys[rand.Intn(len(keys))])
+			copy(end, start)
+		}
+
+		proof, err := smt.ProveRange(start, end)
+		if err != nil {
+			t.Errorf("returned error when proving range: %v", err)
+		}
+		var expected []string
+		for _, k := range keys {
+			if k >= string(start) && k <= string(end) {
+				expected = append(expected, k)
+			}
+		}
+		if len(proof.Keys) != len(expected) {
+			t.Fatalf("expected %d keys in range, got %d", len(expected), len(proof.Keys))
+		}
+		for j, k := range expected {
+			if !bytes.Equal([]byte(k), proof.Keys[j]) || !bytes.Equal(kv[k], proof.Values[j]) {
+				t.Error("did not get correct leaves in range")
+			}
+		}
+		if !VerifyRangeProof(proof, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+			t.Error("valid range proof failed to verify")
+		}
+
+		if len(proof.Keys) > 0 {
+			// Omitting a leaf of the range must not verify.
+			j := rand.Intn(len(proof.Keys))
+			omitted := proof
+			omitted.Keys = append(append([][]byte{}, proof.Keys[:j]...), proof.Keys[j+1:]...)
+			omitted.Values = append(append([][]byte{}, proof.Values[:j]...), proof.Values[j+1:]...)
+			if VerifyRangeProof(omitted, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+				t.Error("range proof with an omitted leaf returned true")
+			}
+
+			// Changing a value must not verify.
+			changed := proof
+			changed.Values = append([][]byte{}, proof.Values...)
+			changed.Values[j] = []byte("badValue")
+			if VerifyRangeProof(changed, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+				t.Error("range proof with a changed value returned true")
+			}
+		}
+
+		// Adding a leaf to the range must not verify.
+		added := proof
+		extra := append([]byte{}, end...)
+		extra[len(extra)-1]--
+		if bytes.Compare(extra, start) >= 0 && kv[string(extra)] == nil {
+			j := sort.Search(len(proof.Keys), func(i int) bool { return bytes.Compare(proof.Keys[i], extra) > 0 })
+			added.Keys = append(append(append([][]byte{}, proof.Keys[:j]...), extra), proof.Keys[j:]...)
+			added.Values = append(append(append([][]byte{}, proof.Values[:j]...), []byte("value")), proof.Values[j:]...)
+			if VerifyRangeProof(added, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+				t.Error("range proof with an added leaf returned true")
+			}
+		}
+	}
+}
+
+// Test range proofs on the smallest trees.
+func TestSparseMerkleTreeRangeProofsSmall(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithOrderedKeys())
+	start := make([]byte, sha256.Size)
+	end := bytes.Repeat([]byte{0xff}, sha256.Size)
+
+	// An empty tree has no leaves in any range.
+	proof, err := smt.ProveRange(start, end)
+	if err != nil {
+		t.Errorf("returned error when proving range: %v", err)
+	}
+	if len(proof.Keys) != 0 || !VerifyRangeProof(proof, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid range proof on empty tree failed to verify")
+	}
+
+	// A tree with a single leaf, inside and outside of the range.
+	key := make([]byte, sha256.Size)
+	key[0] = 0x80
+	smt.Update(key, []byte("testValue"))
+	proof, err = smt.ProveRange(start, end)
+	if err != nil {
+		t.Errorf("returned error when proving range: %v", err)
+	}
+	if len(proof.Keys) != 1 || !VerifyRangeProof(proof, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid range proof on single leaf failed to verify")
+	}
+	proof.Keys, proof.Values = nil, nil
+	if VerifyRangeProof(proof, smt.Root(), start, end, sha256.New(), WithOrderedKeys()) {
+		t.Error("range proof with an omitted leaf returned true")
+	}
+	proof, err = smt.ProveRange(start, start)
+	if err != nil {
+		t.Errorf("returned error when proving range: %v", err)
+	}
+	if len(proof.Keys) != 0 || !VerifyRangeProof(proof, smt.Root(), start, start, sha256.New(), WithOrderedKeys()) {
+		t.Error("valid range proof outside of single leaf failed to verify")
+	}
+
+	// Range proofs require the same options to verify.
+	if VerifyRangeProof(proof, smt.Root(), start, start, sha256.New()) {
+		t.Error("range proof verification returned true without ordered keys")
+	}
+}
+
+// Test errors for keys and ranges of trees with ordered keys.
+func TestSparseMerkleTreeOrderedKeysErrors(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithOrderedKeys())
+	key := make([]byte, sha256.Size)
+
+	if _, err := smt.Update([]byte("short"), []byte("testValue")); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("expected ErrInvalidKeySize when updating short key, got: %v", err)
+	}
+	if _, err := smt.Get([]byte("short")); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("expected ErrInvalidKeySize when getting short key, got: %v", err)
+	}
+	if _, err := smt.Prove([]byte("short")); !errors.Is(err, ErrInvalidKeySize) {
+		t.Errorf("expected ErrInvalidKeySize when proving short key, got: %v", err)
+	}
+	if VerifyProof(SparseMerkleProof{}, smt.Root(), []byte("short"), defaultValue, sha256.New(), WithOrderedKeys()) {
+		t.Error("proof verification returned true for short key")
+	}
+
+	end := append([]byte{}, key...)
+	key[0] = 1
+	if _, err := smt.ProveRange(key, end); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("expected ErrInvalidRange when proving reversed range, got: %v", err)
+	}
+
+	smt = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	if _, err := smt.ProveRange(end, key); !errors.Is(err, ErrRangeProofUnsupported) {
+		t.Errorf("expected ErrRangeProofUnsupported when proving range without ordered keys, got: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+// Package server serves the values and proofs of a SparseMerkleTree over
+// HTTP, as JSON. Keys and roots are passed as hex query parameters, and every
+// request may name the root to read at, which defaults to the current root of
+// the tree. The client package fetches and verifies the responses.
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/celestiaorg/smt"
+)
+
+// MaxMultiKeys is the most keys that can be proven in one request to
+// /prove-multi.
+const MaxMultiKeys = 1024
+
+// RootResponse is the response to /root.
+type RootResponse struct {
+	Root []byte `json:"root"`
+}
+
+// GetResponse is the response to /get.
+type GetResponse struct {
+	Root  []byte `json:"root"`
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// ProofResponse is the response to /prove, and an element of the response to
+// /prove-multi. The value is empty for a non-membership proof.
+type ProofResponse struct {
+	Root  []byte                `json:"root"`
+	Key   []byte                `json:"key"`
+	Value []byte                `json:"value"`
+	Proof smt.SparseMerkleProof `json:"proof"`
+}
+
+// CompactProofResponse is the response to /prove-compact.
+type CompactProofResponse struct {
+	Root  []byte                       `json:"root"`
+	Key   []byte                       `json:"key"`
+	Value []byte                       `json:"value"`
+	Proof smt.SparseCompactMerkleProof `json:"proof"`
+}
+
+// MultiProofResponse is the response to /prove-multi, with a proof for every
+// requested key, in the order of the request.
+type MultiProofResponse struct {
+	Root   []byte          `json:"root"`
+	Proofs []ProofResponse `json:"proofs"`
+}
+
+// ErrorResponse is the response to a request that failed.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+// Server is an http.Handler that serves a tree. Requests are served one at a
+// time, so the tree must only be updated through Update while it is served.
+type Server struct {
+	mu   sync.Mutex
+	tree *smt.SparseMerkleTree
+	mux  *http.ServeMux
+}
+
+// New creates a Server that serves a tree.
+func New(tree *smt.SparseMerkleTree) *Server {
+	s := &Server{
+		tree: tree,
+		mux:  http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/root", s.handleRoot)
+	s.mux.HandleFunc("/get", s.handleGet)
+	s.mux.HandleFunc("/prove", s.handleProve)
+	s.mux.HandleFunc("/prove-compact", s.handleProveCompact)
+	s.mux.HandleFunc("/prove-multi", s.handleProveMulti)
+	return s
+}
+
+// Update calls fn with the tree, while no request is being served.
+func (s *Server) Update(fn func(tree *smt.SparseMerkleTree) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fn(s.tree)
+}
+
+// ServeHTTP serves a request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	root := s.tree.Root()
+	s.mu.Unlock()
+	writeJSON(w, RootResponse{Root: root})
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	key, err := hexParam(r, "key")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root, err := s.root(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	value, err := s.tree.GetForRoot(key, root)
+	if err != nil {
+		writeTreeError(w, err)
+		return
+	}
+	writeJSON(w, GetResponse{Root: root, Key: key, Value: value})
+}
+
+func (s *Server) handleProve(w http.ResponseWriter, r *http.Request) {
+	key, err := hexParam(r, "key")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root, err := s.root(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	response, err := s.prove(key, root)
+	if err != nil {
+		writeTreeError(w, err)
+		return
+	}
+	writeJSON(w, response)
+}
+
+func (s *Server) handleProveCompact(w http.ResponseWriter, r *http.Request) {
+	key, err := hexParam(r, "key")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root, err := s.root(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	value, err := s.tree.GetForRoot(key, root)
+	if err != nil {
+		writeTreeError(w, err)
+		return
+	}
+	proof, err := s.tree.ProveCompactForRoot(key, root)
+	if err != nil {
+		writeTreeError(w, err)
+		return
+	}
+	writeJSON(w, CompactProofResponse{Root: root, Key: key, Value: value, Proof: proof})
+}
+
+func (s *Server) handleProveMulti(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()["key"]
+	if len(params) > MaxMultiKeys {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("more than %d keys", MaxMultiKeys))
+		return
+	}
+	keys := make([][]byte, len(params))
+	for i, param := range params {
+		key, err := hex.DecodeString(param)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid key: %v", err))
+			return
+		}
+		keys[i] = key
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	root, err := s.root(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	response := MultiProofResponse{Root: root, Proofs: make([]ProofResponse, len(keys))}
+	for i, key := range keys {
+		if response.Proofs[i], err = s.prove(key, root); err != nil {
+			writeTreeError(w, err)
+			return
+		}
+	}
+	writeJSON(w, response)
+}
+
+// root returns the root parameter of a request, or the current root of the
+// tree if there is none.
+func (s *Server) root(r *http.Request) ([]byte, error) {
+	if r.URL.Query().Get("root") == "" {
+		return s.tree.Root(), nil
+	}
+	return hexParam(r, "root")
+}
+
+func (s *Server) prove(key []byte, root []byte) (ProofResponse, error) {
+	value, err := s.tree.GetForRoot(key, root)
+	if err != nil {
+		return ProofResponse{}, err
+	}
+	proof, err := s.tree.ProveForRoot(key, root)
+	if err != nil {
+		return ProofResponse{}, err
+	}
+	return ProofResponse{Root: root, Key: key, Value: value, Proof: proof}, nil
+}
+
+func hexParam(r *http.Request, name string) ([]byte, error) {
+	b, err := hex.DecodeString(r.URL.Query().Get(name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return b, nil
+}
+
+// writeTreeError writes an error of the tree: missing nodes or values mean
+// that the tree does not have the requested root.
+func writeTreeError(w http.ResponseWriter, err error) {
+	var invalidKeyError *smt.InvalidKeyError
+	switch {
+	case errors.As(err, &invalidKeyError), errors.Is(err, smt.ErrValueNotFound):
+		writeError(w, http.StatusNotFound, errors.New("root not found"))
+	case errors.Is(err, smt.ErrInvalidKeySize):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
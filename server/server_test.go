@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/celestiaorg/smt"
+)
+
+func get(t *testing.T, ts *httptest.Server, path string, response interface{}) int {
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("returned error when getting %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Errorf("returned error when decoding response to %s: %v", path, err)
+	}
+	return resp.StatusCode
+}
+
+func TestServer(t *testing.T) {
+	tree := smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New(), smt.WithHistory())
+	tree.Update([]byte("testKey"), []byte("testValue"))
+	oldRoot := tree.Root()
+	s := New(tree)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	s.Update(func(tree *smt.SparseMerkleTree) error {
+		_, err := tree.Update([]byte("testKey"), []byte("testValue2"))
+		return err
+	})
+
+	var rootResponse RootResponse
+	get(t, ts, "/root", &rootResponse)
+	if !bytes.Equal(tree.Root(), rootResponse.Root) {
+		t.Error("did not get root of tree")
+	}
+
+	key := hex.EncodeToString([]byte("testKey"))
+	var getResponse GetResponse
+	get(t, ts, "/get?key="+key, &getResponse)
+	if !bytes.Equal([]byte("testValue2"), getResponse.Value) {
+		t.Error("did not get value of key at current root")
+	}
+	get(t, ts, "/get?key="+key+"&root="+hex.EncodeToString(oldRoot), &getResponse)
+	if !bytes.Equal([]byte("testValue"), getResponse.Value) {
+		t.Error("did not get value of key at old root")
+	}
+
+	var proofResponse ProofResponse
+	get(t, ts, "/prove?key="+key+"&root="+hex.EncodeToString(oldRoot), &proofResponse)
+	if !smt.VerifyProof(proofResponse.Proof, oldRoot, []byte("testKey"), proofResponse.Value, sha256.New()) {
+		t.Error("proof failed to verify")
+	}
+	var compactResponse CompactProofResponse
+	get(t, ts, "/prove-compact?key="+key, &compactResponse)
+	if !smt.VerifyCompactProof(compactResponse.Proof, tree.Root(), []byte("testKey"), compactResponse.Value, sha256.New()) {
+		t.Error("compact proof failed to verify")
+	}
+	var multiResponse MultiProofResponse
+	get(t, ts, "/prove-multi?key="+key+"&key=", &multiResponse)
+	if len(multiResponse.Proofs) != 2 || !bytes.Equal([]byte("testValue2"), multiResponse.Proofs[0].Value) ||
+		len(multiResponse.Proofs[1].Value) != 0 {
+		t.Error("did not get proofs of keys in order")
+	}
+	for _, proof := range multiResponse.Proofs {
+		if !smt.VerifyProof(proof.Proof, tree.Root(), proof.Key, proof.Value, sha256.New()) {
+			t.Error("proof of multiple keys failed to verify")
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	tree := smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New())
+	tree.Update([]byte("testKey"), []byte("testValue"))
+	ts := httptest.NewServer(New(tree))
+	defer ts.Close()
+
+	unknownRoot := "/prove?key=00&root=" + strings.Repeat("1", 64)
+	tooManyKeys := "/prove-multi?" + strings.Repeat("key=00&", MaxMultiKeys+1)
+	for path, expected := range map[string]int{
+		"/get?key=zz":           http.StatusBadRequest,
+		"/prove?key=00&root=zz": http.StatusBadRequest,
+		unknownRoot:             http.StatusNotFound,
+		tooManyKeys:             http.StatusBadRequest,
+	} {
+		var response ErrorResponse
+		if status := get(t, ts, path, &response); status != expected || response.Error == "" {
+			t.Errorf("expected status %d with error when getting %.40s, got %d", expected, path, status)
+		}
+	}
+
+	resp, err := http.Post(ts.URL+"/root", "application/json", nil)
+	if err != nil {
+		t.Fatalf("returned error when posting: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d when posting, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
@@ -15,11 +15,56 @@ var defaultValue = []byte{}
 
 var errKeyAlreadyEmpty = errors.New("key already empty")
 
+var errStopIteration = errors.New("stop iteration")
+
+// ErrValueNotFound is returned when reading a key at a root whose value for
+// that key is no longer stored.
+var ErrValueNotFound = errors.New("value not found")
+
+// ErrPathCollision is returned when updating a key whose path in the tree is
+// already taken by a different key. This can only happen if the depth of the
+// tree is shorter than the hasher output.
+var ErrPathCollision = errors.New("path collision")
+
+// ErrInvalidKeySize is returned when a key of a tree with ordered keys is not
+// the size of a path, or when a key of a tree with namespaces is shorter than
+// a namespace.
+var ErrInvalidKeySize = errors.New("invalid key size")
+
 // SparseMerkleTree is a Sparse Merkle tree.
 type SparseMerkleTree struct {
 	th            treeHasher
 	nodes, values MapStore
 	root          []byte
+
+	// readOnly is set for snapshots, which cannot be written to.
+	readOnly bool
+	// snapshots tracks the snapshots taken of the tree, if any.
+	snapshots *snapshotRegistry
+	// snapshot is set if the tree is a snapshot.
+	snapshot *snapshot
+
+	// keepHistory is set if orphaned nodes are kept, and values are also
+	// stored by value hash, so that the tree can be read at older roots.
+	keepHistory bool
+
+	// contentAddressed is set if values are stored by value hash, with a
+	// reference count, instead of by path.
+	contentAddressed bool
+
+	// meta is the store of the metadata record of the tree, if it was
+	// opened with OpenSparseMerkleTree.
+	meta MapStore
+	// version is the number of times the tree was committed.
+	version uint64
+	// orphans are the nodes orphaned since the last commit of a versioned
+	// tree, by the paths they were on. They are only deleted once no retained
+	// version uses them.
+	orphans map[string][]byte
+
+	// journal is the store of the journal of the writes of operations, if
+	// the tree was created with WithJournal.
+	journal MapStore
 }
 
 // NewSparseMerkleTree creates a new Sparse Merkle tree on an empty MapStore.
@@ -40,13 +85,18 @@ func NewSparseMerkleTree(nodes, values MapStore, hasher hash.Hash, options ...Op
 }
 
 // ImportSparseMerkleTree imports a Sparse Merkle tree from a non-empty MapStore.
-func ImportSparseMerkleTree(nodes, values MapStore, hasher hash.Hash, root []byte) *SparseMerkleTree {
+func ImportSparseMerkleTree(nodes, values MapStore, hasher hash.Hash, root []byte, options ...Option) *SparseMerkleTree {
 	smt := SparseMerkleTree{
 		th:     *newTreeHasher(hasher),
 		nodes:  nodes,
 		values: values,
 		root:   root,
 	}
+
+	for _, option := range options {
+		option(&smt)
+	}
+
 	return &smt
 }
 
@@ -61,11 +111,27 @@ func (smt *SparseMerkleTree) SetRoot(root []byte) {
 }
 
 func (smt *SparseMerkleTree) depth() int {
-	return smt.th.pathSize() * 8
+	return smt.th.depth()
+}
+
+// checkKey returns ErrInvalidKeySize if a key cannot be used as a path in a
+// tree with ordered keys, or has no namespace in a tree with namespaces.
+func (smt *SparseMerkleTree) checkKey(key []byte) error {
+	if smt.th.orderedKeys && len(key) != smt.th.pathSize() {
+		return ErrInvalidKeySize
+	}
+	if len(key) < smt.th.namespaceSize {
+		return ErrInvalidKeySize
+	}
+	return nil
 }
 
 // Get gets the value of a key from the tree.
 func (smt *SparseMerkleTree) Get(key []byte) ([]byte, error) {
+	if err := smt.checkKey(key); err != nil {
+		return nil, err
+	}
+
 	// Get tree's root
 	root := smt.Root()
 
@@ -74,6 +140,12 @@ func (smt *SparseMerkleTree) Get(key []byte) ([]byte, error) {
 		return defaultValue, nil
 	}
 
+	if smt.contentAddressed || smt.meta != nil {
+		// Values are stored by the value hash of their leaf, or the root
+		// may be that of an older version.
+		return smt.GetForRoot(key, root)
+	}
+
 	path := smt.th.path(key)
 	value, err := smt.values.Get(path)
 
@@ -98,6 +170,120 @@ func (smt *SparseMerkleTree) Has(key []byte) (bool, error) {
 	return !bytes.Equal(defaultValue, val), err
 }
 
+// GetForRoot gets the value of a key from the tree at a specific root. The
+// value is found by descending the tree from the root, so older roots can only
+// be read if their nodes and values were kept with WithHistory.
+func (smt *SparseMerkleTree) GetForRoot(key []byte, root []byte) ([]byte, error) {
+	if err := smt.checkKey(key); err != nil {
+		return nil, err
+	}
+
+	path := smt.th.path(key)
+	valueHash, err := smt.valueHashForRoot(path, root)
+	if err != nil {
+		return nil, err
+	}
+	if valueHash == nil {
+		return defaultValue, nil
+	}
+	return smt.valueForHash(path, valueHash)
+}
+
+// HasForRoot returns true if the value at the given key is non-default at a
+// specific root, false otherwise.
+func (smt *SparseMerkleTree) HasForRoot(key []byte, root []byte) (bool, error) {
+	if err := smt.checkKey(key); err != nil {
+		return false, err
+	}
+
+	valueHash, err := smt.valueHashForRoot(smt.th.path(key), root)
+	return valueHash != nil, err
+}
+
+// valueHashForRoot descends the tree from a root to the leaf of a path, and
+// returns the data committed to by the leaf, or nil if there is no leaf for
+// the path.
+func (smt *SparseMerkleTree) valueHashForRoot(path []byte, root []byte) ([]byte, error) {
+	_, _, leafData, _, err := smt.sideNodesForRoot(path, root, false)
+	if err != nil {
+		return nil, err
+	}
+	if leafData == nil || !smt.th.isLeaf(leafData) {
+		return nil, nil
+	}
+	actualPath, valueHash := smt.th.parseLeaf(leafData)
+	if !bytes.Equal(actualPath, path) {
+		return nil, nil
+	}
+	return valueHash, nil
+}
+
+// valueForHash gets the value of a path whose leaf commits to a value hash.
+// This is the current value of the path, unless it has since changed and the
+// older value was kept with WithHistory. Content-addressed values are found by
+// the value hash alone.
+func (smt *SparseMerkleTree) valueForHash(path []byte, valueHash []byte) ([]byte, error) {
+	if smt.contentAddressed {
+		return smt.contentValue(valueHash)
+	}
+
+	var invalidKeyError *InvalidKeyError
+
+	value, err := smt.values.Get(path)
+	if err == nil {
+		if storedValueHash, ok := smt.th.storedValueHash(value); ok && bytes.Equal(storedValueHash, valueHash) {
+			return value, nil
+		}
+	}
+	if err != nil && !errors.As(err, &invalidKeyError) {
+		return nil, err
+	}
+
+	value, err = smt.values.Get(historyKey(path, valueHash))
+	if err != nil {
+		if errors.As(err, &invalidKeyError) {
+			return nil, ErrValueNotFound
+		}
+		return nil, err
+	}
+	return value, nil
+}
+
+// deleteNode deletes an orphaned node on a path from the node store, unless
+// the tree keeps its history. The orphans of versioned trees are deleted when
+// the tree is committed, or when the versions that use them are deleted.
+func (smt *SparseMerkleTree) deleteNode(node []byte, path []byte) error {
+	if smt.keepHistory {
+		return nil
+	}
+	if smt.orphans != nil {
+		smt.orphans[string(node)] = path
+		return nil
+	}
+	return smt.nodes.Delete(node)
+}
+
+// Iterate calls fn with the path and value of every leaf of the tree, in
+// increasing order of path, until fn returns false.
+func (smt *SparseMerkleTree) Iterate(fn func(path []byte, value []byte) bool) error {
+	start := make([]byte, smt.th.pathSize())
+	end := bytes.Repeat([]byte{0xff}, smt.th.pathSize())
+	err := smt.rangeLeaves(smt.Root(), 0, make([]byte, smt.th.pathSize()), start, end, func(path []byte, valueHash []byte) error {
+		value, err := smt.leafValue(path, valueHash)
+		if err != nil {
+			return err
+		}
+		if !fn(path, value) {
+			return errStopIteration
+		}
+		return nil
+	})
+	if errors.Is(err, errStopIteration) {
+		return nil
+	}
+	return err
+}
+
 // Update sets a new value for a key in the tree, and sets and returns the new root of the tree.
 func (smt *SparseMerkleTree) Update(key []byte, value []byte) ([]byte, error) {
 	newRoot, err := smt.UpdateForRoot(key, value, smt.Root())
@@ -115,7 +301,27 @@ func (smt *SparseMerkleTree) Delete(key []byte) ([]byte, error) {
 
 // UpdateForRoot sets a new value for a key in the tree at a specific root, and returns the new root.
 func (smt *SparseMerkleTree) UpdateForRoot(key []byte, value []byte, root []byte) ([]byte, error) {
-	path := smt.th.path(key)
+	if err := smt.checkKey(key); err != nil {
+		return nil, err
+	}
+	return smt.updateForRoot(smt.th.path(key), value, smt.th.valueHash(value), root)
+}
+
+// updateForRoot sets a new value for a path in the tree at a specific root,
+// where leafData is the data committed to by the leaf for that value.
+func (smt *SparseMerkleTree) updateForRoot(path []byte, value []byte, leafData []byte, root []byte) ([]byte, error) {
+	if smt.readOnly {
+		return nil, ErrReadOnly
+	}
+	if smt.journal != nil {
+		return smt.journaled(func() ([]byte, error) {
+			return smt.doUpdateForRoot(path, value, leafData, root)
+		})
+	}
+	return smt.doUpdateForRoot(path, value, leafData, root)
+}
+
+func (smt *SparseMerkleTree) doUpdateForRoot(path []byte, value []byte, leafData []byte, root []byte) ([]byte, error) {
 	sideNodes, pathNodes, oldLeafData, _, err := smt.sideNodesForRoot(path, root, false)
 	if err != nil {
 		return nil, err
@@ -129,13 +335,17 @@ func (smt *SparseMerkleTree) UpdateForRoot(key []byte, value []byte, root []byte
 			// This key is already empty; return the old root.
 			return root, nil
 		}
-		if err := smt.values.Delete(path); err != nil {
+		if err != nil {
+			return nil, err
+		}
+		_, oldValueHash := smt.th.parseLeaf(oldLeafData)
+		if err := smt.removeValue(path, oldValueHash); err != nil {
 			return nil, err
 		}
 
 	} else {
 		// Insert or update operation.
-		newRoot, err = smt.updateWithSideNodes(path, value, sideNodes, pathNodes, oldLeafData)
+		newRoot, err = smt.updateWithSideNodes(path, value, leafData, sideNodes, pathNodes, oldLeafData)
 	}
 	return newRoot, err
 }
@@ -150,6 +360,10 @@ func (smt *SparseMerkleTree) deleteWithSideNodes(path []byte, sideNodes [][]byte
 		// This key is already empty as it is a placeholder; return an error.
 		return nil, errKeyAlreadyEmpty
 	}
+	if smt.th.isExtension(oldLeafData) {
+		// This key is already empty as its path leaves an extension node; return an error.
+		return nil, errKeyAlreadyEmpty
+	}
 	actualPath, _ := smt.th.parseLeaf(oldLeafData)
 	if !bytes.Equal(path, actualPath) {
 		// This key is already empty as a different key was found its place; return an error.
@@ -157,14 +371,24 @@ func (smt *SparseMerkleTree) deleteWithSideNodes(path []byte, sideNodes [][]byte
 	}
 	// All nodes above the deleted leaf are now orphaned
 	for _, node := range pathNodes {
-		if err := smt.nodes.Delete(node); err != nil {
+		if node == nil {
+			// This node was collapsed into an extension node.
+			continue
+		}
+		if err := smt.deleteNode(node, path); err != nil {
 			return nil, err
 		}
 	}
 
 	var currentHash, currentData []byte
 	nonPlaceholderReached := false
+	// The chain of inner nodes with placeholder siblings above the current
+	// node, from extensionStart to extensionEnd, if they are collapsed into an
+	// extension node.
+	var extensionStart, extensionEnd int
+	var extensionPath, siblingData []byte
 	for i, sideNode := range sideNodes {
+		height := len(sideNodes) - 1 - i
 		if currentData == nil {
 			sideNodeValue, err := smt.nodes.Get(sideNode)
 			if err != nil {
@@ -176,6 +400,18 @@ func (smt *SparseMerkleTree) deleteWithSideNodes(path []byte, sideNodes [][]byte
 				currentHash = sideNode
 				currentData = sideNode
 				continue
+			} else if smt.th.extensions {
+				// This is the node sibling that needs to be left in its place,
+				// below a node that now only has a placeholder sibling.
+				currentHash = sideNode
+				currentData = sideNode
+				siblingData = sideNodeValue
+				extensionPath = make([]byte, len(path))
+				copy(extensionPath, path)
+				flipBitAtFromMSB(extensionPath, height)
+				extensionStart, extensionEnd = height, height+1
+				nonPlaceholderReached = true
+				continue
 			} else {
 				// This is the node sibling that needs to be left in its place.
 				currentData = smt.th.placeholder()
@@ -193,6 +429,24 @@ func (smt *SparseMerkleTree) deleteWithSideNodes(path []byte, sideNodes [][]byte
 			nonPlaceholderReached = true
 		}
 
+		if smt.th.extensions {
+			if bytes.Equal(sideNode, smt.th.placeholder()) {
+				if extensionEnd == 0 {
+					extensionPath, extensionEnd = path, height+1
+				}
+				extensionStart = height
+				continue
+			}
+			if extensionEnd != 0 {
+				var err error
+				currentData, err = smt.setExtension(extensionPath, extensionStart, extensionEnd, currentData, siblingData)
+				if err != nil {
+					return nil, err
+				}
+				extensionEnd, siblingData = 0, nil
+			}
+		}
+
 		if getBitAtFromMSB(path, len(sideNodes)-1-i) == right {
 			currentHash, currentData = smt.th.digestNode(sideNode, currentData)
 		} else {
@@ -204,6 +458,14 @@ func (smt *SparseMerkleTree) deleteWithSideNodes(path []byte, sideNodes [][]byte
 		currentData = currentHash
 	}
 
+	if extensionEnd != 0 {
+		var err error
+		currentHash, err = smt.setExtension(extensionPath, extensionStart, extensionEnd, currentData, siblingData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if currentHash == nil {
 		// The tree is empty; return placeholder value as root.
 		currentHash = smt.th.placeholder()
@@ -211,14 +473,34 @@ func (smt *SparseMerkleTree) deleteWithSideNodes(path []byte, sideNodes [][]byte
 	return currentHash, nil
 }
 
-func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, sideNodes [][]byte, pathNodes [][]byte, oldLeafData []byte) ([]byte, error) {
-	valueHash := smt.th.digest(value)
-	currentHash, currentData := smt.th.digestLeaf(path, valueHash)
-	if err := smt.nodes.Set(currentHash, currentData); err != nil {
+// setExtension sets an extension node for the chain of inner nodes from depth
+// start to end along path, above child, and returns its hash. If childData is
+// the data of an extension node starting at end, the two are merged.
+func (smt *SparseMerkleTree) setExtension(path []byte, start int, end int, child []byte, childData []byte) ([]byte, error) {
+	if childData != nil && smt.th.isExtension(childData) {
+		childStart, childEnd, childPath, grandchild := smt.th.parseExtension(childData)
+		if childStart == end {
+			if err := smt.deleteNode(child, path); err != nil {
+				return nil, err
+			}
+			mergedPath := extensionBits(path, start, end, smt.th.pathSize())
+			for i := childStart; i < childEnd; i++ {
+				if getBitAtFromMSB(childPath, i) == 1 {
+					setBitAtFromMSB(mergedPath, i)
+				}
+			}
+			path, end, child = mergedPath, childEnd, grandchild
+		}
+	}
+
+	hash, data := smt.th.digestExtension(start, end, path, child)
+	if err := smt.nodes.Set(hash, data); err != nil {
 		return nil, err
 	}
-	currentData = currentHash
+	return hash, nil
+}
 
+func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, valueHash []byte, sideNodes [][]byte, pathNodes [][]byte, oldLeafData []byte) ([]byte, error) {
 	// If the leaf node that sibling nodes lead to has a different actual path
 	// than the leaf node being updated, we need to create an intermediate node
 	// with this leaf node and the new leaf node as children.
@@ -229,11 +511,55 @@ func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, side
 	var oldValueHash []byte
 	if bytes.Equal(pathNodes[0], smt.th.placeholder()) {
 		commonPrefixCount = smt.depth()
+	} else if smt.th.isExtension(oldLeafData) {
+		// The path leaves an extension node. Split it where the path leaves
+		// it: the part below becomes the sibling of the new leaf, and the
+		// part above is rebuilt from placeholder siblings below.
+		start, end, extensionPath, child := smt.th.parseExtension(oldLeafData)
+		commonPrefixCount = start + countCommonBits(path, extensionPath, start, end)
+		sibling := child
+		if commonPrefixCount+1 < end {
+			var siblingData []byte
+			sibling, siblingData = smt.th.digestExtension(commonPrefixCount+1, end, extensionPath, child)
+			if err := smt.nodes.Set(sibling, siblingData); err != nil {
+				return nil, err
+			}
+		}
+		if err := smt.deleteNode(pathNodes[0], path); err != nil {
+			return nil, err
+		}
+		pathNodes[0] = sibling
 	} else {
 		var actualPath []byte
 		actualPath, oldValueHash = smt.th.parseLeaf(oldLeafData)
 		commonPrefixCount = countCommonPrefix(path, actualPath)
+		if commonPrefixCount >= smt.depth() {
+			if !bytes.Equal(path, actualPath) {
+				// A different key already takes this path.
+				return nil, ErrPathCollision
+			}
+			commonPrefixCount = smt.depth()
+		}
 	}
+
+	currentHash, currentData := smt.th.digestLeaf(path, valueHash)
+	// The leaves of versioned trees hold one reference each to their
+	// content-addressed values, and a leaf that was orphaned may be set again
+	// before it is pruned.
+	storeValue := true
+	if smt.contentAddressed && smt.orphans != nil {
+		_, err := smt.nodes.Get(currentHash)
+		var invalidKeyError *InvalidKeyError
+		if err != nil && !errors.As(err, &invalidKeyError) {
+			return nil, err
+		}
+		storeValue = err != nil
+	}
+	if err := smt.nodes.Set(currentHash, currentData); err != nil {
+		return nil, err
+	}
+	currentData = currentHash
+
 	if commonPrefixCount != smt.depth() {
 		if getBitAtFromMSB(path, commonPrefixCount) == right {
 			currentHash, currentData = smt.th.digestNode(pathNodes[0], currentData)
@@ -253,16 +579,20 @@ func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, side
 			return smt.root, nil
 		}
 		// If an old leaf exists, remove it
-		if err := smt.nodes.Delete(pathNodes[0]); err != nil {
+		if err := smt.deleteNode(pathNodes[0], path); err != nil {
 			return nil, err
 		}
-		if err := smt.values.Delete(path); err != nil {
+		if err := smt.removeValue(path, oldValueHash); err != nil {
 			return nil, err
 		}
 	}
 	// All remaining path nodes are orphaned
 	for i := 1; i < len(pathNodes); i++ {
-		if err := smt.nodes.Delete(pathNodes[i]); err != nil {
+		if pathNodes[i] == nil {
+			// This node was collapsed into an extension node.
+			continue
+		}
+		if err := smt.deleteNode(pathNodes[i], path); err != nil {
 			return nil, err
 		}
 	}
@@ -271,6 +601,10 @@ func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, side
 	// Note: i-offsetOfSideNodes is the index into sideNodes[]
 	offsetOfSideNodes := smt.depth() - len(sideNodes)
 
+	// The number of placeholder siblings above the current node, if they
+	// are collapsed into an extension node.
+	extensionLength := 0
+
 	for i := 0; i < smt.depth(); i++ {
 		var sideNode []byte
 
@@ -288,6 +622,19 @@ func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, side
 			sideNode = sideNodes[i-offsetOfSideNodes]
 		}
 
+		if smt.th.extensions && bytes.Equal(sideNode, smt.th.placeholder()) {
+			extensionLength++
+			continue
+		}
+		if extensionLength > 0 {
+			var err error
+			currentData, err = smt.setExtension(path, smt.depth()-i, smt.depth()-i+extensionLength, currentData, nil)
+			if err != nil {
+				return nil, err
+			}
+			extensionLength = 0
+		}
+
 		if getBitAtFromMSB(path, smt.depth()-1-i) == right {
 			currentHash, currentData = smt.th.digestNode(sideNode, currentData)
 		} else {
@@ -299,8 +646,17 @@ func (smt *SparseMerkleTree) updateWithSideNodes(path []byte, value []byte, side
 		}
 		currentData = currentHash
 	}
-	if err := smt.values.Set(path, value); err != nil {
-		return nil, err
+	if extensionLength > 0 {
+		var err error
+		currentHash, err = smt.setExtension(path, 0, extensionLength, currentData, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if storeValue {
+		if err := smt.storeValue(path, value, valueHash); err != nil {
+			return nil, err
+		}
 	}
 
 	return currentHash, nil
@@ -336,6 +692,30 @@ func (smt *SparseMerkleTree) sideNodesForRoot(path []byte, root []byte, getSibli
 	var sideNode []byte
 	var siblingData []byte
 	for i := 0; i < smt.depth(); i++ {
+		if smt.th.isExtension(currentData) {
+			start, end, extensionPath, child := smt.th.parseExtension(currentData)
+			if start+countCommonBits(path, extensionPath, start, end) != end {
+				// If the path leaves the extension node, we've reached the end.
+				break
+			}
+			// Expand the extension node into the chain of inner nodes it
+			// stands for, which only have placeholder siblings.
+			for j := start; j < end-1; j++ {
+				sideNodes = append(sideNodes, smt.th.placeholder())
+				pathNodes = append(pathNodes, nil)
+			}
+			sideNodes = append(sideNodes, smt.th.placeholder())
+			pathNodes = append(pathNodes, child)
+
+			i = end
+			currentData, err = smt.nodes.Get(child)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			} else if smt.th.isLeaf(currentData) {
+				break
+			}
+		}
+
 		leftNode, rightNode := smt.th.parseNode(currentData)
 
 		// Get sidenode depending on whether the path bit is on or off.
@@ -364,7 +744,7 @@ func (smt *SparseMerkleTree) sideNodesForRoot(path []byte, root []byte, getSibli
 		}
 	}
 
-	if getSiblingData {
+	if getSiblingData && sideNode != nil {
 		siblingData, err = smt.nodes.Get(sideNode)
 		if err != nil {
 			return nil, nil, nil, nil, err
@@ -406,7 +786,14 @@ func (smt *SparseMerkleTree) ProveUpdatableForRoot(key []byte, root []byte) (Spa
 }
 
 func (smt *SparseMerkleTree) doProveForRoot(key []byte, root []byte, isUpdatable bool) (SparseMerkleProof, error) {
-	path := smt.th.path(key)
+	if err := smt.checkKey(key); err != nil {
+		return SparseMerkleProof{}, err
+	}
+	return smt.proveForPath(smt.th.path(key), root, isUpdatable)
+}
+
+// proveForPath generates a Merkle proof for a path, against a specific node.
+func (smt *SparseMerkleTree) proveForPath(path []byte, root []byte, isUpdatable bool) (SparseMerkleProof, error) {
 	sideNodes, pathNodes, leafData, siblingData, err := smt.sideNodesForRoot(path, root, isUpdatable)
 	if err != nil {
 		return SparseMerkleProof{}, err
@@ -422,7 +809,11 @@ func (smt *SparseMerkleTree) doProveForRoot(key []byte, root []byte, isUpdatable
 	// Deal with non-membership proofs. If the leaf hash is the placeholder
 	// value, we do not need to add anything else to the proof.
 	var nonMembershipLeafData []byte
-	if !bytes.Equal(pathNodes[0], smt.th.placeholder()) {
+	if smt.th.isExtension(leafData) {
+		// This is a non-membership proof that involves showing an extension
+		// node that the path leaves. Add the extension node data to the proof.
+		nonMembershipLeafData = leafData
+	} else if !bytes.Equal(pathNodes[0], smt.th.placeholder()) {
 		actualPath, _ := smt.th.parseLeaf(leafData)
 		if !bytes.Equal(actualPath, path) {
 			// This is a non-membership proof that involves showing a different leaf.
@@ -452,6 +843,6 @@ func (smt *SparseMerkleTree) ProveCompactForRoot(key []byte, root []byte) (Spars
 	if err != nil {
 		return SparseCompactMerkleProof{}, err
 	}
-	compactedProof, err := CompactProof(proof, smt.th.hasher)
+	compactedProof, err := compactProof(proof, &smt.th)
 	return compactedProof, err
 }
@@ -3,6 +3,7 @@ package smt
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"hash"
 	"math/rand"
 	"testing"
@@ -614,3 +615,337 @@ func TestOrphanRemoval(t *testing.T) {
 		}
 	})
 }
+
+// Test tree operations on a tree shorter than the hasher output.
+func TestSparseMerkleTreeDepth(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, sha256.New(), WithDepth(64))
+	kv := make(map[string]string)
+
+	for i := 0; i < 100; i++ {
+		key := make([]byte, 16)
+		rand.Read(key)
+		kv[string(key)] = string(key)
+		_, err := smt.Update(key, key)
+		if err != nil {
+			t.Errorf("returned error when updating empty key: %v", err)
+		}
+	}
+	for k, v := range kv {
+		value, err := smt.Get([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when getting non-empty key: %v", err)
+		}
+		if !bytes.Equal([]byte(v), value) {
+			t.Error("did not get correct value when getting non-empty key")
+		}
+		value, err = smt.GetDescend([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when descending to non-empty key: %v", err)
+		}
+		if !bytes.Equal([]byte(v), value) {
+			t.Error("did not get correct value when descending to non-empty key")
+		}
+		proof, err := smt.Prove([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when proving key: %v", err)
+		}
+		if !VerifyProof(proof, smt.Root(), []byte(k), []byte(v), smt.th.hasher, WithDepth(64)) {
+			t.Error("valid proof failed to verify")
+		}
+		compactProof, err := smt.ProveCompact([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when proving key: %v", err)
+		}
+		if !VerifyCompactProof(compactProof, smt.Root(), []byte(k), []byte(v), smt.th.hasher, WithDepth(64)) {
+			t.Error("valid compact proof failed to verify")
+		}
+	}
+	for k := range kv {
+		_, err := smt.Delete([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when deleting key: %v", err)
+		}
+	}
+	if !bytes.Equal(smt.Root(), smt.th.placeholder()) {
+		t.Error("tree is not empty after deleting all keys")
+	}
+	if len(smn.m) != 0 || len(smv.m) != 0 {
+		t.Error("stores are not empty after deleting all keys")
+	}
+}
+
+// Test keys whose paths collide in a tree shorter than the hasher output.
+func TestSparseMerkleTreeDepthCollision(t *testing.T) {
+	h := newDummyHasher(sha256.New())
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, h, WithDepth(64))
+
+	// Make two keys whose paths share more than 64 bits, and a third that
+	// shares exactly 63 bits with the first.
+	key1 := make([]byte, h.Size()+4)
+	rand.Read(key1)
+	key1[0], key1[1], key1[2], key1[3] = byte(0), byte(0), byte(0), byte(0)
+	key1[11] &^= 1
+	key2 := make([]byte, h.Size()+4)
+	copy(key2, key1)
+	key2[h.Size()+4-1] ^= 1
+	key3 := make([]byte, h.Size()+4)
+	copy(key3, key1)
+	key3[11] |= 1
+
+	_, err := smt.Update(key1, []byte("testValue1"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	root := smt.Root()
+	nodeCount := len(smn.m)
+	_, err = smt.Update(key2, []byte("testValue2"))
+	if !errors.Is(err, ErrPathCollision) {
+		t.Errorf("expected ErrPathCollision when updating colliding key, got: %v", err)
+	}
+	if !bytes.Equal(root, smt.Root()) || nodeCount != len(smn.m) {
+		t.Error("tree changed after colliding update")
+	}
+
+	value, err := smt.Get(key2)
+	if err != nil {
+		t.Errorf("returned error when getting colliding key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) {
+		t.Error("did not get default value when getting colliding key")
+	}
+	value, err = smt.GetDescend(key2)
+	if err != nil {
+		t.Errorf("returned error when descending to colliding key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) {
+		t.Error("did not get default value when descending to colliding key")
+	}
+	_, err = smt.Delete(key2)
+	if err != nil {
+		t.Errorf("returned error when deleting colliding key: %v", err)
+	}
+	if !bytes.Equal(root, smt.Root()) {
+		t.Error("tree changed after deleting colliding key")
+	}
+	proof, err := smt.Prove(key2)
+	if err != nil {
+		t.Errorf("returned error when proving colliding key: %v", err)
+	}
+	if !VerifyProof(proof, smt.Root(), key2, defaultValue, h, WithDepth(64)) {
+		t.Error("valid non-membership proof of colliding key failed to verify")
+	}
+
+	// Neighbouring keys at the maximum depth.
+	_, err = smt.Update(key3, []byte("testValue3"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	proof, err = smt.Prove(key1)
+	if err != nil {
+		t.Errorf("returned error when proving key: %v", err)
+	}
+	if len(proof.SideNodes) != 64 {
+		t.Errorf("expected 64 side nodes, got %d", len(proof.SideNodes))
+	}
+	if !VerifyProof(proof, smt.Root(), key1, []byte("testValue1"), h, WithDepth(64)) {
+		t.Error("valid proof failed to verify")
+	}
+	if VerifyProof(proof, smt.Root(), key1, []byte("testValue1"), h, WithDepth(63)) {
+		t.Error("proof longer than the depth of the tree returned true")
+	}
+	value, err = smt.GetDescend(key3)
+	if err != nil {
+		t.Errorf("returned error when descending to non-empty key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue3"), value) {
+		t.Error("did not get correct value when descending to non-empty key")
+	}
+}
+
+// Test that extension nodes collapse the chain of inner nodes above two
+// neighboring leafs, and that splitting and merging them keeps proofs valid.
+func TestSparseMerkleTreeExtensionNodesMaxHeightCase(t *testing.T) {
+	h := newDummyHasher(sha256.New())
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, h, WithExtensionNodes())
+
+	key1 := make([]byte, h.Size()+4)
+	rand.Read(key1)
+	key1[0], key1[1], key1[2], key1[3] = byte(0), byte(0), byte(0), byte(0)
+	key1[h.Size()+4-1] = byte(0)
+	key2 := make([]byte, h.Size()+4)
+	copy(key2, key1)
+	key2[h.Size()+4-1] = byte(1)
+	// key3 leaves the chain of key1 and key2 half way down.
+	key3 := make([]byte, h.Size()+4)
+	copy(key3, key1)
+	key3[20] ^= byte(0x10)
+
+	_, err := smt.Update(key1, []byte("testValue1"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	_, err = smt.Update(key2, []byte("testValue2"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	root := smt.Root()
+	// An extension node, the node above both leafs, and the two leafs.
+	if len(smn.m) != 4 {
+		t.Errorf("expected 4 nodes, got %d", len(smn.m))
+	}
+
+	proof, err := smt.Prove(key1)
+	if err != nil {
+		t.Errorf("returned error when proving key: %v", err)
+	}
+	if len(proof.SideNodes) != 256 {
+		t.Errorf("unexpected proof size")
+	}
+	if !VerifyProof(proof, root, key1, []byte("testValue1"), h, WithExtensionNodes()) {
+		t.Error("valid proof failed to verify")
+	}
+	if VerifyProof(proof, root, key1, []byte("testValue1"), h) {
+		t.Error("proof verified without extension nodes")
+	}
+	compactProof, err := smt.ProveCompact(key1)
+	if err != nil {
+		t.Errorf("returned error when proving key: %v", err)
+	}
+	if !VerifyCompactProof(compactProof, root, key1, []byte("testValue1"), h, WithExtensionNodes()) {
+		t.Error("valid compact proof failed to verify")
+	}
+
+	// Prove that key3 is empty by showing the extension node that it leaves.
+	proof, err = smt.Prove(key3)
+	if err != nil {
+		t.Errorf("returned error when proving key: %v", err)
+	}
+	if len(proof.SideNodes) != 0 || !smt.th.isExtension(proof.NonMembershipLeafData) {
+		t.Error("expected non-membership proof of an extension node")
+	}
+	if !VerifyProof(proof, root, key3, defaultValue, h, WithExtensionNodes()) {
+		t.Error("valid non-membership proof failed to verify")
+	}
+	if VerifyProof(proof, root, key1, defaultValue, h, WithExtensionNodes()) {
+		t.Error("non-membership proof of an extension node on its own path returned true")
+	}
+	value, err := smt.GetDescend(key3)
+	if err != nil {
+		t.Errorf("returned error when descending to empty key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) {
+		t.Error("did not get default value when descending to empty key")
+	}
+
+	// Split the extension node, then merge it back.
+	_, err = smt.Update(key3, []byte("testValue3"))
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	for i, key := range [][]byte{key1, key2, key3} {
+		expected := []byte("testValue" + string(rune('1'+i)))
+		value, err = smt.GetDescend(key)
+		if err != nil {
+			t.Errorf("returned error when descending to non-empty key: %v", err)
+		}
+		if !bytes.Equal(expected, value) {
+			t.Error("did not get correct value when descending to non-empty key")
+		}
+		proof, err = smt.Prove(key)
+		if err != nil {
+			t.Errorf("returned error when proving key: %v", err)
+		}
+		if !VerifyProof(proof, smt.Root(), key, expected, h, WithExtensionNodes()) {
+			t.Error("valid proof failed to verify")
+		}
+	}
+	_, err = smt.Delete(key3)
+	if err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	if !bytes.Equal(root, smt.Root()) {
+		t.Error("tree root is not as expected after deleting key")
+	}
+	if len(smn.m) != 4 {
+		t.Errorf("expected 4 nodes after deleting key, got %d", len(smn.m))
+	}
+
+	_, err = smt.Delete(key2)
+	if err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	if len(smn.m) != 1 {
+		t.Errorf("expected 1 node after deleting key, got %d", len(smn.m))
+	}
+	_, err = smt.Delete(key1)
+	if err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	if len(smn.m) != 0 || len(smv.m) != 0 {
+		t.Error("stores are not empty after deleting all keys")
+	}
+}
+
+// Test that trees with extension nodes have the same root regardless of the
+// order of operations.
+func TestSparseMerkleTreeExtensionNodesOrder(t *testing.T) {
+	h := newDummyHasher(sha256.New())
+	keys := make([][]byte, 64)
+	for i := range keys {
+		// Keys share most of their path, so that there are long chains of
+		// inner nodes to collapse.
+		keys[i] = make([]byte, h.Size()+4)
+		keys[i][4+rand.Intn(h.Size())] = byte(rand.Intn(256))
+		keys[i][4+rand.Intn(h.Size())] = byte(rand.Intn(256))
+	}
+
+	build := func(keys [][]byte) (*SparseMerkleTree, *SimpleMap) {
+		smn := NewSimpleMap()
+		smt := NewSparseMerkleTree(smn, NewSimpleMap(), h, WithExtensionNodes())
+		for _, key := range keys {
+			if _, err := smt.Update(key, key); err != nil {
+				t.Errorf("returned error when updating key: %v", err)
+			}
+		}
+		return smt, smn
+	}
+
+	smt1, _ := build(keys)
+	shuffled := make([][]byte, len(keys))
+	copy(shuffled, keys)
+	rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	smt2, smn2 := build(shuffled)
+	if !bytes.Equal(smt1.Root(), smt2.Root()) {
+		t.Error("tree roots differ for different orders of insertion")
+	}
+
+	// Deleting keys must leave the same tree as never inserting them.
+	for _, key := range shuffled[len(shuffled)/2:] {
+		if _, err := smt2.Delete(key); err != nil {
+			t.Errorf("returned error when deleting key: %v", err)
+		}
+	}
+	smt3, smn3 := build(shuffled[:len(shuffled)/2])
+	if !bytes.Equal(smt2.Root(), smt3.Root()) {
+		t.Error("tree roots differ after deleting keys")
+	}
+	if len(smn2.m) != len(smn3.m) {
+		t.Errorf("expected %d nodes after deleting keys, got %d", len(smn3.m), len(smn2.m))
+	}
+	for _, key := range keys {
+		proof, err := smt2.Prove(key)
+		if err != nil {
+			t.Errorf("returned error when proving key: %v", err)
+		}
+		value, err := smt2.Get(key)
+		if err != nil {
+			t.Errorf("returned error when getting key: %v", err)
+		}
+		if !VerifyProof(proof, smt2.Root(), key, value, h, WithExtensionNodes()) {
+			t.Error("valid proof failed to verify")
+		}
+	}
+}
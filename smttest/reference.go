@@ -0,0 +1,201 @@
+package smttest
+
+import (
+	"bytes"
+	"hash"
+
+	"github.com/celestiaorg/smt"
+)
+
+// ReferenceTree is a deliberately simple sparse Merkle tree, to test
+// SparseMerkleTree against. It keeps its values in a map, and computes its
+// root and proofs from all of them whenever they are asked for, with the
+// hashing rules of a SparseMerkleTree with no options, or with ordered keys.
+type ReferenceTree struct {
+	hasher      hash.Hash
+	values      map[string][]byte
+	orderedKeys bool
+}
+
+// referenceLeaf is a leaf of a ReferenceTree.
+type referenceLeaf struct {
+	path []byte
+	data []byte
+}
+
+// NewReferenceTree creates a new empty ReferenceTree.
+func NewReferenceTree(hasher hash.Hash) *ReferenceTree {
+	return &ReferenceTree{
+		hasher: hasher,
+		values: make(map[string][]byte),
+	}
+}
+
+// NewOrderedReferenceTree creates a new empty ReferenceTree whose keys are
+// their paths, like a SparseMerkleTree created WithOrderedKeys.
+func NewOrderedReferenceTree(hasher hash.Hash) *ReferenceTree {
+	rt := NewReferenceTree(hasher)
+	rt.orderedKeys = true
+	return rt
+}
+
+// Get gets the value of a key, which is empty if the key is not set.
+func (rt *ReferenceTree) Get(key []byte) []byte {
+	return rt.values[string(key)]
+}
+
+// Update sets the value of a key. Setting an empty value deletes the key.
+func (rt *ReferenceTree) Update(key []byte, value []byte) {
+	if len(value) == 0 {
+		rt.Delete(key)
+		return
+	}
+	rt.values[string(key)] = append([]byte(nil), value...)
+}
+
+// Delete deletes a key.
+func (rt *ReferenceTree) Delete(key []byte) {
+	delete(rt.values, string(key))
+}
+
+// Root returns the root of the tree.
+func (rt *ReferenceTree) Root() []byte {
+	return rt.subtreeRoot(rt.leaves(), 0)
+}
+
+// Prove returns the proof of a key that SparseMerkleTree.Prove returns.
+func (rt *ReferenceTree) Prove(key []byte) smt.SparseMerkleProof {
+	proof, _ := rt.prove(key)
+	return proof
+}
+
+// ProveUpdatable returns the proof of a key that
+// SparseMerkleTree.ProveUpdatable returns, which also holds the data of the
+// lowest side node.
+func (rt *ReferenceTree) ProveUpdatable(key []byte) smt.SparseMerkleProof {
+	proof, siblingLeaves := rt.prove(key)
+	if len(proof.SideNodes) > 0 {
+		proof.SiblingData = rt.subtreeData(siblingLeaves, len(proof.SideNodes))
+	}
+	return proof
+}
+
+// ProveCompact returns the proof of a key that SparseMerkleTree.ProveCompact
+// returns, in which the placeholder side nodes are left out and marked in a
+// bit mask.
+func (rt *ReferenceTree) ProveCompact(key []byte) smt.SparseCompactMerkleProof {
+	proof := rt.Prove(key)
+	compact := smt.SparseCompactMerkleProof{
+		NonMembershipLeafData: proof.NonMembershipLeafData,
+		BitMask:               make([]byte, (len(proof.SideNodes)+7)/8),
+		NumSideNodes:          len(proof.SideNodes),
+	}
+	for i, sideNode := range proof.SideNodes {
+		if bytes.Equal(sideNode, make([]byte, rt.hasher.Size())) {
+			compact.BitMask[i/8] |= 1 << (7 - i%8)
+		} else {
+			compact.SideNodes = append(compact.SideNodes, sideNode)
+		}
+	}
+	return compact
+}
+
+// prove returns the proof of a key, and the leaves under its lowest side
+// node.
+func (rt *ReferenceTree) prove(key []byte) (smt.SparseMerkleProof, []referenceLeaf) {
+	path := rt.path(key)
+	leaves := rt.leaves()
+
+	// Walk down from the root until the path reaches a subtree with at most
+	// one leaf, which is where the tree holds a placeholder or a leaf.
+	var sideNodes [][]byte
+	var siblingLeaves []referenceLeaf
+	depth := 0
+	for ; len(leaves) > 1; depth++ {
+		left, right := splitLeaves(leaves, depth)
+		if bit(path, depth) == 0 {
+			leaves, siblingLeaves = left, right
+		} else {
+			leaves, siblingLeaves = right, left
+		}
+		sideNodes = append(sideNodes, rt.subtreeRoot(siblingLeaves, depth+1))
+	}
+
+	var proof smt.SparseMerkleProof
+	// The side nodes of proofs are ordered from the bottom of the tree.
+	for i := len(sideNodes) - 1; i >= 0; i-- {
+		proof.SideNodes = append(proof.SideNodes, sideNodes[i])
+	}
+	if len(leaves) == 1 && !bytes.Equal(path, leaves[0].path) {
+		proof.NonMembershipLeafData = leaves[0].data
+	}
+	return proof, siblingLeaves
+}
+
+// leaves returns the leaves of every key of the tree.
+func (rt *ReferenceTree) leaves() []referenceLeaf {
+	leaves := make([]referenceLeaf, 0, len(rt.values))
+	for key, value := range rt.values {
+		path := rt.path([]byte(key))
+		data := []byte{0}
+		data = append(data, path...)
+		data = append(data, rt.digest(value)...)
+		leaves = append(leaves, referenceLeaf{path: path, data: data})
+	}
+	return leaves
+}
+
+// subtreeRoot returns the root of the subtree at a depth that holds some
+// leaves. A subtree with no leaves is a placeholder, and a subtree with one
+// leaf is that leaf.
+func (rt *ReferenceTree) subtreeRoot(leaves []referenceLeaf, depth int) []byte {
+	if len(leaves) == 0 {
+		return make([]byte, rt.hasher.Size())
+	}
+	return rt.digest(rt.subtreeData(leaves, depth))
+}
+
+// subtreeData returns the data of the root of the subtree at a depth that
+// holds at least one leaf.
+func (rt *ReferenceTree) subtreeData(leaves []referenceLeaf, depth int) []byte {
+	if len(leaves) == 1 {
+		return leaves[0].data
+	}
+	left, right := splitLeaves(leaves, depth)
+	data := []byte{1}
+	data = append(data, rt.subtreeRoot(left, depth+1)...)
+	return append(data, rt.subtreeRoot(right, depth+1)...)
+}
+
+// path returns the path of a key.
+func (rt *ReferenceTree) path(key []byte) []byte {
+	if rt.orderedKeys {
+		return append([]byte(nil), key...)
+	}
+	return rt.digest(key)
+}
+
+func (rt *ReferenceTree) digest(data []byte) []byte {
+	rt.hasher.Write(data)
+	sum := rt.hasher.Sum(nil)
+	rt.hasher.Reset()
+	return sum
+}
+
+// splitLeaves splits leaves by the bit of their paths at a depth.
+func splitLeaves(leaves []referenceLeaf, depth int) (left, right []referenceLeaf) {
+	for _, leaf := range leaves {
+		if bit(leaf.path, depth) == 0 {
+			left = append(left, leaf)
+		} else {
+			right = append(right, leaf)
+		}
+	}
+	return left, right
+}
+
+// bit returns the bit of a path at a depth, from the most significant bit of
+// its first byte.
+func bit(path []byte, depth int) byte {
+	return path[depth/8] >> (7 - depth%8) & 1
+}
@@ -0,0 +1,16 @@
+//go:build go1.18
+// +build go1.18
+
+package smttest
+
+import "testing"
+
+// FuzzReferenceTree checks a tree against a ReferenceTree under the
+// operations encoded in the fuzzed data. See runOperations.
+func FuzzReferenceTree(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 0, 3, 1, 2, 2, 1, 0, 2})
+	f.Add([]byte{3, 7, 6, 9, 9, 7, 4, 9, 1, 7})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		runOperations(t, data)
+	})
+}
@@ -0,0 +1,150 @@
+package smttest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+
+	"github.com/celestiaorg/smt"
+)
+
+// Test that a tree has the same roots and proofs as a ReferenceTree under
+// random operations.
+func TestReferenceTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		data := make([]byte, 2*(1+r.Intn(300)))
+		r.Read(data)
+		runOperations(t, data)
+	}
+}
+
+// runOperations applies the operations encoded in data to trees and to
+// ReferenceTrees, and checks that they have the same root and proofs after
+// every operation. Every operation is two bytes, of its kind and its key.
+//
+// The operations are applied to a tree with hashed keys, and to a tree with
+// ordered keys whose paths only differ in their last bytes, so that leaves
+// are as deep as the tree.
+func runOperations(t testing.TB, data []byte) {
+	runOperationsOn(t, data,
+		smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New()),
+		NewReferenceTree(sha256.New()),
+		func(kind byte, key byte) []byte {
+			return []byte{key}
+		})
+	runOperationsOn(t, data,
+		smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New(), smt.WithOrderedKeys()),
+		NewOrderedReferenceTree(sha256.New()),
+		orderedKey,
+		smt.WithOrderedKeys())
+}
+
+// orderedKey returns a key of a tree with ordered keys that is zero but for
+// one of its last eight bytes, chosen by the kind of operation.
+func orderedKey(kind byte, key byte) []byte {
+	k := make([]byte, sha256.Size)
+	k[len(k)-1-int(kind>>5)] = key
+	return k
+}
+
+func runOperationsOn(t testing.TB, data []byte, tree *smt.SparseMerkleTree, reference *ReferenceTree, newKey func(kind byte, key byte) []byte, options ...smt.Option) {
+	for i := 0; i+1 < len(data); i += 2 {
+		op, key := data[i], newKey(data[i], data[i+1])
+		var err error
+		switch op % 3 {
+		case 0:
+			value := []byte{op, data[i+1], byte(i)}
+			_, err = tree.Update(key, value)
+			reference.Update(key, value)
+		case 1:
+			_, err = tree.Delete(key)
+			reference.Delete(key)
+		case 2:
+			// Updating a key to the empty value deletes it.
+			_, err = tree.Update(key, nil)
+			reference.Update(key, nil)
+		}
+		if err != nil {
+			t.Fatalf("returned error at operation %d: %v", i/2, err)
+		}
+
+		root := tree.Root()
+		if !bytes.Equal(reference.Root(), root) {
+			t.Fatalf("did not get root of ReferenceTree at operation %d", i/2)
+		}
+		// Check the key of the operation, and a key that is likely unset.
+		for _, key := range [][]byte{key, newKey(0, op)} {
+			checkKey(t, tree, reference, root, key, i/2, options...)
+		}
+	}
+}
+
+// checkKey checks that a tree has the same value and proofs of a key as a
+// ReferenceTree.
+func checkKey(t testing.TB, tree *smt.SparseMerkleTree, reference *ReferenceTree, root []byte, key []byte, op int, options ...smt.Option) {
+	value, err := tree.Get(key)
+	if err != nil {
+		t.Fatalf("returned error when getting key: %v", err)
+	}
+	if !bytes.Equal(reference.Get(key), value) {
+		t.Fatalf("did not get value of ReferenceTree at operation %d", op)
+	}
+
+	proof, err := tree.Prove(key)
+	if err != nil {
+		t.Fatalf("returned error when proving key: %v", err)
+	}
+	if !equalProofs(reference.Prove(key), proof) {
+		t.Fatalf("did not get proof of ReferenceTree at operation %d", op)
+	}
+	if !smt.VerifyProof(proof, root, key, value, sha256.New(), options...) {
+		t.Fatalf("proof failed to verify at operation %d", op)
+	}
+
+	updatable, err := tree.ProveUpdatable(key)
+	if err != nil {
+		t.Fatalf("returned error when proving key with updatable proof: %v", err)
+	}
+	if !equalProofs(reference.ProveUpdatable(key), updatable) {
+		t.Fatalf("did not get updatable proof of ReferenceTree at operation %d", op)
+	}
+
+	compact, err := tree.ProveCompact(key)
+	if err != nil {
+		t.Fatalf("returned error when proving key with compact proof: %v", err)
+	}
+	if !equalCompactProofs(reference.ProveCompact(key), compact) {
+		t.Fatalf("did not get compact proof of ReferenceTree at operation %d", op)
+	}
+	if !smt.VerifyCompactProof(compact, root, key, value, sha256.New(), options...) {
+		t.Fatalf("compact proof failed to verify at operation %d", op)
+	}
+}
+
+func equalProofs(a, b smt.SparseMerkleProof) bool {
+	return equalSideNodes(a.SideNodes, b.SideNodes) &&
+		bytes.Equal(a.NonMembershipLeafData, b.NonMembershipLeafData) &&
+		bytes.Equal(a.SiblingData, b.SiblingData)
+}
+
+func equalCompactProofs(a, b smt.SparseCompactMerkleProof) bool {
+	return equalSideNodes(a.SideNodes, b.SideNodes) &&
+		bytes.Equal(a.NonMembershipLeafData, b.NonMembershipLeafData) &&
+		bytes.Equal(a.BitMask, b.BitMask) &&
+		a.NumSideNodes == b.NumSideNodes &&
+		bytes.Equal(a.SiblingData, b.SiblingData)
+}
+
+func equalSideNodes(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
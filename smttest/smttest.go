@@ -0,0 +1,347 @@
+// Package smttest tests implementations of the interfaces of package smt.
+package smttest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/celestiaorg/smt"
+)
+
+// TestMapStore tests that the MapStores created by newStore keep to the
+// contracts of MapStore, and of IterableMapStore if they implement it, and
+// that trees on them have the same roots as trees on SimpleMaps. Every call to
+// newStore must return a new empty store, and can fail the test it is called
+// with.
+//
+// That values returned by Get are not modified is a contract of the callers of
+// MapStore, not of stores, which may return the slices they hold, as SimpleMap
+// does. It is not tested.
+func TestMapStore(t *testing.T, newStore func(t *testing.T) smt.MapStore) {
+	t.Run("Contract", func(t *testing.T) {
+		testContract(t, newStore(t))
+	})
+	t.Run("Iterate", func(t *testing.T) {
+		store, ok := newStore(t).(smt.IterableMapStore)
+		if !ok {
+			t.Skip("store is not iterable")
+		}
+		testIterate(t, store)
+	})
+	t.Run("ConcurrentGet", func(t *testing.T) {
+		testConcurrentGet(t, newStore(t))
+	})
+	t.Run("Tree", func(t *testing.T) {
+		testTree(t, newStore)
+	})
+	t.Run("TreeExtensionNodes", func(t *testing.T) {
+		testTree(t, newStore, smt.WithExtensionNodes())
+	})
+	t.Run("VersionedTree", func(t *testing.T) {
+		testVersionedTree(t, newStore)
+	})
+}
+
+// testContract tests the results of Get, Set and Delete.
+func testContract(t *testing.T, store smt.MapStore) {
+	key := []byte("testKey")
+	var invalidKeyError *smt.InvalidKeyError
+	if _, err := store.Get(key); !errors.As(err, &invalidKeyError) || !bytes.Equal(key, invalidKeyError.Key) {
+		t.Errorf("expected InvalidKeyError with key when getting missing key, got: %v", err)
+	}
+	if err := store.Delete(key); !errors.As(err, &invalidKeyError) || !bytes.Equal(key, invalidKeyError.Key) {
+		t.Errorf("expected InvalidKeyError with key when deleting missing key, got: %v", err)
+	}
+
+	// The key and value passed to Set can be reused by the caller.
+	setKey := append([]byte(nil), key...)
+	value := []byte("testValue")
+	if err := store.Set(setKey, value); err != nil {
+		t.Errorf("returned error when setting key: %v", err)
+	}
+	copy(setKey, "reused!")
+	copy(value, "reusedVal")
+	got, err := store.Get(key)
+	if err != nil {
+		t.Errorf("returned error when getting key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue"), got) {
+		t.Errorf("did not get value of key after reusing buffers passed to Set, got %q", got)
+	}
+	if _, err := store.Get([]byte("reused!")); err == nil {
+		t.Error("got key from buffer reused after Set")
+	}
+
+	if err := store.Set(key, []byte("testValue2")); err != nil {
+		t.Errorf("returned error when overwriting key: %v", err)
+	}
+	if got, _ := store.Get(key); !bytes.Equal([]byte("testValue2"), got) {
+		t.Errorf("did not get overwritten value of key, got %q", got)
+	}
+
+	// Empty keys and values can be set.
+	if err := store.Set(key, nil); err != nil {
+		t.Errorf("returned error when setting empty value: %v", err)
+	}
+	if got, err := store.Get(key); err != nil || len(got) != 0 {
+		t.Errorf("did not get empty value of key, got %q and error: %v", got, err)
+	}
+	if err := store.Set(nil, []byte("emptyKeyValue")); err != nil {
+		t.Errorf("returned error when setting empty key: %v", err)
+	}
+	if got, err := store.Get([]byte{}); err != nil || !bytes.Equal([]byte("emptyKeyValue"), got) {
+		t.Errorf("did not get value of empty key, got %q and error: %v", got, err)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	if _, err := store.Get(key); !errors.As(err, &invalidKeyError) {
+		t.Errorf("expected InvalidKeyError when getting deleted key, got: %v", err)
+	}
+	if err := store.Delete(key); !errors.As(err, &invalidKeyError) {
+		t.Errorf("expected InvalidKeyError when deleting key twice, got: %v", err)
+	}
+	if got, _ := store.Get(nil); !bytes.Equal([]byte("emptyKeyValue"), got) {
+		t.Error("did not keep empty key when deleting other key")
+	}
+}
+
+// testIterate tests that iteration is in order, and over the keys with a
+// prefix.
+func testIterate(t *testing.T, store smt.IterableMapStore) {
+	// The keys, in order.
+	keys := []string{"", "a", "a\x00", "ab", "a\xff", "a\xff\xff", "b", "\xff", "\xff\xff"}
+	for _, i := range rand.Perm(len(keys)) {
+		if err := store.Set([]byte(keys[i]), []byte("value-"+keys[i])); err != nil {
+			t.Errorf("returned error when setting key: %v", err)
+		}
+	}
+
+	iterate := func(prefix string, limit int) []string {
+		got := []string{}
+		err := store.Iterate([]byte(prefix), func(key []byte, value []byte) bool {
+			if !bytes.Equal([]byte("value-"+string(key)), value) {
+				t.Errorf("did not get value of key %q when iterating", key)
+			}
+			got = append(got, string(key))
+			return len(got) != limit
+		})
+		if err != nil {
+			t.Errorf("returned error when iterating: %v", err)
+		}
+		return got
+	}
+	for _, prefix := range []string{"", "a", "a\xff", "ab", "\xff", "c"} {
+		expected := []string{}
+		for _, key := range keys {
+			if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+				expected = append(expected, key)
+			}
+		}
+		if got := iterate(prefix, -1); !reflect.DeepEqual(expected, got) {
+			t.Errorf("expected keys %q when iterating over prefix %q, got %q", expected, prefix, got)
+		}
+	}
+	if got := iterate("a", 2); !reflect.DeepEqual([]string{"a", "a\x00"}, got) {
+		t.Errorf("did not stop iterating when fn returned false, got %q", got)
+	}
+
+	store.Delete([]byte("ab"))
+	if got := iterate("ab", -1); len(got) != 0 {
+		t.Errorf("got deleted key when iterating, got %q", got)
+	}
+}
+
+// testConcurrentGet tests that keys can be got from several goroutines at
+// once, as they are by the snapshots of a tree.
+func testConcurrentGet(t *testing.T, store smt.MapStore) {
+	for i := 0; i < 100; i++ {
+		s := strconv.Itoa(i)
+		store.Set([]byte(s), []byte("value"+s))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				s := strconv.Itoa(i)
+				if value, err := store.Get([]byte(s)); err != nil || !bytes.Equal([]byte("value"+s), value) {
+					t.Errorf("did not get value of key %s concurrently", s)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// workload applies random operations to trees with the same keys, and keeps
+// track of the values of their keys.
+type workload struct {
+	t    *testing.T
+	r    *rand.Rand
+	kv   map[string][]byte
+	keys []string
+}
+
+func newWorkload(t *testing.T) *workload {
+	return &workload{
+		t:  t,
+		r:  rand.New(rand.NewSource(1)),
+		kv: make(map[string][]byte),
+	}
+}
+
+// apply applies a random insert, update or delete to the trees.
+func (w *workload) apply(trees ...*smt.SparseMerkleTree) {
+	n := w.r.Intn(10)
+	if n < 4 || len(w.keys) == 0 {
+		key := make([]byte, 1+w.r.Intn(32))
+		w.r.Read(key)
+		if _, ok := w.kv[string(key)]; !ok {
+			w.keys = append(w.keys, string(key))
+		}
+		w.update(trees, key)
+		return
+	}
+
+	i := w.r.Intn(len(w.keys))
+	key := []byte(w.keys[i])
+	if n < 7 {
+		w.update(trees, key)
+		return
+	}
+	w.keys[i] = w.keys[len(w.keys)-1]
+	w.keys = w.keys[:len(w.keys)-1]
+	delete(w.kv, string(key))
+	for _, tree := range trees {
+		if _, err := tree.Delete(key); err != nil {
+			w.t.Errorf("returned error when deleting key: %v", err)
+		}
+	}
+}
+
+func (w *workload) update(trees []*smt.SparseMerkleTree, key []byte) {
+	value := make([]byte, 1+w.r.Intn(64))
+	w.r.Read(value)
+	w.kv[string(key)] = value
+	for _, tree := range trees {
+		if _, err := tree.Update(key, value); err != nil {
+			w.t.Errorf("returned error when updating key: %v", err)
+		}
+	}
+}
+
+// check checks the value and proof of every key of a tree.
+func (w *workload) check(tree *smt.SparseMerkleTree, options ...smt.Option) {
+	keys := append([]string(nil), w.keys...)
+	sort.Strings(keys)
+	for _, key := range keys {
+		value, err := tree.Get([]byte(key))
+		if err != nil {
+			w.t.Errorf("returned error when getting key: %v", err)
+		}
+		if !bytes.Equal(w.kv[key], value) {
+			w.t.Errorf("did not get value of key %x", key)
+		}
+		proof, err := tree.Prove([]byte(key))
+		if err != nil {
+			w.t.Errorf("returned error when proving key: %v", err)
+		}
+		if !smt.VerifyProof(proof, tree.Root(), []byte(key), value, sha256.New(), options...) {
+			w.t.Errorf("proof of key %x failed to verify", key)
+		}
+	}
+}
+
+// testTree tests that a tree on the stores has the same roots as a tree on
+// SimpleMaps under random operations.
+func testTree(t *testing.T, newStore func(t *testing.T) smt.MapStore, options ...smt.Option) {
+	tree := smt.NewSparseMerkleTree(newStore(t), newStore(t), sha256.New(), options...)
+	reference := smt.NewSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New(), options...)
+	w := newWorkload(t)
+	for i := 0; i < 1000; i++ {
+		w.apply(tree, reference)
+		if !bytes.Equal(reference.Root(), tree.Root()) {
+			t.Fatalf("did not get root of tree on SimpleMaps after %d operations", i+1)
+		}
+	}
+	w.check(tree, options...)
+}
+
+// testVersionedTree tests that a versioned tree on the stores has the same
+// roots as one on SimpleMaps, and that pruning versions leaves the retained
+// versions and the latest one intact.
+func testVersionedTree(t *testing.T, newStore func(t *testing.T) smt.MapStore) {
+	nodes, values, meta := newStore(t), newStore(t), newStore(t)
+	tree, err := smt.OpenSparseMerkleTree(nodes, values, meta, sha256.New())
+	if err != nil {
+		t.Fatalf("returned error when opening tree: %v", err)
+	}
+	reference, _ := smt.OpenSparseMerkleTree(smt.NewSimpleMap(), smt.NewSimpleMap(), smt.NewSimpleMap(), sha256.New())
+
+	w := newWorkload(t)
+	oldest := uint64(1)
+	for i := 0; i < 1000; i++ {
+		w.apply(tree, reference)
+		if i%50 != 49 {
+			continue
+		}
+		version, root, err := tree.Commit()
+		if err != nil {
+			t.Fatalf("returned error when committing tree: %v", err)
+		}
+		reference.Commit()
+		if !bytes.Equal(reference.Root(), root) {
+			t.Fatalf("did not get root of tree on SimpleMaps at version %d", version)
+		}
+		// Retain the last three versions.
+		if version-oldest == 3 {
+			if err := tree.DeleteVersion(oldest); err != nil {
+				t.Errorf("returned error when deleting version: %v", err)
+			}
+			oldest++
+		}
+	}
+	w.check(tree)
+
+	roots, err := tree.VersionRoots()
+	if err != nil {
+		t.Fatalf("returned error when getting version roots: %v", err)
+	}
+	if len(roots) != 3 {
+		t.Errorf("expected 3 retained versions, got %d", len(roots))
+	}
+	for version, root := range roots {
+		loaded, err := tree.LoadVersion(version)
+		if err != nil {
+			t.Errorf("returned error when loading version %d: %v", version, err)
+			continue
+		}
+		if !bytes.Equal(root, loaded.Root()) {
+			t.Errorf("did not get root of version %d", version)
+		}
+		for _, key := range w.keys {
+			if _, err := loaded.Get([]byte(key)); err != nil {
+				t.Errorf("returned error when getting key from version %d: %v", version, err)
+			}
+		}
+	}
+
+	reopened, err := smt.OpenSparseMerkleTree(nodes, values, meta, sha256.New())
+	if err != nil {
+		t.Fatalf("returned error when reopening tree: %v", err)
+	}
+	if !bytes.Equal(tree.Root(), reopened.Root()) {
+		t.Error("did not get committed root when reopening tree")
+	}
+}
@@ -0,0 +1,30 @@
+package smttest
+
+import (
+	"testing"
+
+	"github.com/celestiaorg/smt"
+)
+
+func TestSimpleMap(t *testing.T) {
+	TestMapStore(t, func(t *testing.T) smt.MapStore {
+		return smt.NewSimpleMap()
+	})
+}
+
+func TestSortedMap(t *testing.T) {
+	TestMapStore(t, func(t *testing.T) smt.MapStore {
+		return smt.NewSortedMap()
+	})
+}
+
+func TestPrefixedMapStore(t *testing.T) {
+	// The stores share a backend, so their keys must not mix.
+	backend := smt.NewSimpleMap()
+	var stores int
+	TestMapStore(t, func(t *testing.T) smt.MapStore {
+		stores++
+		nodes, _, _ := smt.NamedTreeStores(backend, string(rune('a'+stores)))
+		return nodes
+	})
+}
@@ -0,0 +1,277 @@
+package smt
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrReadOnly is returned when writing to a read-only tree, such as a
+// snapshot.
+var ErrReadOnly = errors.New("read-only tree")
+
+// Snapshot returns a read-only tree pinned to the current root of the tree.
+// Later updates of the tree do not delete the nodes and values that the
+// snapshot needs, until the snapshot is released with Release. A snapshot may
+// be read from another goroutine while the tree is being updated.
+func (smt *SparseMerkleTree) Snapshot() *SparseMerkleTree {
+	if smt.snapshot != nil {
+		// A snapshot of a snapshot shares its pinned nodes and values.
+		registry := smt.snapshot.registry
+		registry.mu.Lock()
+		defer registry.mu.Unlock()
+		smt.snapshot.refs++
+		return smt.snapshotTree(smt.snapshot)
+	}
+
+	if smt.snapshots == nil {
+		// Wrap the stores of the tree, so that updates keep what snapshots
+		// need.
+		smt.snapshots = &snapshotRegistry{
+			nodes:   smt.nodes,
+			values:  smt.values,
+			live:    make(map[*snapshot]struct{}),
+			pending: make(map[string]uint64),
+		}
+		smt.nodes = &snapshotNodeStore{registry: smt.snapshots}
+		smt.values = &snapshotValueStore{registry: smt.snapshots}
+		smt.th.mu = &sync.Mutex{}
+	}
+
+	registry := smt.snapshots
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	s := &snapshot{
+		registry: registry,
+		epoch:    registry.epoch,
+		refs:     1,
+		values:   make(map[string][]byte),
+	}
+	registry.epoch++
+	registry.live[s] = struct{}{}
+	return smt.snapshotTree(s)
+}
+
+func (smt *SparseMerkleTree) snapshotTree(s *snapshot) *SparseMerkleTree {
+	return &SparseMerkleTree{
+		th:               smt.th,
+		nodes:            &snapshotNodeView{registry: s.registry},
+		values:           &snapshotValueView{snapshot: s},
+		root:             smt.root,
+		readOnly:         true,
+		snapshot:         s,
+		keepHistory:      smt.keepHistory,
+		contentAddressed: smt.contentAddressed,
+	}
+}
+
+// Release releases a snapshot, so that the nodes and values that only the
+// snapshot needed are deleted from the stores of its tree. The snapshot must
+// not be used afterwards. Release does nothing on trees that are not
+// snapshots.
+func (smt *SparseMerkleTree) Release() error {
+	s := smt.snapshot
+	if s == nil {
+		return nil
+	}
+	smt.snapshot = nil
+
+	registry := s.registry
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(registry.live, s)
+
+	// Delete the nodes that were deleted from the tree after the oldest
+	// remaining snapshot was taken.
+	for key, epoch := range registry.pending {
+		if registry.needed(epoch) {
+			continue
+		}
+		if err := registry.nodes.Delete([]byte(key)); err != nil {
+			return err
+		}
+		delete(registry.pending, key)
+	}
+	return nil
+}
+
+// snapshotRegistry tracks the live snapshots of a tree, and the nodes that
+// the tree deleted while they were live.
+type snapshotRegistry struct {
+	// mu guards the stores of the tree, which may be read by snapshots from
+	// other goroutines.
+	mu            sync.RWMutex
+	nodes, values MapStore
+
+	// epoch is the number of snapshots taken of the tree. Every snapshot
+	// and deleted node is tagged with the epoch at which it was taken or
+	// deleted.
+	epoch   uint64
+	live    map[*snapshot]struct{}
+	pending map[string]uint64
+}
+
+// needed returns true if a live snapshot was taken before a node was deleted
+// at an epoch.
+func (registry *snapshotRegistry) needed(epoch uint64) bool {
+	for s := range registry.live {
+		if s.epoch < epoch {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot is the state of a snapshot.
+type snapshot struct {
+	registry *snapshotRegistry
+	epoch    uint64
+	refs     int
+
+	// values holds the values that the tree changed since the snapshot was
+	// taken, as they were then. Values that did not exist are nil.
+	values map[string][]byte
+}
+
+// snapshotNodeStore is the node store of a tree with snapshots. It defers
+// node deletions while snapshots that may need the nodes are live.
+type snapshotNodeStore struct {
+	registry *snapshotRegistry
+}
+
+// Get gets the value for a key.
+func (sns *snapshotNodeStore) Get(key []byte) ([]byte, error) {
+	sns.registry.mu.RLock()
+	defer sns.registry.mu.RUnlock()
+	return sns.registry.nodes.Get(key)
+}
+
+// Set updates the value for a key.
+func (sns *snapshotNodeStore) Set(key []byte, value []byte) error {
+	sns.registry.mu.Lock()
+	defer sns.registry.mu.Unlock()
+	// The node is in use again, so it must not be deleted on release.
+	delete(sns.registry.pending, string(key))
+	return sns.registry.nodes.Set(key, value)
+}
+
+// Delete deletes a key.
+func (sns *snapshotNodeStore) Delete(key []byte) error {
+	sns.registry.mu.Lock()
+	defer sns.registry.mu.Unlock()
+	if _, ok := sns.registry.pending[string(key)]; ok {
+		return &InvalidKeyError{Key: key}
+	}
+	if sns.registry.needed(sns.registry.epoch) {
+		sns.registry.pending[string(key)] = sns.registry.epoch
+		return nil
+	}
+	return sns.registry.nodes.Delete(key)
+}
+
+// snapshotValueStore is the value store of a tree with snapshots. It keeps the
+// old values of the keys it changes for the live snapshots.
+type snapshotValueStore struct {
+	registry *snapshotRegistry
+}
+
+// Get gets the value for a key.
+func (svs *snapshotValueStore) Get(key []byte) ([]byte, error) {
+	svs.registry.mu.RLock()
+	defer svs.registry.mu.RUnlock()
+	return svs.registry.values.Get(key)
+}
+
+// Set updates the value for a key.
+func (svs *snapshotValueStore) Set(key []byte, value []byte) error {
+	svs.registry.mu.Lock()
+	defer svs.registry.mu.Unlock()
+	if err := svs.preserve(key); err != nil {
+		return err
+	}
+	return svs.registry.values.Set(key, value)
+}
+
+// Delete deletes a key.
+func (svs *snapshotValueStore) Delete(key []byte) error {
+	svs.registry.mu.Lock()
+	defer svs.registry.mu.Unlock()
+	if err := svs.preserve(key); err != nil {
+		return err
+	}
+	return svs.registry.values.Delete(key)
+}
+
+// preserve keeps the current value of a key for the live snapshots that do
+// not have it yet.
+func (svs *snapshotValueStore) preserve(key []byte) error {
+	for s := range svs.registry.live {
+		if _, ok := s.values[string(key)]; ok {
+			continue
+		}
+		value, err := svs.registry.values.Get(key)
+		if err != nil {
+			var invalidKeyError *InvalidKeyError
+			if !errors.As(err, &invalidKeyError) {
+				return err
+			}
+			value = nil
+		}
+		s.values[string(key)] = value
+	}
+	return nil
+}
+
+// snapshotNodeView is the read-only node store of a snapshot.
+type snapshotNodeView struct {
+	registry *snapshotRegistry
+}
+
+// Get gets the value for a key.
+func (snv *snapshotNodeView) Get(key []byte) ([]byte, error) {
+	snv.registry.mu.RLock()
+	defer snv.registry.mu.RUnlock()
+	return snv.registry.nodes.Get(key)
+}
+
+// Set returns ErrReadOnly.
+func (snv *snapshotNodeView) Set(key []byte, value []byte) error {
+	return ErrReadOnly
+}
+
+// Delete returns ErrReadOnly.
+func (snv *snapshotNodeView) Delete(key []byte) error {
+	return ErrReadOnly
+}
+
+// snapshotValueView is the read-only value store of a snapshot.
+type snapshotValueView struct {
+	snapshot *snapshot
+}
+
+// Get gets the value for a key.
+func (svv *snapshotValueView) Get(key []byte) ([]byte, error) {
+	registry := svv.snapshot.registry
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	if value, ok := svv.snapshot.values[string(key)]; ok {
+		if value == nil {
+			return nil, &InvalidKeyError{Key: key}
+		}
+		return value, nil
+	}
+	return registry.values.Get(key)
+}
+
+// Set returns ErrReadOnly.
+func (svv *snapshotValueView) Set(key []byte, value []byte) error {
+	return ErrReadOnly
+}
+
+// Delete returns ErrReadOnly.
+func (svv *snapshotValueView) Delete(key []byte) error {
+	return ErrReadOnly
+}
@@ -0,0 +1,205 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// Test that snapshots keep the contents of a tree at a root.
+func TestSparseMerkleTreeSnapshot(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, sha256.New())
+	kv := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		s := strconv.Itoa(i)
+		kv[s] = s
+		smt.Update([]byte(s), []byte(s))
+	}
+
+	snapshot := smt.Snapshot()
+	root := snapshot.Root()
+	for i := 0; i < 100; i++ {
+		s := strconv.Itoa(i)
+		if i%3 == 0 {
+			smt.Delete([]byte(s))
+		} else {
+			smt.Update([]byte(s), []byte("new"+s))
+		}
+	}
+
+	// The snapshot still has the old contents.
+	if !bytes.Equal(root, snapshot.Root()) {
+		t.Error("snapshot root changed after updating tree")
+	}
+	for k, v := range kv {
+		value, err := snapshot.Get([]byte(k))
+		if err != nil {
+			t.Errorf("returned error when getting key from snapshot: %v", err)
+		}
+		if !bytes.Equal([]byte(v), value) {
+			t.Error("did not get old value when getting key from snapshot")
+		}
+		proof, err := snapshot.Prove([]byte(k))
+		if err != nil {
+			t.Errorf("error returned when trying to prove inclusion in snapshot: %v", err)
+		}
+		if !VerifyProof(proof, root, []byte(k), []byte(v), sha256.New()) {
+			t.Error("valid proof from snapshot failed to verify")
+		}
+	}
+	if has, _ := snapshot.Has([]byte("99")); has {
+		t.Error("did not get 'false' when checking key added after snapshot")
+	}
+	var count int
+	err := snapshot.Iterate(func(path []byte, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		t.Errorf("returned error when iterating snapshot: %v", err)
+	}
+	if count != len(kv) {
+		t.Errorf("expected %d leaves in snapshot, got %d", len(kv), count)
+	}
+
+	// Snapshots cannot be written to.
+	if _, err := snapshot.Update([]byte("testKey"), []byte("testValue")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly when updating snapshot, got: %v", err)
+	}
+	if _, err := snapshot.Delete([]byte("1")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly when deleting from snapshot, got: %v", err)
+	}
+	tx := snapshot.Begin()
+	tx.Update([]byte("testKey"), []byte("testValue"))
+	if err := tx.Commit(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly when committing transaction on snapshot, got: %v", err)
+	}
+
+	// Once released, the stores are the same as if there was no snapshot.
+	if err := snapshot.Release(); err != nil {
+		t.Errorf("returned error when releasing snapshot: %v", err)
+	}
+	expected := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		if i%3 != 0 {
+			s := strconv.Itoa(i)
+			expected.Update([]byte(s), []byte("new"+s))
+		}
+	}
+	if !bytes.Equal(expected.Root(), smt.Root()) ||
+		!reflect.DeepEqual(expected.nodes.(*SimpleMap).m, smn.m) ||
+		!reflect.DeepEqual(expected.values.(*SimpleMap).m, smv.m) {
+		t.Error("stores differ from a tree without snapshots after releasing snapshot")
+	}
+}
+
+// Test that nodes are kept for as long as any snapshot needs them.
+func TestSparseMerkleTreeSnapshotsReleaseOrder(t *testing.T) {
+	smn := NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, NewSimpleMap(), sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	snapshot1 := smt.Snapshot()
+	smt.Update([]byte("testKey"), []byte("testValue2"))
+	snapshot2 := smt.Snapshot()
+	snapshot3 := snapshot2.Snapshot()
+	smt.Update([]byte("testKey"), []byte("testValue3"))
+
+	check := func(snapshot *SparseMerkleTree, expected string) {
+		value, err := snapshot.Get([]byte("testKey"))
+		if err != nil {
+			t.Errorf("returned error when getting key from snapshot: %v", err)
+		}
+		if !bytes.Equal([]byte(expected), value) {
+			t.Error("did not get correct value when getting key from snapshot")
+		}
+		if _, err := snapshot.Prove([]byte("testKey")); err != nil {
+			t.Errorf("error returned when trying to prove inclusion in snapshot: %v", err)
+		}
+	}
+
+	snapshot2.Release()
+	check(snapshot1, "testValue")
+	check(snapshot3, "testValue2")
+	snapshot1.Release()
+	check(snapshot3, "testValue2")
+	snapshot3.Release()
+
+	if len(smn.m) != 1 {
+		t.Errorf("expected 1 node left after releasing all snapshots, got %d", len(smn.m))
+	}
+}
+
+// Test reading a snapshot while the tree is being updated.
+func TestSparseMerkleTreeSnapshotConcurrent(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 100; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	snapshot := smt.Snapshot()
+	root := snapshot.Root()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			s := strconv.Itoa(rand.Intn(100))
+			proof, err := snapshot.Prove([]byte(s))
+			if err != nil {
+				t.Errorf("error returned when trying to prove inclusion in snapshot: %v", err)
+				return
+			}
+			if !VerifyProof(proof, root, []byte(s), []byte(s), sha256.New()) {
+				t.Error("valid proof from snapshot failed to verify")
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		s := strconv.Itoa(rand.Intn(200))
+		smt.Update([]byte(s), []byte(strconv.Itoa(i)))
+	}
+	wg.Wait()
+	snapshot.Release()
+}
+
+// Test iterating over the leaves of trees in order.
+func TestSparseMerkleTreeIterate(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithExtensionNodes()}} {
+		smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+		kv := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			s := strconv.Itoa(i)
+			kv[string(smt.th.path([]byte(s)))] = s
+			smt.Update([]byte(s), []byte(s))
+		}
+		paths := make([]string, 0, len(kv))
+		for path := range kv {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		var i int
+		err := smt.Iterate(func(path []byte, value []byte) bool {
+			if string(path) != paths[i] || string(value) != kv[paths[i]] {
+				t.Error("did not iterate over the correct leaf")
+			}
+			i++
+			return i < 50
+		})
+		if err != nil {
+			t.Errorf("returned error when iterating tree: %v", err)
+		}
+		if i != 50 {
+			t.Errorf("expected iteration to stop after 50 leaves, got %d", i)
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package smt
+
+import (
+	"bytes"
+	"sort"
+)
+
+const (
+	// sortedMapDegree is the minimum number of children of the inner nodes
+	// of a SortedMap, other than the root.
+	sortedMapDegree   = 32
+	sortedMapMaxItems = 2*sortedMapDegree - 1
+	sortedMapMinItems = sortedMapDegree - 1
+
+	// sortedMapItemOverhead is the approximate memory used by an entry of a
+	// SortedMap besides its key and value.
+	sortedMapItemOverhead = 64
+)
+
+// SortedMap is an in-memory map whose keys are kept in order, in a B-tree. It
+// can be used in place of a SimpleMap, and its keys can be iterated over in
+// both directions. Snapshots of a SortedMap are taken in constant time.
+type SortedMap struct {
+	root   *sortedMapNode
+	cow    *sortedMapCow
+	length int
+	usage  int64
+}
+
+// sortedMapCow tells which SortedMap owns a node: nodes are shared between a
+// map and its snapshots, and copied before they are written to by a map that
+// does not own them.
+type sortedMapCow struct {
+	// A pointer to a zero-size value may equal any other.
+	_ byte
+}
+
+type sortedMapItem struct {
+	key, value []byte
+}
+
+type sortedMapNode struct {
+	items    []sortedMapItem
+	children []*sortedMapNode
+	cow      *sortedMapCow
+}
+
+// NewSortedMap creates a new empty SortedMap.
+func NewSortedMap() *SortedMap {
+	return &SortedMap{cow: &sortedMapCow{}}
+}
+
+// Get gets the value for a key.
+func (sm *SortedMap) Get(key []byte) ([]byte, error) {
+	for n := sm.root; n != nil; {
+		i, found := n.find(key)
+		if found {
+			return n.items[i].value, nil
+		}
+		if len(n.children) == 0 {
+			break
+		}
+		n = n.children[i]
+	}
+	return nil, &InvalidKeyError{Key: key}
+}
+
+// Set updates the value for a key. The key and value are copied.
+func (sm *SortedMap) Set(key []byte, value []byte) error {
+	item := sortedMapItem{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	}
+	if sm.root == nil {
+		sm.root = sm.newNode()
+		sm.root.items = append(sm.root.items, item)
+		sm.length++
+		sm.usage += itemUsage(item)
+		return nil
+	}
+
+	sm.root = sm.root.mutableFor(sm.cow)
+	if len(sm.root.items) >= sortedMapMaxItems {
+		middle, second := sm.root.split(sortedMapMaxItems / 2)
+		first := sm.root
+		sm.root = sm.newNode()
+		sm.root.items = append(sm.root.items, middle)
+		sm.root.children = append(sm.root.children, first, second)
+	}
+	old, replaced := sm.root.insert(item)
+	if replaced {
+		sm.usage -= itemUsage(old)
+	} else {
+		sm.length++
+	}
+	sm.usage += itemUsage(item)
+	return nil
+}
+
+// Delete deletes a key.
+func (sm *SortedMap) Delete(key []byte) error {
+	if sm.root == nil {
+		return &InvalidKeyError{Key: key}
+	}
+	sm.root = sm.root.mutableFor(sm.cow)
+	old, removed := sm.root.remove(key, false)
+	if len(sm.root.items) == 0 {
+		if len(sm.root.children) > 0 {
+			sm.root = sm.root.children[0]
+		} else {
+			sm.root = nil
+		}
+	}
+	if !removed {
+		return &InvalidKeyError{Key: key}
+	}
+	sm.length--
+	sm.usage -= itemUsage(old)
+	return nil
+}
+
+// Iterate calls fn with every key that starts with a prefix and its value, in
+// increasing order of key, until fn returns false. The keys and values must
+// not be modified.
+func (sm *SortedMap) Iterate(prefix []byte, fn func(key []byte, value []byte) bool) error {
+	return sm.IterateRange(prefix, prefixEnd(prefix), fn)
+}
+
+// IterateRange calls fn with every key from start, inclusive, to end,
+// exclusive, and its value, in increasing order of key, until fn returns false.
+// A nil start or end leaves the range unbounded on that side. The keys and
+// values must not be modified.
+func (sm *SortedMap) IterateRange(start, end []byte, fn func(key []byte, value []byte) bool) error {
+	if sm.root != nil {
+		sm.root.ascend(start, end, fn)
+	}
+	return nil
+}
+
+// ReverseIterateRange calls fn with every key from start, inclusive, to end,
+// exclusive, and its value, in decreasing order of key, until fn returns false.
+// See IterateRange.
+func (sm *SortedMap) ReverseIterateRange(start, end []byte, fn func(key []byte, value []byte) bool) error {
+	if sm.root != nil {
+		sm.root.descend(start, end, fn)
+	}
+	return nil
+}
+
+// Snapshot returns a copy of the map, in constant time. The map and the copy
+// share their nodes until either of them is written to, so the copy can be
+// read while the map is written to in another goroutine.
+func (sm *SortedMap) Snapshot() *SortedMap {
+	// Neither map owns the nodes anymore, so both copy them on write.
+	snapshot := &SortedMap{
+		root:   sm.root,
+		cow:    &sortedMapCow{},
+		length: sm.length,
+		usage:  sm.usage,
+	}
+	sm.cow = &sortedMapCow{}
+	return snapshot
+}
+
+// Len returns the number of keys in the map.
+func (sm *SortedMap) Len() int {
+	return sm.length
+}
+
+// MemoryUsage returns the approximate memory used by the keys and values of
+// the map. Nodes that are shared with snapshots are counted in full by each.
+func (sm *SortedMap) MemoryUsage() int64 {
+	return sm.usage
+}
+
+func (sm *SortedMap) newNode() *sortedMapNode {
+	return &sortedMapNode{cow: sm.cow}
+}
+
+func itemUsage(item sortedMapItem) int64 {
+	return int64(len(item.key)+len(item.value)) + sortedMapItemOverhead
+}
+
+// prefixEnd returns the smallest key greater than every key with a prefix, or
+// nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] != 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// find returns the index of the first item of the node whose key is not less
+// than a key, and whether it is equal.
+func (n *sortedMapNode) find(key []byte) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return bytes.Compare(n.items[i].key, key) >= 0
+	})
+	return i, i < len(n.items) && bytes.Equal(n.items[i].key, key)
+}
+
+// mutableFor returns the node if it is owned by cow, or a copy of it owned by
+// cow otherwise.
+func (n *sortedMapNode) mutableFor(cow *sortedMapCow) *sortedMapNode {
+	if n.cow == cow {
+		return n
+	}
+	c := &sortedMapNode{cow: cow}
+	c.items = append(make([]sortedMapItem, 0, sortedMapMaxItems), n.items...)
+	if len(n.children) > 0 {
+		c.children = append(make([]*sortedMapNode, 0, sortedMapMaxItems+1), n.children...)
+	}
+	return c
+}
+
+func (n *sortedMapNode) mutableChild(i int) *sortedMapNode {
+	c := n.children[i].mutableFor(n.cow)
+	n.children[i] = c
+	return c
+}
+
+// split splits the node at an item, and returns the item and a new node with
+// the items and children after it.
+func (n *sortedMapNode) split(i int) (sortedMapItem, *sortedMapNode) {
+	item := n.items[i]
+	next := &sortedMapNode{cow: n.cow}
+	next.items = append(next.items, n.items[i+1:]...)
+	n.items = n.items[:i]
+	if len(n.children) > 0 {
+		next.children = append(next.children, n.children[i+1:]...)
+		n.children = n.children[:i+1]
+	}
+	return item, next
+}
+
+// maybeSplitChild splits a child that is full, and returns whether it did.
+func (n *sortedMapNode) maybeSplitChild(i int) bool {
+	if len(n.children[i].items) < sortedMapMaxItems {
+		return false
+	}
+	first := n.mutableChild(i)
+	item, second := first.split(sortedMapMaxItems / 2)
+	n.items = append(n.items, sortedMapItem{})
+	copy(n.items[i+1:], n.items[i:])
+	n.items[i] = item
+	n.children = append(n.children, nil)
+	copy(n.children[i+2:], n.children[i+1:])
+	n.children[i+1] = second
+	return true
+}
+
+// insert inserts an item into the subtree of a node that is not full, and
+// returns the item it replaced, if any.
+func (n *sortedMapNode) insert(item sortedMapItem) (sortedMapItem, bool) {
+	i, found := n.find(item.key)
+	if found {
+		old := n.items[i]
+		n.items[i] = item
+		return old, true
+	}
+	if len(n.children) == 0 {
+		n.items = append(n.items, sortedMapItem{})
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = item
+		return sortedMapItem{}, false
+	}
+	if n.maybeSplitChild(i) {
+		switch c := bytes.Compare(item.key, n.items[i].key); {
+		case c > 0:
+			i++
+		case c == 0:
+			old := n.items[i]
+			n.items[i] = item
+			return old, true
+		}
+	}
+	return n.mutableChild(i).insert(item)
+}
+
+// remove removes the item with a key, or the greatest item if max is set,
+// from the subtree of a node, and returns it. Children are grown on the way
+// down, so that removing an item from them leaves them with enough items.
+func (n *sortedMapNode) remove(key []byte, max bool) (sortedMapItem, bool) {
+	var i int
+	var found bool
+	if max {
+		if len(n.children) == 0 {
+			item := n.items[len(n.items)-1]
+			n.items = n.items[:len(n.items)-1]
+			return item, true
+		}
+		i = len(n.items)
+	} else {
+		i, found = n.find(key)
+		if len(n.children) == 0 {
+			if !found {
+				return sortedMapItem{}, false
+			}
+			item := n.items[i]
+			n.items = append(n.items[:i], n.items[i+1:]...)
+			return item, true
+		}
+	}
+
+	if len(n.children[i].items) <= sortedMapMinItems {
+		n.growChild(i)
+		return n.remove(key, max)
+	}
+	child := n.mutableChild(i)
+	if found {
+		// The item is replaced with its predecessor.
+		item := n.items[i]
+		n.items[i], _ = child.remove(nil, true)
+		return item, true
+	}
+	return child.remove(key, max)
+}
+
+// growChild adds an item to a child with the fewest items, by taking one from
+// a sibling, or by merging it with a sibling.
+func (n *sortedMapNode) growChild(i int) {
+	switch {
+	case i > 0 && len(n.children[i-1].items) > sortedMapMinItems:
+		child, left := n.mutableChild(i), n.mutableChild(i-1)
+		child.items = append(child.items, sortedMapItem{})
+		copy(child.items[1:], child.items)
+		child.items[0] = n.items[i-1]
+		n.items[i-1] = left.items[len(left.items)-1]
+		left.items = left.items[:len(left.items)-1]
+		if len(left.children) > 0 {
+			child.children = append(child.children, nil)
+			copy(child.children[1:], child.children)
+			child.children[0] = left.children[len(left.children)-1]
+			left.children = left.children[:len(left.children)-1]
+		}
+	case i < len(n.items) && len(n.children[i+1].items) > sortedMapMinItems:
+		child, right := n.mutableChild(i), n.mutableChild(i+1)
+		child.items = append(child.items, n.items[i])
+		n.items[i] = right.items[0]
+		right.items = append(right.items[:0], right.items[1:]...)
+		if len(right.children) > 0 {
+			child.children = append(child.children, right.children[0])
+			right.children = append(right.children[:0], right.children[1:]...)
+		}
+	default:
+		if i >= len(n.items) {
+			i--
+		}
+		child := n.mutableChild(i)
+		right := n.children[i+1]
+		child.items = append(child.items, n.items[i])
+		child.items = append(child.items, right.items...)
+		child.children = append(child.children, right.children...)
+		n.items = append(n.items[:i], n.items[i+1:]...)
+		n.children = append(n.children[:i+1], n.children[i+2:]...)
+	}
+}
+
+// ascend calls fn with the items of the subtree of a node from start to end in
+// increasing order, and returns false if it stopped.
+func (n *sortedMapNode) ascend(start, end []byte, fn func(key []byte, value []byte) bool) bool {
+	i := 0
+	if start != nil {
+		i, _ = n.find(start)
+	}
+	for ; i < len(n.items); i++ {
+		if len(n.children) > 0 && !n.children[i].ascend(start, end, fn) {
+			return false
+		}
+		item := n.items[i]
+		if end != nil && bytes.Compare(item.key, end) >= 0 {
+			return false
+		}
+		if !fn(item.key, item.value) {
+			return false
+		}
+	}
+	if len(n.children) > 0 {
+		return n.children[len(n.children)-1].ascend(start, end, fn)
+	}
+	return true
+}
+
+// descend calls fn with the items of the subtree of a node from start to end
+// in decreasing order, and returns false if it stopped.
+func (n *sortedMapNode) descend(start, end []byte, fn func(key []byte, value []byte) bool) bool {
+	i := len(n.items)
+	if end != nil {
+		i, _ = n.find(end)
+	}
+	if len(n.children) > 0 && !n.children[i].descend(start, end, fn) {
+		return false
+	}
+	for i--; i >= 0; i-- {
+		item := n.items[i]
+		if start != nil && bytes.Compare(item.key, start) < 0 {
+			return false
+		}
+		if !fn(item.key, item.value) {
+			return false
+		}
+		if len(n.children) > 0 && !n.children[i].descend(start, end, fn) {
+			return false
+		}
+	}
+	return true
+}
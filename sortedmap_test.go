@@ -0,0 +1,196 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// Test that a SortedMap behaves like a SimpleMap under random operations, and
+// iterates over its keys in order.
+func TestSortedMap(t *testing.T) {
+	sm := NewSortedMap()
+	reference := NewSimpleMap()
+	r := rand.New(rand.NewSource(1))
+	var usage int64
+
+	for i := 0; i < 20000; i++ {
+		key := []byte(strconv.Itoa(r.Intn(3000)))
+		if r.Intn(3) == 0 {
+			err, referenceErr := sm.Delete(key), reference.Delete(key)
+			if (err == nil) != (referenceErr == nil) {
+				t.Fatalf("expected error %v when deleting key %s, got: %v", referenceErr, key, err)
+			}
+			var invalidKeyError *InvalidKeyError
+			if err != nil && (!errors.As(err, &invalidKeyError) || !bytes.Equal(key, invalidKeyError.Key)) {
+				t.Fatalf("expected InvalidKeyError when deleting missing key, got: %v", err)
+			}
+			continue
+		}
+		value := []byte(strconv.Itoa(r.Int()))
+		if err := sm.Set(key, value); err != nil {
+			t.Fatalf("returned error when setting key: %v", err)
+		}
+		reference.Set(key, value)
+	}
+
+	var keys []string
+	for key, value := range reference.m {
+		keys = append(keys, key)
+		usage += int64(len(key)+len(value)) + sortedMapItemOverhead
+		got, err := sm.Get([]byte(key))
+		if err != nil || !bytes.Equal(value, got) {
+			t.Errorf("did not get value of key %s", key)
+		}
+	}
+	sort.Strings(keys)
+	if sm.Len() != len(keys) {
+		t.Errorf("expected length %d, got %d", len(keys), sm.Len())
+	}
+	if sm.MemoryUsage() != usage {
+		t.Errorf("expected memory usage %d, got %d", usage, sm.MemoryUsage())
+	}
+	if _, err := sm.Get([]byte("missing")); err == nil {
+		t.Error("did not return an error when getting a non-existent key")
+	}
+
+	collect := func(iterate func(start, end []byte, fn func(key []byte, value []byte) bool) error, start, end []byte) []string {
+		var got []string
+		err := iterate(start, end, func(key []byte, value []byte) bool {
+			got = append(got, string(key))
+			return true
+		})
+		if err != nil {
+			t.Errorf("returned error when iterating: %v", err)
+		}
+		return got
+	}
+	bounds := [][2]string{{"", ""}, {"1", "2"}, {"15", "150"}, {"2999", ""}, {"", "100"}, {"5", "5"}, {"9", "1"}}
+	for _, b := range bounds {
+		var start, end []byte
+		if b[0] != "" {
+			start = []byte(b[0])
+		}
+		if b[1] != "" {
+			end = []byte(b[1])
+		}
+		var expected []string
+		for _, key := range keys {
+			if (start == nil || key >= b[0]) && (end == nil || key < b[1]) {
+				expected = append(expected, key)
+			}
+		}
+		if got := collect(sm.IterateRange, start, end); !reflect.DeepEqual(expected, got) {
+			t.Errorf("did not iterate over keys from %q to %q in order", b[0], b[1])
+		}
+		for i, j := 0, len(expected)-1; i < j; i, j = i+1, j-1 {
+			expected[i], expected[j] = expected[j], expected[i]
+		}
+		if got := collect(sm.ReverseIterateRange, start, end); !reflect.DeepEqual(expected, got) {
+			t.Errorf("did not iterate over keys from %q to %q in reverse order", b[0], b[1])
+		}
+	}
+
+	var prefixed []string
+	sm.Iterate([]byte("29"), func(key []byte, value []byte) bool {
+		prefixed = append(prefixed, string(key))
+		return len(prefixed) < 3
+	})
+	var expected []string
+	for _, key := range keys {
+		if len(expected) < 3 && len(key) >= 2 && key[:2] == "29" {
+			expected = append(expected, key)
+		}
+	}
+	if !reflect.DeepEqual(expected, prefixed) {
+		t.Errorf("did not iterate over keys with prefix until stopped, got %v", prefixed)
+	}
+
+	// Delete everything.
+	for _, key := range keys {
+		if err := sm.Delete([]byte(key)); err != nil {
+			t.Errorf("returned error when deleting key: %v", err)
+		}
+	}
+	if sm.Len() != 0 || sm.MemoryUsage() != 0 {
+		t.Error("did not empty map when deleting every key")
+	}
+}
+
+// Test that a snapshot and the map it was taken of do not see each other's
+// writes.
+func TestSortedMapSnapshot(t *testing.T) {
+	sm := NewSortedMap()
+	for i := 0; i < 1000; i++ {
+		sm.Set([]byte(strconv.Itoa(i)), []byte("old"))
+	}
+	snapshot := sm.Snapshot()
+	for i := 0; i < 1000; i += 2 {
+		sm.Delete([]byte(strconv.Itoa(i)))
+	}
+	sm.Set([]byte("1"), []byte("new"))
+	snapshot.Set([]byte("3"), []byte("snapshot"))
+	snapshot.Set([]byte("new"), []byte("snapshot"))
+
+	if snapshot.Len() != 1001 || sm.Len() != 500 {
+		t.Errorf("expected lengths 1001 and 500, got %d and %d", snapshot.Len(), sm.Len())
+	}
+	for i := 0; i < 1000; i++ {
+		key := []byte(strconv.Itoa(i))
+		value, err := snapshot.Get(key)
+		expected := []byte("old")
+		if i == 3 {
+			expected = []byte("snapshot")
+		}
+		if err != nil || !bytes.Equal(expected, value) {
+			t.Errorf("did not get value of key %d from snapshot", i)
+		}
+
+		value, err = sm.Get(key)
+		switch {
+		case i%2 == 0:
+			if err == nil {
+				t.Errorf("got deleted key %d from map", i)
+			}
+		case i == 1:
+			if !bytes.Equal([]byte("new"), value) {
+				t.Error("did not get new value from map")
+			}
+		default:
+			if !bytes.Equal([]byte("old"), value) {
+				t.Errorf("did not get value of key %d from map", i)
+			}
+		}
+	}
+	if _, err := sm.Get([]byte("new")); err == nil {
+		t.Error("got key set in snapshot from map")
+	}
+}
+
+// Test that a tree on SortedMaps has the same roots as a tree on SimpleMaps.
+func TestSortedMapTree(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	sorted := NewSparseMerkleTree(NewSortedMap(), NewSortedMap(), sha256.New())
+	for i := 0; i < 500; i++ {
+		key := []byte(strconv.Itoa(i % 100))
+		var err error
+		if i%7 == 0 {
+			_, err = sorted.Delete(key)
+			smt.Delete(key)
+		} else {
+			_, err = sorted.Update(key, []byte(strconv.Itoa(i)))
+			smt.Update(key, []byte(strconv.Itoa(i)))
+		}
+		if err != nil {
+			t.Errorf("returned error when updating tree: %v", err)
+		}
+		if !bytes.Equal(smt.Root(), sorted.Root()) {
+			t.Fatal("did not get same root from tree on SortedMaps")
+		}
+	}
+}
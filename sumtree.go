@@ -0,0 +1,198 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math"
+)
+
+// ErrSumOverflow is returned when an update would overflow the sum of a
+// SparseMerkleSumTree.
+var ErrSumOverflow = errors.New("sum overflow")
+
+// ErrInvalidSumValue is returned when a value stored for a sum tree is too
+// short to hold a weight.
+var ErrInvalidSumValue = errors.New("invalid sum tree value")
+
+// SparseMerkleSumTree is a Sparse Merkle sum tree. Every leaf carries a weight,
+// and every node commits to the sum of the weights of the leaves beneath it.
+type SparseMerkleSumTree struct {
+	smt *SparseMerkleTree
+}
+
+// NewSparseMerkleSumTree creates a new Sparse Merkle sum tree on an empty MapStore.
+func NewSparseMerkleSumTree(nodes, values MapStore, hasher hash.Hash, options ...Option) *SparseMerkleSumTree {
+	return &SparseMerkleSumTree{
+		smt: NewSparseMerkleTree(nodes, values, hasher, append([]Option{sumTree}, options...)...),
+	}
+}
+
+// ImportSparseMerkleSumTree imports a Sparse Merkle sum tree from a non-empty MapStore.
+func ImportSparseMerkleSumTree(nodes, values MapStore, hasher hash.Hash, root []byte, options ...Option) *SparseMerkleSumTree {
+	return &SparseMerkleSumTree{
+		smt: ImportSparseMerkleTree(nodes, values, hasher, root, append([]Option{sumTree}, options...)...),
+	}
+}
+
+func sumTree(smt *SparseMerkleTree) {
+	smt.th.setSumTree()
+}
+
+// Root gets the root of the tree.
+func (smst *SparseMerkleSumTree) Root() []byte {
+	return smst.smt.Root()
+}
+
+// SetRoot sets the root of the tree.
+func (smst *SparseMerkleSumTree) SetRoot(root []byte) {
+	smst.smt.SetRoot(root)
+}
+
+// Sum returns the sum of the weights of all leaves in the tree.
+func (smst *SparseMerkleSumTree) Sum() uint64 {
+	return smst.smt.th.sumOf(smst.Root())
+}
+
+// Get gets the value and weight of a key from the tree.
+func (smst *SparseMerkleSumTree) Get(key []byte) ([]byte, uint64, error) {
+	data, err := smst.smt.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.Equal(data, defaultValue) {
+		return defaultValue, 0, nil
+	}
+	value, weight, ok := decodeSumValue(data)
+	if !ok {
+		return nil, 0, ErrInvalidSumValue
+	}
+	return value, weight, nil
+}
+
+// GetForRoot gets the value and weight of a key from the tree at a specific
+// root.
+func (smst *SparseMerkleSumTree) GetForRoot(key []byte, root []byte) ([]byte, uint64, error) {
+	data, err := smst.smt.GetForRoot(key, root)
+	if err != nil {
+		return nil, 0, err
+	}
+	if bytes.Equal(data, defaultValue) {
+		return defaultValue, 0, nil
+	}
+	value, weight, ok := decodeSumValue(data)
+	if !ok {
+		return nil, 0, ErrInvalidSumValue
+	}
+	return value, weight, nil
+}
+
+// Has returns true if the value at the given key is non-default, false
+// otherwise.
+func (smst *SparseMerkleSumTree) Has(key []byte) (bool, error) {
+	return smst.smt.Has(key)
+}
+
+// Update sets a new value and weight for a key in the tree, and sets and
+// returns the new root of the tree. ErrSumOverflow is returned if the sum of
+// the tree would overflow.
+func (smst *SparseMerkleSumTree) Update(key []byte, value []byte, weight uint64) ([]byte, error) {
+	if bytes.Equal(value, defaultValue) {
+		return smst.Delete(key)
+	}
+
+	_, oldWeight, err := smst.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	// Every node's sum is bounded by the sum of the root, so it is enough to
+	// check the root for an overflow.
+	if smst.Sum()-oldWeight > math.MaxUint64-weight {
+		return nil, ErrSumOverflow
+	}
+
+	th := &smst.smt.th
+	newRoot, err := smst.smt.updateForRoot(th.path(key), encodeSumValue(value, weight), appendSum(th.digest(value), weight), smst.Root())
+	if err != nil {
+		return nil, err
+	}
+	smst.SetRoot(newRoot)
+	return newRoot, nil
+}
+
+// Delete deletes a value from tree. It returns the new root of the tree.
+func (smst *SparseMerkleSumTree) Delete(key []byte) ([]byte, error) {
+	return smst.smt.Delete(key)
+}
+
+// Prove generates a Merkle proof for a key against the current root.
+func (smst *SparseMerkleSumTree) Prove(key []byte) (SparseMerkleProof, error) {
+	return smst.smt.Prove(key)
+}
+
+// ProveForRoot generates a Merkle proof for a key, against a specific node.
+func (smst *SparseMerkleSumTree) ProveForRoot(key []byte, root []byte) (SparseMerkleProof, error) {
+	return smst.smt.ProveForRoot(key, root)
+}
+
+// ProveUpdatable generates an updatable Merkle proof for a key against the current root.
+func (smst *SparseMerkleSumTree) ProveUpdatable(key []byte) (SparseMerkleProof, error) {
+	return smst.smt.ProveUpdatable(key)
+}
+
+// ProveCompact generates a compacted Merkle proof for a key against the current root.
+func (smst *SparseMerkleSumTree) ProveCompact(key []byte) (SparseCompactMerkleProof, error) {
+	return smst.smt.ProveCompact(key)
+}
+
+// VerifySumProof verifies a Merkle proof for a key, value and weight in a
+// Sparse Merkle sum tree. Non-membership proofs must have a weight of 0.
+func VerifySumProof(proof SparseMerkleProof, root []byte, key []byte, value []byte, weight uint64, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, append([]Option{sumTree}, options...))
+	return verifySumProof(proof, root, key, value, weight, th)
+}
+
+// VerifyCompactSumProof verifies a compacted Merkle proof for a key, value
+// and weight in a Sparse Merkle sum tree.
+func VerifyCompactSumProof(proof SparseCompactMerkleProof, root []byte, key []byte, value []byte, weight uint64, hasher hash.Hash, options ...Option) bool {
+	th := treeHasherWithOptions(hasher, append([]Option{sumTree}, options...))
+	decompactedProof, err := decompactProof(proof, th)
+	if err != nil {
+		return false
+	}
+	return verifySumProof(decompactedProof, root, key, value, weight, th)
+}
+
+func verifySumProof(proof SparseMerkleProof, root []byte, key []byte, value []byte, weight uint64, th *treeHasher) bool {
+	if len(root) != th.nodeSize() {
+		return false
+	}
+
+	var valueHash []byte
+	if bytes.Equal(value, defaultValue) {
+		if weight != 0 {
+			return false
+		}
+	} else {
+		valueHash = appendSum(th.digest(value), weight)
+	}
+	result, _ := verifyProofWithUpdates(proof, root, th.path(key), valueHash, th)
+	return result
+}
+
+// encodeSumValue encodes a value and its weight for the value store.
+func encodeSumValue(value []byte, weight uint64) []byte {
+	data := make([]byte, 0, len(value)+sumSize)
+	data = append(data, value...)
+	return appendSum(data, weight)
+}
+
+// decodeSumValue decodes a value and its weight from the value store, and
+// returns false if the data is too short to hold a weight.
+func decodeSumValue(data []byte) ([]byte, uint64, bool) {
+	if len(data) < sumSize {
+		return nil, 0, false
+	}
+	return data[:len(data)-sumSize], binary.BigEndian.Uint64(data[len(data)-sumSize:]), true
+}
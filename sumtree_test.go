@@ -0,0 +1,268 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// Test base case sum tree operations with a few keys.
+func TestSparseMerkleSumTreeBasic(t *testing.T) {
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+
+	if smst.Sum() != 0 {
+		t.Errorf("expected empty tree sum of 0, got %d", smst.Sum())
+	}
+
+	_, err := smst.Update([]byte("testKey"), []byte("testValue"), 5)
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	_, err = smst.Update([]byte("testKey2"), []byte("testValue2"), 10)
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	_, err = smst.Update([]byte("foo"), []byte("testValue3"), 20)
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	if smst.Sum() != 35 {
+		t.Errorf("expected sum of 35, got %d", smst.Sum())
+	}
+
+	value, weight, err := smst.Get([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("returned error when getting non-empty key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue2"), value) || weight != 10 {
+		t.Error("did not get correct value and weight when getting non-empty key")
+	}
+
+	// Updating only the weight of a key must update the sum.
+	_, err = smst.Update([]byte("testKey2"), []byte("testValue2"), 1)
+	if err != nil {
+		t.Errorf("returned error when updating non-empty key: %v", err)
+	}
+	if smst.Sum() != 26 {
+		t.Errorf("expected sum of 26, got %d", smst.Sum())
+	}
+
+	_, err = smst.Delete([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when deleting key: %v", err)
+	}
+	if smst.Sum() != 21 {
+		t.Errorf("expected sum of 21, got %d", smst.Sum())
+	}
+	value, weight, err = smst.Get([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when getting deleted key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) || weight != 0 {
+		t.Error("did not get default value and weight when getting deleted key")
+	}
+
+	// Test that a tree can be imported from a MapStore.
+	smst2 := ImportSparseMerkleSumTree(smst.smt.nodes, smst.smt.values, sha256.New(), smst.Root())
+	if smst2.Sum() != 21 {
+		t.Errorf("expected imported sum of 21, got %d", smst2.Sum())
+	}
+	value, weight, err = smst2.Get([]byte("foo"))
+	if err != nil {
+		t.Errorf("returned error when getting non-empty key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue3"), value) || weight != 20 {
+		t.Error("did not get correct value and weight when getting non-empty key")
+	}
+}
+
+// Test that sum tree proofs commit to the weights.
+func TestSparseMerkleSumTreeProofs(t *testing.T) {
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+
+	smst.Update([]byte("testKey"), []byte("testValue"), 5)
+	smst.Update([]byte("testKey2"), []byte("testValue2"), 10)
+	root, _ := smst.Update([]byte("foo"), []byte("testValue3"), 20)
+
+	proof, err := smst.Prove([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("error returned when trying to prove inclusion: %v", err)
+	}
+	if !VerifySumProof(proof, root, []byte("testKey2"), []byte("testValue2"), 10, sha256.New()) {
+		t.Error("valid proof failed to verify")
+	}
+	if VerifySumProof(proof, root, []byte("testKey2"), []byte("testValue2"), 11, sha256.New()) {
+		t.Error("invalid proof verification returned true for wrong weight")
+	}
+	if VerifySumProof(proof, root, []byte("testKey2"), []byte("badValue"), 10, sha256.New()) {
+		t.Error("invalid proof verification returned true for wrong value")
+	}
+
+	// Tamper with the sum of a side node.
+	tampered := SparseMerkleProof{SideNodes: make([][]byte, len(proof.SideNodes))}
+	for i, node := range proof.SideNodes {
+		tampered.SideNodes[i] = append([]byte{}, node...)
+	}
+	tampered.SideNodes[0][len(tampered.SideNodes[0])-1]++
+	if VerifySumProof(tampered, root, []byte("testKey2"), []byte("testValue2"), 10, sha256.New()) {
+		t.Error("invalid proof verification returned true for tampered sum")
+	}
+
+	compactProof, err := smst.ProveCompact([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("error returned when trying to prove inclusion: %v", err)
+	}
+	if !VerifyCompactSumProof(compactProof, root, []byte("testKey2"), []byte("testValue2"), 10, sha256.New()) {
+		t.Error("valid compact proof failed to verify")
+	}
+
+	proof, err = smst.Prove([]byte("testKey3"))
+	if err != nil {
+		t.Errorf("error returned when trying to prove non-inclusion: %v", err)
+	}
+	if !VerifySumProof(proof, root, []byte("testKey3"), defaultValue, 0, sha256.New()) {
+		t.Error("valid non-membership proof failed to verify")
+	}
+	if VerifySumProof(proof, root, []byte("testKey3"), defaultValue, 1, sha256.New()) {
+		t.Error("non-membership proof with non-zero weight returned true")
+	}
+
+	proof, err = smst.ProveUpdatable([]byte("testKey"))
+	if err != nil {
+		t.Errorf("error returned when trying to prove inclusion: %v", err)
+	}
+	if !VerifySumProof(proof, root, []byte("testKey"), []byte("testValue"), 5, sha256.New()) {
+		t.Error("valid updatable proof failed to verify")
+	}
+}
+
+// Test that sum overflows are detected.
+func TestSparseMerkleSumTreeOverflow(t *testing.T) {
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+
+	_, err := smst.Update([]byte("testKey"), []byte("testValue"), math.MaxUint64-1)
+	if err != nil {
+		t.Errorf("returned error when updating empty key: %v", err)
+	}
+	root := smst.Root()
+	_, err = smst.Update([]byte("testKey2"), []byte("testValue2"), 2)
+	if !errors.Is(err, ErrSumOverflow) {
+		t.Errorf("expected ErrSumOverflow, got: %v", err)
+	}
+	if !bytes.Equal(root, smst.Root()) {
+		t.Error("root changed after overflowing update")
+	}
+	// Replacing the weight of an existing key is not an overflow.
+	_, err = smst.Update([]byte("testKey"), []byte("testValue"), math.MaxUint64)
+	if err != nil {
+		t.Errorf("returned error when updating non-empty key: %v", err)
+	}
+	if smst.Sum() != math.MaxUint64 {
+		t.Errorf("expected sum of %d, got %d", uint64(math.MaxUint64), smst.Sum())
+	}
+
+	// A proof whose side nodes overflow must not verify.
+	th := newTreeHasher(sha256.New())
+	th.setSumTree()
+	leafHash, _ := th.digestLeaf(th.path([]byte("testKey2")), appendSum(th.digest([]byte("testValue2")), 2))
+	sideNode, _ := th.digestLeaf(th.path([]byte("testKey")), appendSum(th.digest([]byte("testValue")), math.MaxUint64))
+	var forgedRoot []byte
+	if getBitAtFromMSB(th.path([]byte("testKey2")), 0) == right {
+		forgedRoot, _ = th.digestNode(sideNode, leafHash)
+	} else {
+		forgedRoot, _ = th.digestNode(leafHash, sideNode)
+	}
+	proof := SparseMerkleProof{SideNodes: [][]byte{sideNode}}
+	if VerifySumProof(proof, forgedRoot, []byte("testKey2"), []byte("testValue2"), 2, sha256.New()) {
+		t.Error("proof with overflowing sum returned true")
+	}
+}
+
+// Test that stored values too short to hold a weight are rejected.
+func TestSparseMerkleSumTreeShortValues(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smst := NewSparseMerkleSumTree(smn, smv, sha256.New())
+	for i := 0; i < 50; i++ {
+		s := strconv.Itoa(i)
+		smst.Update([]byte(s), []byte(s), uint64(i))
+	}
+	root := smst.Root()
+
+	// A short value in an export stream.
+	var buf bytes.Buffer
+	NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).Export(smst.smt.th.placeholder(), &buf)
+	stream := append([]byte(nil), buf.Bytes()[:buf.Len()-1]...)
+	stream = append(stream, exportLeaf)
+	stream = append(stream, make([]byte, sha256.Size)...)
+	stream = append(stream, 2, 'a', 'b', exportEnd)
+	if _, err := ImportSum(bytes.NewReader(stream), NewSimpleMap(), NewSimpleMap(), sha256.New()); !errors.Is(err, ErrInvalidExport) {
+		t.Errorf("expected ErrInvalidExport when importing short value, got: %v", err)
+	}
+
+	// A short value in a chunk.
+	var chunks []SparseMerkleChunk
+	smst.smt.ExportChunks(root, 500, func(chunk SparseMerkleChunk) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	chunk := chunks[0]
+	chunk.Values = append([][]byte(nil), chunk.Values...)
+	chunk.Values[0] = []byte("ab")
+	th := newTreeHasher(sha256.New())
+	th.setSumTree()
+	if verifyChunk(chunk, root, th) {
+		t.Error("verified chunk with short value")
+	}
+	restorer := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New()).smt.NewRestorer(root)
+	if _, err := restorer.Add(chunk); !errors.Is(err, ErrInvalidChunk) {
+		t.Errorf("expected ErrInvalidChunk when adding chunk with short value, got: %v", err)
+	}
+
+	// A short value in the value store.
+	smv.Set(smst.smt.th.path([]byte("1")), []byte("ab"))
+	if _, _, err := smst.Get([]byte("1")); !errors.Is(err, ErrInvalidSumValue) && !errors.Is(err, ErrValueNotFound) {
+		t.Errorf("expected error when getting short value, got: %v", err)
+	}
+}
+
+// Test sum tree operations in bulk against a map of weights.
+func TestSparseMerkleSumTreeBulk(t *testing.T) {
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	weights := make(map[string]uint64)
+
+	for i := 0; i < 200; i++ {
+		key := make([]byte, 1+rand.Intn(2))
+		rand.Read(key)
+		if rand.Intn(3) == 0 {
+			delete(weights, string(key))
+			if _, err := smst.Delete(key); err != nil {
+				t.Errorf("returned error when deleting key: %v", err)
+			}
+		} else {
+			weight := uint64(rand.Intn(1000))
+			weights[string(key)] = weight
+			if _, err := smst.Update(key, key, weight); err != nil {
+				t.Errorf("returned error when updating key: %v", err)
+			}
+		}
+
+		var sum uint64
+		for k, w := range weights {
+			sum += w
+			proof, err := smst.Prove([]byte(k))
+			if err != nil {
+				t.Errorf("error returned when trying to prove inclusion: %v", err)
+			}
+			if !VerifySumProof(proof, smst.Root(), []byte(k), []byte(k), w, sha256.New()) {
+				t.Error("valid proof failed to verify")
+			}
+		}
+		if smst.Sum() != sum {
+			t.Errorf("expected sum of %d, got %d", sum, smst.Sum())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package smt
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrTransactionClosed is returned when committing a transaction that was
+// already committed or rolled back.
+var ErrTransactionClosed = errors.New("transaction closed")
+
+// ErrTransactionConflict is returned when committing a transaction whose
+// parent tree was changed since the transaction began.
+var ErrTransactionConflict = errors.New("transaction conflict")
+
+// Transaction is a child tree whose changes are kept in an in-memory overlay
+// over the stores of its parent tree, until they are committed to the parent
+// or rolled back. Reads fall through to the parent for keys that were not
+// changed. Transactions nest: a transaction can begin its own transactions.
+type Transaction struct {
+	*SparseMerkleTree
+	parent        *SparseMerkleTree
+	baseRoot      []byte
+	nodes, values *overlayMapStore
+	closed        bool
+}
+
+// Begin begins a transaction on the tree. The tree must not be changed until
+// the transaction is committed or rolled back.
+func (smt *SparseMerkleTree) Begin() *Transaction {
+	nodes := newOverlayMapStore(smt.nodes)
+	values := newOverlayMapStore(smt.values)
+	return &Transaction{
+		SparseMerkleTree: &SparseMerkleTree{
+			th:               smt.th,
+			nodes:            nodes,
+			values:           values,
+			root:             smt.root,
+			keepHistory:      smt.keepHistory,
+			contentAddressed: smt.contentAddressed,
+			orphans:          newOrphans(smt.orphans),
+		},
+		parent:   smt,
+		baseRoot: smt.root,
+		nodes:    nodes,
+		values:   values,
+	}
+}
+
+// Commit writes the changes of the transaction to the stores of its parent
+// tree, and sets the root of the parent tree to the root of the transaction.
+// ErrTransactionConflict is returned if the root of the parent tree was
+// changed since the transaction began. If writing to the stores fails, the
+// transaction stays open, and committing it again writes the rest of its
+// changes.
+func (tx *Transaction) Commit() error {
+	if tx.closed {
+		return ErrTransactionClosed
+	}
+	if tx.parent.readOnly {
+		return ErrReadOnly
+	}
+	if !bytes.Equal(tx.parent.Root(), tx.baseRoot) {
+		return ErrTransactionConflict
+	}
+	// The stores of the parent may have been wrapped since the transaction
+	// began, such as by Snapshot, so the changes are written to its current
+	// stores.
+	tx.nodes.parent, tx.values.parent = tx.parent.nodes, tx.parent.values
+
+	if tx.parent.journal != nil {
+		if err := tx.parent.applyJournaled(tx.nodes, tx.values, tx.Root()); err != nil {
+			return err
+		}
+	} else {
+		if err := tx.nodes.flush(); err != nil {
+			return err
+		}
+		if err := tx.values.flush(); err != nil {
+			return err
+		}
+	}
+	for node, path := range tx.orphans {
+		tx.parent.orphans[node] = path
+	}
+	tx.parent.SetRoot(tx.Root())
+	tx.closed = true
+	return nil
+}
+
+// Rollback drops the changes of the transaction, and resets its root to the
+// root of the parent tree when the transaction began.
+func (tx *Transaction) Rollback() {
+	tx.closed = true
+	tx.nodes.reset()
+	tx.values.reset()
+	tx.orphans = newOrphans(tx.orphans)
+	tx.SetRoot(tx.baseRoot)
+}
+
+// newOrphans returns an empty set of orphans for a transaction on a tree with
+// a set of orphans, or nil if the tree is not versioned.
+func newOrphans(orphans map[string][]byte) map[string][]byte {
+	if orphans == nil {
+		return nil
+	}
+	return make(map[string][]byte)
+}
+
+// overlayMapStore is a MapStore that keeps changes to a parent MapStore in
+// memory, until they are flushed.
+type overlayMapStore struct {
+	parent  MapStore
+	sets    map[string][]byte
+	deletes map[string]struct{}
+}
+
+func newOverlayMapStore(parent MapStore) *overlayMapStore {
+	return &overlayMapStore{
+		parent:  parent,
+		sets:    make(map[string][]byte),
+		deletes: make(map[string]struct{}),
+	}
+}
+
+// Get gets the value for a key.
+func (om *overlayMapStore) Get(key []byte) ([]byte, error) {
+	if value, ok := om.sets[string(key)]; ok {
+		return value, nil
+	}
+	if _, ok := om.deletes[string(key)]; ok {
+		return nil, &InvalidKeyError{Key: key}
+	}
+	return om.parent.Get(key)
+}
+
+// Set updates the value for a key.
+func (om *overlayMapStore) Set(key []byte, value []byte) error {
+	delete(om.deletes, string(key))
+	om.sets[string(key)] = value
+	return nil
+}
+
+// Delete deletes a key.
+func (om *overlayMapStore) Delete(key []byte) error {
+	if _, ok := om.deletes[string(key)]; ok {
+		return &InvalidKeyError{Key: key}
+	}
+	_, set := om.sets[string(key)]
+	delete(om.sets, string(key))
+
+	// Only record the deletion if the parent has the key, so that flushing
+	// never deletes a missing key from the parent.
+	_, err := om.parent.Get(key)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) && set {
+			return nil
+		}
+		return err
+	}
+	om.deletes[string(key)] = struct{}{}
+	return nil
+}
+
+// flush writes the changes to the parent MapStore. Every change is dropped
+// once it is written, so that flushing again after an error writes only the
+// changes that were not written.
+func (om *overlayMapStore) flush() error {
+	for key := range om.deletes {
+		if err := om.parent.Delete([]byte(key)); err != nil {
+			return err
+		}
+		delete(om.deletes, key)
+	}
+	for key, value := range om.sets {
+		if err := om.parent.Set([]byte(key), value); err != nil {
+			return err
+		}
+		delete(om.sets, key)
+	}
+	return nil
+}
+
+// reset drops the changes.
+func (om *overlayMapStore) reset() {
+	om.sets = make(map[string][]byte)
+	om.deletes = make(map[string]struct{})
+}
@@ -0,0 +1,206 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Test that transactions only change their parent tree when committed.
+func TestTransactionCommitRollback(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	smt.Update([]byte("testKey2"), []byte("testValue2"))
+	root := smt.Root()
+	nodes, values := copySimpleMap(smn), copySimpleMap(smv)
+
+	tx := smt.Begin()
+	_, err := tx.Update([]byte("testKey"), []byte("testValue3"))
+	if err != nil {
+		t.Errorf("returned error when updating key in transaction: %v", err)
+	}
+	_, err = tx.Delete([]byte("testKey2"))
+	if err != nil {
+		t.Errorf("returned error when deleting key in transaction: %v", err)
+	}
+	_, err = tx.Update([]byte("testKey4"), []byte("testValue4"))
+	if err != nil {
+		t.Errorf("returned error when updating key in transaction: %v", err)
+	}
+
+	// Reads see the writes of the transaction, and fall through otherwise.
+	value, err := tx.Get([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when getting key in transaction: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue3"), value) {
+		t.Error("did not get correct value when getting key in transaction")
+	}
+	if has, _ := tx.Has([]byte("testKey2")); has {
+		t.Error("did not get 'false' when checking deleted key in transaction")
+	}
+
+	// The parent is unchanged until the transaction is committed.
+	if !bytes.Equal(root, smt.Root()) || !reflect.DeepEqual(nodes, smn.m) || !reflect.DeepEqual(values, smv.m) {
+		t.Error("parent tree changed before committing transaction")
+	}
+	value, _ = smt.Get([]byte("testKey"))
+	if !bytes.Equal([]byte("testValue"), value) {
+		t.Error("did not get old value from parent tree before committing transaction")
+	}
+
+	tx.Rollback()
+	if !bytes.Equal(root, smt.Root()) || !reflect.DeepEqual(nodes, smn.m) || !reflect.DeepEqual(values, smv.m) {
+		t.Error("parent tree changed after rolling back transaction")
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTransactionClosed) {
+		t.Errorf("expected ErrTransactionClosed when committing rolled back transaction, got: %v", err)
+	}
+
+	tx = smt.Begin()
+	tx.Update([]byte("testKey"), []byte("testValue3"))
+	tx.Delete([]byte("testKey2"))
+	tx.Update([]byte("testKey4"), []byte("testValue4"))
+	// A key that is added then deleted within the transaction.
+	tx.Update([]byte("testKey5"), []byte("testValue5"))
+	tx.Delete([]byte("testKey5"))
+	if err := tx.Commit(); err != nil {
+		t.Errorf("returned error when committing transaction: %v", err)
+	}
+	if !bytes.Equal(tx.Root(), smt.Root()) {
+		t.Error("parent tree root is not the transaction root after committing transaction")
+	}
+
+	// The parent must be the same as if the changes were made to it directly.
+	expected := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	expected.Update([]byte("testKey"), []byte("testValue3"))
+	expected.Update([]byte("testKey4"), []byte("testValue4"))
+	if !bytes.Equal(expected.Root(), smt.Root()) ||
+		!reflect.DeepEqual(expected.nodes.(*SimpleMap).m, smn.m) ||
+		!reflect.DeepEqual(expected.values.(*SimpleMap).m, smv.m) {
+		t.Error("parent tree differs from a tree with the same changes after committing transaction")
+	}
+}
+
+// Test nested transactions, and conflicts with changes to the parent tree.
+func TestTransactionNested(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(smn, smv, sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	nodes, values := copySimpleMap(smn), copySimpleMap(smv)
+
+	block := smt.Begin()
+	tx1 := block.Begin()
+	tx1.Update([]byte("testKey2"), []byte("testValue2"))
+	if err := tx1.Commit(); err != nil {
+		t.Errorf("returned error when committing nested transaction: %v", err)
+	}
+	tx2 := block.Begin()
+	tx2.Update([]byte("testKey3"), []byte("testValue3"))
+	tx2.Delete([]byte("testKey"))
+	tx2.Rollback()
+
+	value, _ := block.Get([]byte("testKey2"))
+	if !bytes.Equal([]byte("testValue2"), value) {
+		t.Error("did not get committed value from enclosing transaction")
+	}
+	if !reflect.DeepEqual(nodes, smn.m) || !reflect.DeepEqual(values, smv.m) {
+		t.Error("parent tree changed by nested transaction")
+	}
+
+	if err := block.Commit(); err != nil {
+		t.Errorf("returned error when committing transaction: %v", err)
+	}
+	expected := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	expected.Update([]byte("testKey"), []byte("testValue"))
+	expected.Update([]byte("testKey2"), []byte("testValue2"))
+	if !bytes.Equal(expected.Root(), smt.Root()) || !reflect.DeepEqual(expected.nodes.(*SimpleMap).m, smn.m) {
+		t.Error("parent tree differs from a tree with the same changes after committing nested transactions")
+	}
+
+	// A transaction cannot be committed if its parent changed meanwhile.
+	tx := smt.Begin()
+	tx.Update([]byte("testKey3"), []byte("testValue3"))
+	smt.Update([]byte("testKey4"), []byte("testValue4"))
+	if err := tx.Commit(); !errors.Is(err, ErrTransactionConflict) {
+		t.Errorf("expected ErrTransactionConflict when committing stale transaction, got: %v", err)
+	}
+}
+
+// Test that a transaction whose commit failed can be committed again.
+func TestTransactionCommitRetry(t *testing.T) {
+	writes := 0
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt := NewSparseMerkleTree(&crashingMapStore{MapStore: smn, writes: &writes}, &crashingMapStore{MapStore: smv, writes: &writes}, sha256.New())
+
+	tx := smt.Begin()
+	tx.Update([]byte("testKey"), []byte("testValue"))
+	tx.Update([]byte("testKey2"), []byte("testValue2"))
+	writes = 2
+	if err := tx.Commit(); !errors.Is(err, errCrash) {
+		t.Errorf("expected errCrash when committing transaction to failing stores, got: %v", err)
+	}
+	if !bytes.Equal(smt.th.placeholder(), smt.Root()) {
+		t.Error("parent tree root changed after failed commit")
+	}
+
+	writes = -1
+	if err := tx.Commit(); err != nil {
+		t.Errorf("returned error when committing transaction again: %v", err)
+	}
+	expected := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	expected.Update([]byte("testKey"), []byte("testValue"))
+	expected.Update([]byte("testKey2"), []byte("testValue2"))
+	if !bytes.Equal(expected.Root(), smt.Root()) ||
+		!reflect.DeepEqual(expected.nodes.(*SimpleMap).m, smn.m) ||
+		!reflect.DeepEqual(expected.values.(*SimpleMap).m, smv.m) {
+		t.Error("parent tree differs from a tree with the same changes after committing transaction again")
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTransactionClosed) {
+		t.Errorf("expected ErrTransactionClosed when committing committed transaction, got: %v", err)
+	}
+}
+
+// Test that snapshots taken while a transaction is open keep their contents
+// after it is committed.
+func TestTransactionSnapshot(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	smt.Update([]byte("testKey2"), []byte("testValue2"))
+
+	tx := smt.Begin()
+	snapshot := smt.Snapshot()
+	tx.Update([]byte("testKey"), []byte("testValue3"))
+	tx.Delete([]byte("testKey2"))
+	if err := tx.Commit(); err != nil {
+		t.Errorf("returned error when committing transaction: %v", err)
+	}
+
+	for key, expected := range map[string]string{"testKey": "testValue", "testKey2": "testValue2"} {
+		value, err := snapshot.Get([]byte(key))
+		if err != nil {
+			t.Errorf("returned error when getting key from snapshot: %v", err)
+		}
+		if !bytes.Equal([]byte(expected), value) {
+			t.Error("did not get old value from snapshot after committing transaction")
+		}
+		proof, err := snapshot.Prove([]byte(key))
+		if err != nil {
+			t.Errorf("returned error when proving key in snapshot: %v", err)
+		}
+		if !VerifyProof(proof, snapshot.Root(), []byte(key), []byte(expected), sha256.New()) {
+			t.Error("proof from snapshot failed to verify after committing transaction")
+		}
+	}
+}
+
+func copySimpleMap(sm *SimpleMap) map[string][]byte {
+	m := make(map[string][]byte, len(sm.m))
+	for k, v := range sm.m {
+		m[k] = v
+	}
+	return m
+}
@@ -2,44 +2,130 @@ package smt
 
 import (
 	"bytes"
+	"encoding/binary"
 	"hash"
+	"math"
+	"sync"
 )
 
 var leafPrefix = []byte{0}
 var nodePrefix = []byte{1}
+var extensionPrefix = []byte{2}
+var hexNodePrefix = []byte{3}
+
+// hexArity is the number of children of an inner node of a
+// SparseMerkleHexTree.
+const hexArity = 16
+
+// sumSize is the number of bytes used to encode a sum in a sum tree.
+const sumSize = 8
 
 type treeHasher struct {
 	hasher    hash.Hash
 	zeroValue []byte
+
+	// sumTree is set if every node commits to the sum of the weights of
+	// the leaves beneath it. Node hashes are then suffixed with that sum.
+	sumTree bool
+
+	// depthBits is the depth of the tree in bits, if it is shorter than the
+	// path size. Paths are then truncated to their first depthBits bits when
+	// placing leaves in the tree.
+	depthBits int
+
+	// extensions is set if chains of inner nodes with a placeholder sibling
+	// are collapsed into extension nodes.
+	extensions bool
+
+	// orderedKeys is set if keys are used as paths as they are, instead of
+	// being hashed, so that leaves are sorted by key.
+	orderedKeys bool
+
+	// namespaceSize is the size of the namespace that prefixes the path of
+	// every key, if any. The namespace of a key is its first namespaceSize
+	// bytes.
+	namespaceSize int
+
+	// mu guards the hasher if it is shared with snapshots that may be read
+	// from other goroutines.
+	mu *sync.Mutex
 }
 
 func newTreeHasher(hasher hash.Hash) *treeHasher {
 	th := treeHasher{hasher: hasher}
-	th.zeroValue = make([]byte, th.pathSize())
+	th.zeroValue = make([]byte, th.nodeSize())
 
 	return &th
 }
 
+func (th *treeHasher) setSumTree() {
+	th.sumTree = true
+	th.zeroValue = make([]byte, th.nodeSize())
+}
+
 func (th *treeHasher) digest(data []byte) []byte {
+	if th.mu != nil {
+		th.mu.Lock()
+		defer th.mu.Unlock()
+	}
 	th.hasher.Write(data)
 	sum := th.hasher.Sum(nil)
 	th.hasher.Reset()
 	return sum
 }
 
+// hasherID identifies the hasher by the size of its digests and its hash of no
+// data, which differ between hash functions even when they share a type.
+func (th *treeHasher) hasherID() []byte {
+	return append([]byte{byte(th.hasher.Size())}, th.digest(nil)...)
+}
+
 func (th *treeHasher) path(key []byte) []byte {
+	if th.orderedKeys {
+		return append([]byte(nil), key...)
+	}
+	if th.namespaceSize > 0 && len(key) >= th.namespaceSize {
+		path := make([]byte, 0, th.pathSize())
+		path = append(path, key[:th.namespaceSize]...)
+		return append(path, th.digest(key)...)
+	}
 	return th.digest(key)
 }
 
+// valueHash returns the data committed to by a leaf holding a value, or nil if
+// the value is the default value.
+func (th *treeHasher) valueHash(value []byte) []byte {
+	if bytes.Equal(value, defaultValue) {
+		return nil
+	}
+	return th.digest(value)
+}
+
+// storedValueHash returns the data committed to by a leaf from the value stored
+// for it, and false if the value is not a valid stored value.
+func (th *treeHasher) storedValueHash(value []byte) ([]byte, bool) {
+	if th.sumTree {
+		value, weight, ok := decodeSumValue(value)
+		if !ok {
+			return nil, false
+		}
+		return appendSum(th.digest(value), weight), true
+	}
+	return th.digest(value), true
+}
+
 func (th *treeHasher) digestLeaf(path []byte, leafData []byte) ([]byte, []byte) {
 	value := make([]byte, 0, len(leafPrefix)+len(path)+len(leafData))
 	value = append(value, leafPrefix...)
 	value = append(value, path...)
 	value = append(value, leafData...)
 
-	th.hasher.Write(value)
-	sum := th.hasher.Sum(nil)
-	th.hasher.Reset()
+	sum := th.digest(value)
+
+	if th.sumTree {
+		// The weight of the leaf is encoded at the end of its leaf data.
+		sum = append(sum, leafData[len(leafData)-sumSize:]...)
+	}
 
 	return sum, value
 }
@@ -58,21 +144,145 @@ func (th *treeHasher) digestNode(leftData []byte, rightData []byte) ([]byte, []b
 	value = append(value, leftData...)
 	value = append(value, rightData...)
 
-	th.hasher.Write(value)
-	sum := th.hasher.Sum(nil)
-	th.hasher.Reset()
+	sum := th.digest(value)
+
+	if th.sumTree {
+		sum = appendSum(sum, th.sumOf(leftData)+th.sumOf(rightData))
+	}
 
 	return sum, value
 }
 
 func (th *treeHasher) parseNode(data []byte) ([]byte, []byte) {
-	return data[len(nodePrefix) : th.pathSize()+len(nodePrefix)], data[len(nodePrefix)+th.pathSize():]
+	return data[len(nodePrefix) : th.nodeSize()+len(nodePrefix)], data[len(nodePrefix)+th.nodeSize():]
+}
+
+// digestExtension hashes an extension node that stands for the chain of inner
+// nodes from depth start to end along path, with only placeholder siblings,
+// above child at depth end.
+func (th *treeHasher) digestExtension(start int, end int, path []byte, child []byte) ([]byte, []byte) {
+	value := make([]byte, 0, th.extensionSize())
+	value = append(value, extensionPrefix...)
+	value = append(value, extensionBits(path, start, end, th.pathSize())...)
+	value = append(value, byte(start>>8), byte(start), byte(end>>8), byte(end))
+	value = append(value, child...)
+
+	sum := th.digest(value)
+
+	if th.sumTree {
+		sum = appendSum(sum, th.sumOf(child))
+	}
+
+	return sum, value
+}
+
+// digestHexNode hashes an inner node of a SparseMerkleHexTree from the hashes
+// of its children.
+func (th *treeHasher) digestHexNode(children [][]byte) ([]byte, []byte) {
+	value := make([]byte, 0, len(hexNodePrefix)+hexArity*th.nodeSize())
+	value = append(value, hexNodePrefix...)
+	for _, child := range children {
+		value = append(value, child...)
+	}
+
+	sum := th.digest(value)
+
+	return sum, value
+}
+
+// parseHexNode returns the hashes of the children of an inner node of a
+// SparseMerkleHexTree.
+func (th *treeHasher) parseHexNode(data []byte) [][]byte {
+	children := make([][]byte, hexArity)
+	for i := range children {
+		offset := len(hexNodePrefix) + i*th.nodeSize()
+		children[i] = data[offset : offset+th.nodeSize()]
+	}
+	return children
+}
+
+// parseExtension returns the start and end depths, the path bits and the
+// child of an extension node.
+func (th *treeHasher) parseExtension(data []byte) (int, int, []byte, []byte) {
+	offset := len(extensionPrefix)
+	path := data[offset : offset+th.pathSize()]
+	offset += th.pathSize()
+	start := int(data[offset])<<8 | int(data[offset+1])
+	end := int(data[offset+2])<<8 | int(data[offset+3])
+	return start, end, path, data[offset+4:]
+}
+
+func (th *treeHasher) isExtension(data []byte) bool {
+	return th.extensions && len(data) >= len(extensionPrefix) && bytes.Equal(data[:len(extensionPrefix)], extensionPrefix)
+}
+
+// extensionSize returns the size of the data of an extension node.
+func (th *treeHasher) extensionSize() int {
+	return len(extensionPrefix) + th.pathSize() + 4 + th.nodeSize()
+}
+
+// digestData returns the hash of a leaf, inner or extension node from its data.
+func (th *treeHasher) digestData(data []byte) []byte {
+	if th.isLeaf(data) {
+		path, leafData := th.parseLeaf(data)
+		hash, _ := th.digestLeaf(path, leafData)
+		return hash
+	}
+	if th.isExtension(data) {
+		start, end, path, child := th.parseExtension(data)
+		hash, _ := th.digestExtension(start, end, path, child)
+		return hash
+	}
+	leftNode, rightNode := th.parseNode(data)
+	hash, _ := th.digestNode(leftNode, rightNode)
+	return hash
+}
+
+// sumOf returns the sum committed to by a node hash in a sum tree.
+func (th *treeHasher) sumOf(node []byte) uint64 {
+	if !th.sumTree {
+		return 0
+	}
+	return binary.BigEndian.Uint64(node[len(node)-sumSize:])
+}
+
+// sumOverflows returns true if the sum of two node hashes overflows.
+func (th *treeHasher) sumOverflows(leftNode []byte, rightNode []byte) bool {
+	return th.sumTree && th.sumOf(leftNode) > math.MaxUint64-th.sumOf(rightNode)
 }
 
 func (th *treeHasher) pathSize() int {
+	return th.namespaceSize + th.hasher.Size()
+}
+
+// depth returns the depth of the tree in bits.
+func (th *treeHasher) depth() int {
+	if th.depthBits != 0 {
+		return th.depthBits
+	}
+	return th.pathSize() * 8
+}
+
+// nodeSize returns the size of a node hash.
+func (th *treeHasher) nodeSize() int {
+	if th.sumTree {
+		return th.hasher.Size() + sumSize
+	}
 	return th.hasher.Size()
 }
 
+// leafDataSize returns the size of the data committed to by a leaf, excluding
+// its path.
+func (th *treeHasher) leafDataSize() int {
+	return th.nodeSize()
+}
+
 func (th *treeHasher) placeholder() []byte {
 	return th.zeroValue
 }
+
+func appendSum(data []byte, sum uint64) []byte {
+	var b [sumSize]byte
+	binary.BigEndian.PutUint64(b[:], sum)
+	return append(data, b[:]...)
+}
@@ -8,6 +8,15 @@ func getBitAtFromMSB(data []byte, position int) int {
 	return 0
 }
 
+// getNibbleAtFromMSB gets the 4-bit nibble at an offset from the most
+// significant nibble
+func getNibbleAtFromMSB(data []byte, position int) int {
+	if position%2 == 0 {
+		return int(data[position/2] >> 4)
+	}
+	return int(data[position/2] & 0x0f)
+}
+
 // setBitAtFromMSB sets the bit at an offset from the most significant bit
 func setBitAtFromMSB(data []byte, position int) {
 	n := int(data[position/8])
@@ -37,6 +46,46 @@ func countCommonPrefix(data1 []byte, data2 []byte) int {
 	return count
 }
 
+// comparePrefix compares the first n bits of two byte slices, from the most
+// significant bit.
+func comparePrefix(data1 []byte, data2 []byte, n int) int {
+	for i := 0; i < n; i++ {
+		if bit1, bit2 := getBitAtFromMSB(data1, i), getBitAtFromMSB(data2, i); bit1 != bit2 {
+			return bit1 - bit2
+		}
+	}
+	return 0
+}
+
+// extensionBits returns a copy of the bits of path from start to end, with all
+// other bits unset.
+func extensionBits(path []byte, start int, end int, size int) []byte {
+	bits := make([]byte, size)
+	for i := start; i < end; i++ {
+		if getBitAtFromMSB(path, i) == 1 {
+			setBitAtFromMSB(bits, i)
+		}
+	}
+	return bits
+}
+
+// countCommonBits counts the bits of two paths that match from start, up to end.
+func countCommonBits(data1 []byte, data2 []byte, start int, end int) int {
+	count := 0
+	for i := start; i < end; i++ {
+		if getBitAtFromMSB(data1, i) != getBitAtFromMSB(data2, i) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// flipBitAtFromMSB flips the bit at an offset from the most significant bit
+func flipBitAtFromMSB(data []byte, position int) {
+	data[position/8] ^= 1 << (8 - 1 - uint(position)%8)
+}
+
 func emptyBytes(length int) []byte {
 	b := make([]byte, length)
 	return b
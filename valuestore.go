@@ -0,0 +1,137 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// refCountSize is the size of the reference count that prefixes every value
+// record in a content-addressed value store.
+const refCountSize = 8
+
+// storeValue stores the value of a path whose leaf commits to a value hash.
+func (smt *SparseMerkleTree) storeValue(path []byte, value []byte, valueHash []byte) error {
+	if smt.contentAddressed {
+		return smt.retainValue(valueHash, value)
+	}
+	if err := smt.values.Set(path, value); err != nil {
+		return err
+	}
+	if smt.keepHistory || smt.orphans != nil {
+		return smt.values.Set(historyKey(path, valueHash), value)
+	}
+	return nil
+}
+
+// removeValue removes the value of a path whose leaf committed to a value
+// hash.
+func (smt *SparseMerkleTree) removeValue(path []byte, valueHash []byte) error {
+	if smt.contentAddressed {
+		if smt.keepHistory || smt.orphans != nil {
+			// Older roots may still reference the value. The leaves of
+			// versioned trees release their values when they are pruned.
+			return nil
+		}
+		return smt.releaseValue(valueHash)
+	}
+	return smt.values.Delete(path)
+}
+
+// leafValue gets the value of a path whose leaf commits to a value hash, in the
+// current tree.
+func (smt *SparseMerkleTree) leafValue(path []byte, valueHash []byte) ([]byte, error) {
+	if smt.contentAddressed || smt.meta != nil {
+		return smt.valueForHash(path, valueHash)
+	}
+	return smt.values.Get(path)
+}
+
+// contentValue gets the value with a value hash from a content-addressed value
+// store.
+func (smt *SparseMerkleTree) contentValue(valueHash []byte) ([]byte, error) {
+	record, err := smt.values.Get(valueHash)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			return nil, ErrValueNotFound
+		}
+		return nil, err
+	}
+	_, value := decodeValueRecord(record)
+	return value, nil
+}
+
+// retainValue adds a reference to the value with a value hash, storing the
+// value if it has no references yet.
+func (smt *SparseMerkleTree) retainValue(valueHash []byte, value []byte) error {
+	var refs uint64
+	record, err := smt.values.Get(valueHash)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if !errors.As(err, &invalidKeyError) {
+			return err
+		}
+	} else {
+		refs, _ = decodeValueRecord(record)
+	}
+	return smt.values.Set(valueHash, encodeValueRecord(refs+1, value))
+}
+
+// releaseValue drops a reference to the value with a value hash, deleting the
+// value when no references are left.
+func (smt *SparseMerkleTree) releaseValue(valueHash []byte) error {
+	record, err := smt.values.Get(valueHash)
+	if err != nil {
+		return err
+	}
+	refs, value := decodeValueRecord(record)
+	if refs <= 1 {
+		return smt.values.Delete(valueHash)
+	}
+	return smt.values.Set(valueHash, encodeValueRecord(refs-1, value))
+}
+
+func encodeValueRecord(refs uint64, value []byte) []byte {
+	record := make([]byte, refCountSize+len(value))
+	binary.BigEndian.PutUint64(record, refs)
+	copy(record[refCountSize:], value)
+	return record
+}
+
+func decodeValueRecord(record []byte) (uint64, []byte) {
+	return binary.BigEndian.Uint64(record[:refCountSize]), record[refCountSize:]
+}
+
+// historyKey returns the key of the value of a path with a value hash, in the
+// value store of a tree with history.
+func historyKey(path []byte, valueHash []byte) []byte {
+	key := make([]byte, 0, len(path)+len(valueHash))
+	key = append(key, path...)
+	return append(key, valueHash...)
+}
+
+// MigrateToContentAddressedValues copies the values of the tree at a root from
+// a value store keyed by path to a value store keyed by value hash, as used by
+// trees created with WithContentAddressedValues. The tree can then be imported
+// with the nodes and the new value store. The new value store must be empty,
+// and distinct from the old one; if the migration fails, it must be restarted
+// with an empty store.
+func MigrateToContentAddressedValues(nodes, from, to MapStore, hasher hash.Hash, root []byte, options ...Option) error {
+	src := ImportSparseMerkleTree(nodes, from, hasher, root, options...)
+	src.contentAddressed = false
+	dst := ImportSparseMerkleTree(nodes, to, hasher, root, options...)
+	dst.contentAddressed = true
+
+	pathSize := src.th.pathSize()
+	start := make([]byte, pathSize)
+	end := bytes.Repeat([]byte{0xff}, pathSize)
+	return src.rangeLeaves(root, 0, make([]byte, pathSize), start, end, func(path []byte, valueHash []byte) error {
+		value, err := from.Get(path)
+		if err != nil {
+			return err
+		}
+		return dst.retainValue(valueHash, value)
+	})
+}
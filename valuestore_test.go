@@ -0,0 +1,176 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// Test that content-addressed values are stored once and counted.
+func TestSparseMerkleTreeContentAddressedValues(t *testing.T) {
+	smv := NewSimpleMap()
+	smt := NewSparseMerkleTree(NewSimpleMap(), smv, sha256.New(), WithContentAddressedValues())
+	for i := 0; i < 10; i++ {
+		smt.Update([]byte(strconv.Itoa(i)), []byte("testValue"))
+	}
+	smt.Update([]byte("otherKey"), []byte("otherValue"))
+
+	if len(smv.m) != 2 {
+		t.Errorf("expected 2 values in store, got %d", len(smv.m))
+	}
+	record, err := smv.Get(smt.th.valueHash([]byte("testValue")))
+	if err != nil {
+		t.Errorf("returned error when getting value record: %v", err)
+	}
+	if refs, value := decodeValueRecord(record); refs != 10 || !bytes.Equal([]byte("testValue"), value) {
+		t.Errorf("expected 10 references to value, got %d", refs)
+	}
+
+	for i := 0; i < 10; i++ {
+		value, err := smt.Get([]byte(strconv.Itoa(i)))
+		if err != nil {
+			t.Errorf("returned error when getting key: %v", err)
+		}
+		if !bytes.Equal([]byte("testValue"), value) {
+			t.Error("did not get correct value when getting key")
+		}
+	}
+	value, err := smt.Get([]byte("missingKey"))
+	if err != nil {
+		t.Errorf("returned error when getting missing key: %v", err)
+	}
+	if !bytes.Equal(defaultValue, value) {
+		t.Error("did not get default value when getting missing key")
+	}
+
+	// Values are deleted once no leaf references them.
+	for i := 0; i < 9; i++ {
+		smt.Update([]byte(strconv.Itoa(i)), []byte("newValue"+strconv.Itoa(i%3)))
+	}
+	smt.Delete([]byte("otherKey"))
+	if len(smv.m) != 4 {
+		t.Errorf("expected 4 values in store, got %d", len(smv.m))
+	}
+	smt.Delete([]byte("9"))
+	if _, err := smv.Get(smt.th.valueHash([]byte("testValue"))); err == nil {
+		t.Error("did not delete value without references")
+	}
+
+	expected := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 9; i++ {
+		expected.Update([]byte(strconv.Itoa(i)), []byte("newValue"+strconv.Itoa(i%3)))
+	}
+	if !bytes.Equal(expected.Root(), smt.Root()) {
+		t.Error("root differs from a tree with values stored by path")
+	}
+	var count int
+	err = smt.Iterate(func(path []byte, value []byte) bool {
+		count++
+		return true
+	})
+	if err != nil {
+		t.Errorf("returned error when iterating tree: %v", err)
+	}
+	if count != 9 {
+		t.Errorf("expected 9 leaves, got %d", count)
+	}
+}
+
+// Test reading content-addressed values at older roots.
+func TestSparseMerkleTreeContentAddressedValuesHistory(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithContentAddressedValues(), WithHistory())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	oldRoot := smt.Root()
+	smt.Update([]byte("testKey"), []byte("testValue2"))
+
+	value, err := smt.GetForRoot([]byte("testKey"), oldRoot)
+	if err != nil {
+		t.Errorf("returned error when getting key at older root: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue"), value) {
+		t.Error("did not get value of older root when getting key at older root")
+	}
+
+	// Without history, replaced values are deleted.
+	smt = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), WithContentAddressedValues())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	snapshot := smt.Snapshot()
+	oldRoot = smt.Root()
+	smt.Update([]byte("testKey"), []byte("testValue2"))
+	if _, err := smt.GetForRoot([]byte("testKey"), oldRoot); !errors.Is(err, ErrValueNotFound) {
+		t.Errorf("expected ErrValueNotFound when getting replaced value, got: %v", err)
+	}
+	value, err = snapshot.Get([]byte("testKey"))
+	if err != nil {
+		t.Errorf("returned error when getting key from snapshot: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue"), value) {
+		t.Error("did not get old value when getting key from snapshot")
+	}
+	snapshot.Release()
+}
+
+// Test content-addressed values in a sum tree.
+func TestSparseMerkleSumTreeContentAddressedValues(t *testing.T) {
+	smv := NewSimpleMap()
+	smst := NewSparseMerkleSumTree(NewSimpleMap(), smv, sha256.New(), WithContentAddressedValues())
+	smst.Update([]byte("testKey"), []byte("testValue"), 5)
+	smst.Update([]byte("otherKey"), []byte("testValue"), 5)
+	smst.Update([]byte("thirdKey"), []byte("testValue"), 6)
+	if len(smv.m) != 2 {
+		t.Errorf("expected 2 values in store, got %d", len(smv.m))
+	}
+
+	value, weight, err := smst.Get([]byte("thirdKey"))
+	if err != nil {
+		t.Errorf("returned error when getting key: %v", err)
+	}
+	if !bytes.Equal([]byte("testValue"), value) || weight != 6 {
+		t.Error("did not get correct value and weight when getting key")
+	}
+}
+
+// Test migrating values stored by path to content-addressed values.
+func TestMigrateToContentAddressedValues(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithExtensionNodes()}} {
+		smn := NewSimpleMap()
+		smt := NewSparseMerkleTree(smn, NewSimpleMap(), sha256.New(), options...)
+		for i := 0; i < 50; i++ {
+			s := strconv.Itoa(i)
+			smt.Update([]byte(s), []byte(strconv.Itoa(i%5)))
+		}
+
+		smv := NewSimpleMap()
+		err := MigrateToContentAddressedValues(smn, smt.values, smv, sha256.New(), smt.Root(), options...)
+		if err != nil {
+			t.Errorf("returned error when migrating values: %v", err)
+		}
+		if len(smv.m) != 5 {
+			t.Errorf("expected 5 values in store after migration, got %d", len(smv.m))
+		}
+
+		migrated := ImportSparseMerkleTree(smn, smv, sha256.New(), smt.Root(), append(options, WithContentAddressedValues())...)
+		for i := 0; i < 50; i++ {
+			s := strconv.Itoa(i)
+			value, err := migrated.Get([]byte(s))
+			if err != nil {
+				t.Errorf("returned error when getting key from migrated tree: %v", err)
+			}
+			if !bytes.Equal([]byte(strconv.Itoa(i%5)), value) {
+				t.Error("did not get correct value when getting key from migrated tree")
+			}
+		}
+
+		// The reference counts carry on after migration.
+		for i := 0; i < 50; i++ {
+			if i%5 == 0 {
+				migrated.Delete([]byte(strconv.Itoa(i)))
+			}
+		}
+		if len(smv.m) != 4 {
+			t.Errorf("expected 4 values in store, got %d", len(smv.m))
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+var updateVectors = flag.Bool("update", false, "regenerate the test vectors in testdata/vectors.json")
+
+const vectorsFile = "testdata/vectors.json"
+
+// hexBytes is a byte slice that is encoded in JSON as a hex string.
+type hexBytes []byte
+
+func (h hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(h)), nil
+}
+
+func (h *hexBytes) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	*h = b
+	return err
+}
+
+// orNil returns nil for an empty slice, as proofs leave their missing fields
+// nil.
+func (h hexBytes) orNil() []byte {
+	if len(h) == 0 {
+		return nil
+	}
+	return h
+}
+
+// vectorFile is the file of test vectors for other implementations of trees
+// and verifiers. Every hash is SHA-256.
+type vectorFile struct {
+	Description string   `json:"description"`
+	Vectors     []vector `json:"vectors"`
+}
+
+// vector is a test vector: a tree built with a sequence of updates, its root,
+// and proofs of keys against the root.
+type vector struct {
+	Name string `json:"name"`
+	// OrderedKeys is set if the tree uses keys as paths, without hashing
+	// them. See WithOrderedKeys.
+	OrderedKeys bool `json:"orderedKeys,omitempty"`
+	// Updates are applied to an empty tree in order. An empty value
+	// deletes a key.
+	Updates []vectorUpdate `json:"updates"`
+	Root    hexBytes       `json:"root"`
+	Proofs  []vectorProof  `json:"proofs"`
+}
+
+type vectorUpdate struct {
+	Key   hexBytes `json:"key"`
+	Value hexBytes `json:"value"`
+}
+
+// vectorProof is a proof of the value of a key, which is empty for a
+// non-membership proof.
+type vectorProof struct {
+	Key          hexBytes           `json:"key"`
+	Value        hexBytes           `json:"value"`
+	Updatable    bool               `json:"updatable,omitempty"`
+	Proof        vectorMerkleProof  `json:"proof"`
+	CompactProof vectorCompactProof `json:"compactProof"`
+}
+
+type vectorMerkleProof struct {
+	SideNodes             []hexBytes `json:"sideNodes"`
+	NonMembershipLeafData hexBytes   `json:"nonMembershipLeafData"`
+	SiblingData           hexBytes   `json:"siblingData"`
+}
+
+type vectorCompactProof struct {
+	SideNodes             []hexBytes `json:"sideNodes"`
+	NonMembershipLeafData hexBytes   `json:"nonMembershipLeafData"`
+	BitMask               hexBytes   `json:"bitMask"`
+	NumSideNodes          int        `json:"numSideNodes"`
+	SiblingData           hexBytes   `json:"siblingData"`
+}
+
+func (v *vector) options() []Option {
+	if v.OrderedKeys {
+		return []Option{WithOrderedKeys()}
+	}
+	return nil
+}
+
+func (p *vectorMerkleProof) proof() SparseMerkleProof {
+	proof := SparseMerkleProof{
+		NonMembershipLeafData: p.NonMembershipLeafData.orNil(),
+		SiblingData:           p.SiblingData.orNil(),
+	}
+	for _, sideNode := range p.SideNodes {
+		proof.SideNodes = append(proof.SideNodes, sideNode)
+	}
+	return proof
+}
+
+func (p *vectorCompactProof) proof() SparseCompactMerkleProof {
+	proof := SparseCompactMerkleProof{
+		NonMembershipLeafData: p.NonMembershipLeafData.orNil(),
+		BitMask:               p.BitMask,
+		NumSideNodes:          p.NumSideNodes,
+		SiblingData:           p.SiblingData.orNil(),
+	}
+	for _, sideNode := range p.SideNodes {
+		proof.SideNodes = append(proof.SideNodes, sideNode)
+	}
+	return proof
+}
+
+// Test that the test vectors verify, and that they are still the ones that
+// the tree generates. Run with -update to regenerate them.
+func TestVectors(t *testing.T) {
+	generated := generateVectors(t)
+	if *updateVectors {
+		data, err := json.MarshalIndent(generated, "", "  ")
+		if err != nil {
+			t.Fatalf("returned error when encoding vectors: %v", err)
+		}
+		if err := ioutil.WriteFile(vectorsFile, append(data, '\n'), 0644); err != nil {
+			t.Fatalf("returned error when writing vectors: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(vectorsFile)
+	if err != nil {
+		t.Fatalf("returned error when reading vectors: %v", err)
+	}
+	var file vectorFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("returned error when decoding vectors: %v", err)
+	}
+	// Compare the encodings, so that empty and nil slices are the same.
+	generatedData, _ := json.Marshal(generated)
+	fileData, _ := json.Marshal(file)
+	if !bytes.Equal(generatedData, fileData) {
+		t.Error("generated vectors differ from checked-in vectors; run with -update if the change is intended")
+	}
+
+	for _, v := range file.Vectors {
+		for _, p := range v.Proofs {
+			proof := p.Proof.proof()
+			if !VerifyProof(proof, v.Root, p.Key, p.Value, sha256.New(), v.options()...) {
+				t.Errorf("proof of key %x of vector %q failed to verify", []byte(p.Key), v.Name)
+			}
+			if !VerifyCompactProof(p.CompactProof.proof(), v.Root, p.Key, p.Value, sha256.New(), v.options()...) {
+				t.Errorf("compact proof of key %x of vector %q failed to verify", []byte(p.Key), v.Name)
+			}
+			if VerifyProof(proof, v.Root, p.Key, append(p.Value, 0), sha256.New(), v.options()...) {
+				t.Errorf("proof of key %x of vector %q verified with wrong value", []byte(p.Key), v.Name)
+			}
+		}
+	}
+}
+
+// generateVectors generates the test vectors.
+func generateVectors(t *testing.T) vectorFile {
+	file := vectorFile{
+		Description: "Test vectors for sparse Merkle trees, generated by TestVectors in github.com/celestiaorg/smt. " +
+			"Every hash is SHA-256. Paths are the hashes of keys, or the keys themselves if orderedKeys is set. " +
+			"Leaves hash 0x00 || path || hash(value), inner nodes hash 0x01 || left || right, and empty subtrees are 32 zero bytes. " +
+			"Side nodes of proofs are ordered from the bottom of the tree.",
+	}
+	add := func(name string, orderedKeys bool, updates []vectorUpdate, prove func(tree *SparseMerkleTree, options []Option) []vectorProof) {
+		v := vector{Name: name, OrderedKeys: orderedKeys, Updates: updates}
+		tree := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), v.options()...)
+		for _, u := range updates {
+			if _, err := tree.Update(u.Key, u.Value); err != nil {
+				t.Fatalf("returned error when updating tree of vector %q: %v", name, err)
+			}
+		}
+		v.Root = tree.Root()
+		v.Proofs = prove(tree, v.options())
+		file.Vectors = append(file.Vectors, v)
+	}
+	prove := func(updatable bool, keys ...[]byte) func(tree *SparseMerkleTree, options []Option) []vectorProof {
+		return func(tree *SparseMerkleTree, options []Option) []vectorProof {
+			var proofs []vectorProof
+			for _, key := range keys {
+				proofs = append(proofs, generateVectorProof(t, tree, key, updatable, options))
+			}
+			return proofs
+		}
+	}
+	set := func(keys ...string) []vectorUpdate {
+		var updates []vectorUpdate
+		for _, key := range keys {
+			updates = append(updates, vectorUpdate{Key: []byte(key), Value: []byte("value-" + key)})
+		}
+		return updates
+	}
+
+	add("empty tree", false, []vectorUpdate{}, prove(false, []byte("key")))
+	add("single leaf", false, set("key"), prove(false, []byte("key"), []byte("otherKey")))
+
+	// Two keys that only differ in their last bit are leaves at the bottom
+	// of the tree.
+	key1, key2 := make([]byte, sha256.Size), make([]byte, sha256.Size)
+	key2[sha256.Size-1] = 1
+	add("max height", true, []vectorUpdate{{Key: key1, Value: []byte("value1")}, {Key: key2, Value: []byte("value2")}},
+		prove(false, key1, key2))
+
+	// Deleting keys bubbles up the leaves of their siblings.
+	keys := []string{"key0", "key1", "key2", "key3", "key4", "key5", "key6", "key7"}
+	updates := set(keys...)
+	for _, key := range []string{"key1", "key4", "key6"} {
+		updates = append(updates, vectorUpdate{Key: []byte(key)})
+	}
+	add("deletions", false, updates, prove(false, []byte("key0"), []byte("key1"), []byte("key2"), []byte("key7")))
+
+	// Find keys whose paths end at a leaf and at a placeholder.
+	tree := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for _, u := range set(keys...) {
+		tree.Update(u.Key, u.Value)
+	}
+	var unrelatedLeaf, placeholder []byte
+	for i := 0; unrelatedLeaf == nil || placeholder == nil; i++ {
+		key := []byte("absentKey" + strconv.Itoa(i))
+		proof, _ := tree.Prove(key)
+		if proof.NonMembershipLeafData != nil && unrelatedLeaf == nil {
+			unrelatedLeaf = key
+		}
+		if proof.NonMembershipLeafData == nil && placeholder == nil {
+			placeholder = key
+		}
+	}
+	add("non-membership", false, set(keys...), prove(false, unrelatedLeaf, placeholder))
+
+	add("updatable proofs", false, set(keys...), prove(true, []byte("key0"), []byte("key3"), unrelatedLeaf, placeholder))
+	return file
+}
+
+func generateVectorProof(t *testing.T, tree *SparseMerkleTree, key []byte, updatable bool, options []Option) vectorProof {
+	value, err := tree.Get(key)
+	if err != nil {
+		t.Fatalf("returned error when getting key: %v", err)
+	}
+	var proof SparseMerkleProof
+	if updatable {
+		proof, err = tree.ProveUpdatable(key)
+	} else {
+		proof, err = tree.Prove(key)
+	}
+	if err != nil {
+		t.Fatalf("returned error when proving key: %v", err)
+	}
+	compactProof, err := CompactProof(proof, sha256.New(), options...)
+	if err != nil {
+		t.Fatalf("returned error when compacting proof: %v", err)
+	}
+
+	p := vectorProof{
+		Key:       key,
+		Value:     value,
+		Updatable: updatable,
+		Proof: vectorMerkleProof{
+			SideNodes:             []hexBytes{},
+			NonMembershipLeafData: proof.NonMembershipLeafData,
+			SiblingData:           proof.SiblingData,
+		},
+		CompactProof: vectorCompactProof{
+			SideNodes:             []hexBytes{},
+			NonMembershipLeafData: compactProof.NonMembershipLeafData,
+			BitMask:               compactProof.BitMask,
+			NumSideNodes:          compactProof.NumSideNodes,
+			SiblingData:           compactProof.SiblingData,
+		},
+	}
+	for _, sideNode := range proof.SideNodes {
+		p.Proof.SideNodes = append(p.Proof.SideNodes, sideNode)
+	}
+	for _, sideNode := range compactProof.SideNodes {
+		p.CompactProof.SideNodes = append(p.CompactProof.SideNodes, sideNode)
+	}
+	return p
+}
@@ -0,0 +1,156 @@
+package smt
+
+import (
+	"bytes"
+	"hash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Verifier verifies Merkle proofs with hashers from a factory. It keeps a
+// hasher and buffers for every goroutine that verifies proofs at the same
+// time, so that one Verifier can be shared across goroutines, and proofs can
+// be verified without allocating for every side node.
+type Verifier struct {
+	newHasher func() hash.Hash
+	options   []Option
+	states    sync.Pool
+}
+
+// ProofItem is a Merkle proof for a key and value against a root, to be
+// verified with Verifier.VerifyAll.
+type ProofItem struct {
+	Proof SparseMerkleProof
+	Root  []byte
+	Key   []byte
+	Value []byte
+}
+
+// verifierState is a tree hasher, with buffers for the data and hash of the
+// current node when verifying a proof.
+type verifierState struct {
+	th   *treeHasher
+	data []byte
+	node []byte
+}
+
+// NewVerifier creates a Verifier for the proofs of trees with a hasher and
+// options. newHasher must return a new hasher on every call.
+func NewVerifier(newHasher func() hash.Hash, options ...Option) *Verifier {
+	v := &Verifier{
+		newHasher: newHasher,
+		options:   options,
+	}
+	v.states.New = func() interface{} {
+		return &verifierState{th: treeHasherWithOptions(v.newHasher(), v.options)}
+	}
+	return v
+}
+
+// Verify verifies a Merkle proof, like VerifyProof.
+func (v *Verifier) Verify(proof SparseMerkleProof, root []byte, key []byte, value []byte) bool {
+	state := v.states.Get().(*verifierState)
+	defer v.states.Put(state)
+	return state.verify(proof, root, key, value)
+}
+
+// VerifyAll verifies Merkle proofs on a number of goroutines, or on as many
+// goroutines as CPUs if workers is not positive. It returns the indexes of the
+// items whose proofs failed to verify, in increasing order.
+func (v *Verifier) VerifyAll(items []ProofItem, workers int) []int {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(items) {
+		workers = len(items)
+	}
+
+	failed := make([]bool, len(items))
+	var next int64 = -1
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			state := v.states.Get().(*verifierState)
+			defer v.states.Put(state)
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(items) {
+					return
+				}
+				item := &items[i]
+				failed[i] = !state.verify(item.Proof, item.Root, item.Key, item.Value)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var indexes []int
+	for i, f := range failed {
+		if f {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func (state *verifierState) verify(proof SparseMerkleProof, root []byte, key []byte, value []byte) bool {
+	th := state.th
+	path, valueHash := th.path(key), th.valueHash(value)
+	if th.extensions || th.sumTree {
+		// Placeholder siblings may collapse into extension nodes, and sums
+		// are appended to hashes: use the general verifier.
+		result, _ := verifyProofWithUpdates(proof, root, path, valueHash, th)
+		return result
+	}
+	if len(path) != th.pathSize() || !proof.sanityCheck(th) {
+		return false
+	}
+
+	// Hash the leaf that the proof ends at.
+	if valueHash == nil {
+		if proof.NonMembershipLeafData == nil {
+			state.node = append(state.node[:0], th.placeholder()...)
+		} else {
+			actualPath, actualValueHash := th.parseLeaf(proof.NonMembershipLeafData)
+			if bytes.Equal(actualPath, path) {
+				return false
+			}
+			// Rebuild the leaf from its parts, so that the data of an inner
+			// node cannot pass for a leaf.
+			state.data = append(state.data[:0], leafPrefix...)
+			state.data = append(state.data, actualPath...)
+			state.data = append(state.data, actualValueHash...)
+			state.hashData()
+		}
+	} else {
+		state.data = append(state.data[:0], leafPrefix...)
+		state.data = append(state.data, path...)
+		state.data = append(state.data, valueHash...)
+		state.hashData()
+	}
+
+	// Hash the nodes up to the root.
+	for i, sideNode := range proof.SideNodes {
+		state.data = append(state.data[:0], nodePrefix...)
+		if getBitAtFromMSB(path, len(proof.SideNodes)-1-i) == right {
+			state.data = append(state.data, sideNode...)
+			state.data = append(state.data, state.node...)
+		} else {
+			state.data = append(state.data, state.node...)
+			state.data = append(state.data, sideNode...)
+		}
+		state.hashData()
+	}
+	return bytes.Equal(state.node, root)
+}
+
+// hashData sets the hash of the current node to the hash of the data buffer.
+func (state *verifierState) hashData() {
+	hasher := state.th.hasher
+	hasher.Write(state.data)
+	state.node = hasher.Sum(state.node[:0])
+	hasher.Reset()
+}
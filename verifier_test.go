@@ -0,0 +1,124 @@
+package smt
+
+import (
+	"crypto/sha256"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Test that a Verifier verifies proofs like VerifyProof.
+func TestVerifier(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithExtensionNodes()}, {WithDepth(8)}} {
+		smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New(), options...)
+		for i := 0; i < 100; i++ {
+			s := strconv.Itoa(i)
+			smt.Update([]byte(s), []byte(s))
+		}
+
+		v := NewVerifier(sha256.New, options...)
+		var items []ProofItem
+		var expected []int
+		for i := 0; i < 200; i++ {
+			s := strconv.Itoa(i)
+			proof, _ := smt.Prove([]byte(s))
+			value, _ := smt.Get([]byte(s))
+			if i%7 == 0 {
+				// A wrong value.
+				value = []byte("wrong")
+			}
+			result := VerifyProof(proof, smt.Root(), []byte(s), value, sha256.New(), options...)
+			if result != v.Verify(proof, smt.Root(), []byte(s), value) {
+				t.Error("Verifier and VerifyProof disagree on proof")
+			}
+			if !result {
+				expected = append(expected, i)
+			}
+			items = append(items, ProofItem{Proof: proof, Root: smt.Root(), Key: []byte(s), Value: value})
+		}
+		if len(expected) == 0 {
+			t.Error("expected some proofs to fail to verify")
+		}
+
+		for _, workers := range []int{0, 1, 3} {
+			if failed := v.VerifyAll(items, workers); !reflect.DeepEqual(expected, failed) {
+				t.Errorf("expected failed proofs %v, got %v", expected, failed)
+			}
+		}
+		if failed := v.VerifyAll(nil, 0); len(failed) != 0 {
+			t.Errorf("expected no failed proofs when verifying no proofs, got %v", failed)
+		}
+	}
+}
+
+// Test that the data of an inner node does not pass for an unrelated leaf in a
+// non-membership proof.
+func TestVerifierInnerNodeForgery(t *testing.T) {
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	for i := 0; i < 10; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	key := []byte("0")
+	proof, _ := smt.Prove(key)
+	if len(proof.SideNodes) == 0 {
+		t.Fatal("expected side nodes in proof")
+	}
+
+	// Claim that the parent of the leaf of the key is an unrelated leaf.
+	path := smt.th.path(key)
+	leaf, _ := smt.th.digestLeaf(path, smt.th.digest(key))
+	var parentData []byte
+	if getBitAtFromMSB(path, len(proof.SideNodes)-1) == right {
+		_, parentData = smt.th.digestNode(proof.SideNodes[0], leaf)
+	} else {
+		_, parentData = smt.th.digestNode(leaf, proof.SideNodes[0])
+	}
+	forged := SparseMerkleProof{
+		SideNodes:             proof.SideNodes[1:],
+		NonMembershipLeafData: parentData,
+	}
+
+	if VerifyProof(forged, smt.Root(), key, nil, sha256.New()) {
+		t.Error("VerifyProof accepted non-membership proof with inner node data")
+	}
+	if NewVerifier(sha256.New).Verify(forged, smt.Root(), key, nil) {
+		t.Error("Verifier accepted non-membership proof with inner node data")
+	}
+}
+
+// Test that verifying a proof does not allocate for every side node.
+func TestVerifierAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector drops pooled states at random")
+	}
+	smt := NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	shallow, _ := smt.Prove([]byte("testKey"))
+	shallowRoot := smt.Root()
+	for i := 0; i < 1000; i++ {
+		s := strconv.Itoa(i)
+		smt.Update([]byte(s), []byte(s))
+	}
+	deep, _ := smt.Prove([]byte("testKey"))
+	if len(deep.SideNodes) <= len(shallow.SideNodes) {
+		t.Fatal("expected a deeper proof after adding leaves")
+	}
+
+	v := NewVerifier(sha256.New)
+	root := smt.Root()
+	v.Verify(deep, root, []byte("testKey"), []byte("testValue"))
+	shallowAllocs := testing.AllocsPerRun(100, func() {
+		if !v.Verify(shallow, shallowRoot, []byte("testKey"), []byte("testValue")) {
+			t.Error("valid shallow proof failed to verify")
+		}
+	})
+	deepAllocs := testing.AllocsPerRun(100, func() {
+		if !v.Verify(deep, root, []byte("testKey"), []byte("testValue")) {
+			t.Error("valid deep proof failed to verify")
+		}
+	})
+	if deepAllocs > shallowAllocs {
+		t.Errorf("expected as many allocations for a deep proof as for a shallow proof, got %v and %v", deepAllocs, shallowAllocs)
+	}
+}
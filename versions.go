@@ -0,0 +1,478 @@
+package smt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrVersionNotFound is returned when loading or deleting a version of a tree
+// that was never committed, or was deleted.
+var ErrVersionNotFound = errors.New("version not found")
+
+// ErrLatestVersion is returned when deleting the latest version of a tree.
+var ErrLatestVersion = errors.New("cannot delete the latest version")
+
+var (
+	// versionsPrefix prefixes the keys of the records of the roots of the
+	// retained versions in the metadata store, by version.
+	versionsPrefix = []byte("smt/versions/")
+	// oldestVersionKey is the key of the record of the oldest retained
+	// version.
+	oldestVersionKey = []byte("smt/oldest")
+	// orphansPrefix prefixes the keys of the records of the nodes orphaned
+	// after a version, by version.
+	orphansPrefix = []byte("smt/orphans/")
+	// orphanedPrefix prefixes the keys of the records of the number of times
+	// that a node was orphaned after a version that is retained, by node.
+	orphanedPrefix = []byte("smt/orphaned/")
+)
+
+// Commit records the root of the tree as its next version, and returns the
+// version and root. The tree must have been opened with OpenSparseMerkleTree.
+//
+// Every committed version is retained, and can be loaded with LoadVersion,
+// until it is deleted with DeleteVersion: nodes that are orphaned by updates
+// are only deleted when the tree is committed, if no retained version uses
+// them.
+func (smt *SparseMerkleTree) Commit() (uint64, []byte, error) {
+	if smt.readOnly {
+		return 0, nil, ErrReadOnly
+	}
+	if smt.meta == nil {
+		return 0, nil, ErrNoMetaStore
+	}
+	root := smt.Root()
+	latestRoot := smt.th.placeholder()
+	if smt.version > 0 {
+		var err error
+		if latestRoot, err = smt.versionRoot(smt.version); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := smt.commitOrphans(root, latestRoot); err != nil {
+		return 0, nil, err
+	}
+
+	version := smt.version + 1
+	if err := smt.meta.Set(versionKey(version), root); err != nil {
+		return 0, nil, err
+	}
+	if version == 1 {
+		if err := smt.meta.Set(oldestVersionKey, encodeUint64(version)); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := smt.meta.Set(metaKey, smt.metaRecord(version)); err != nil {
+		return 0, nil, err
+	}
+	smt.version = version
+	return version, root, nil
+}
+
+// LoadVersion returns a read-only tree at the root of a retained version of
+// the tree, which shares the stores of the tree. It must not be used after
+// the version is deleted.
+func (smt *SparseMerkleTree) LoadVersion(version uint64) (*SparseMerkleTree, error) {
+	if smt.meta == nil {
+		return nil, ErrNoMetaStore
+	}
+	root, err := smt.versionRoot(version)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SparseMerkleTree{
+		th:               smt.th,
+		nodes:            smt.nodes,
+		values:           smt.values,
+		root:             root,
+		readOnly:         true,
+		keepHistory:      smt.keepHistory,
+		contentAddressed: smt.contentAddressed,
+		meta:             smt.meta,
+		version:          version,
+	}, nil
+}
+
+// VersionRoots returns the roots of the retained versions of the tree, by
+// version. The root of every version is a record of its own, and the versions
+// from the oldest retained one to the latest are looked up.
+func (smt *SparseMerkleTree) VersionRoots() (map[uint64][]byte, error) {
+	if smt.meta == nil {
+		return nil, ErrNoMetaStore
+	}
+	oldest, err := smt.oldestVersion()
+	if err != nil {
+		return nil, err
+	}
+	roots := make(map[uint64][]byte)
+	for version := oldest; version > 0 && version <= smt.version; version++ {
+		root, err := smt.versionRoot(version)
+		if errors.Is(err, ErrVersionNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		roots[version] = root
+	}
+	return roots, nil
+}
+
+// DeleteVersion deletes a version of the tree, along with the nodes and values
+// that no other retained version uses. The latest version cannot be deleted.
+func (smt *SparseMerkleTree) DeleteVersion(version uint64) error {
+	if smt.readOnly {
+		return ErrReadOnly
+	}
+	if smt.meta == nil {
+		return ErrNoMetaStore
+	}
+	if _, err := smt.versionRoot(version); err != nil {
+		return err
+	}
+	if version == smt.version {
+		return ErrLatestVersion
+	}
+	latestRoot, err := smt.versionRoot(smt.version)
+	if err != nil {
+		return err
+	}
+	oldest, err := smt.oldestVersion()
+	if err != nil {
+		return err
+	}
+	previous, previousRoot, err := smt.previousVersion(version, oldest)
+	if err != nil {
+		return err
+	}
+
+	// The nodes orphaned after the version are used by no later version,
+	// until they are set again. Of those, the nodes that the previous retained
+	// version uses are orphaned after it instead, and the others are deleted
+	// once no other version uses them.
+	orphans, err := smt.getOrphans(version)
+	if err != nil {
+		return err
+	}
+	var kept []byte
+	entrySize := smt.th.nodeSize() + smt.th.pathSize()
+	for ; len(orphans) >= entrySize; orphans = orphans[entrySize:] {
+		node, path := orphans[:smt.th.nodeSize()], orphans[smt.th.nodeSize():entrySize]
+		if previous > 0 {
+			used, err := smt.hasNode(previousRoot, node, path)
+			if err != nil {
+				return err
+			}
+			if used {
+				kept = append(kept, node...)
+				kept = append(kept, path...)
+				continue
+			}
+		}
+
+		count, err := smt.orphanCount(node)
+		if err != nil {
+			return err
+		}
+		if err := smt.setOrphanCount(node, count-1); err != nil {
+			return err
+		}
+		if count > 1 {
+			// An older version uses the node.
+			continue
+		}
+		used, err := smt.hasNode(latestRoot, node, path)
+		if err != nil {
+			return err
+		}
+		if !used {
+			used, err = smt.hasNode(smt.Root(), node, path)
+			if err != nil {
+				return err
+			}
+		}
+		if !used {
+			if err := smt.pruneNode(node); err != nil {
+				return err
+			}
+		}
+	}
+	if len(kept) > 0 {
+		if err := smt.appendOrphans(previous, kept); err != nil {
+			return err
+		}
+	}
+	if err := deleteIfExists(smt.meta, orphansKey(version)); err != nil {
+		return err
+	}
+
+	if err := smt.meta.Delete(versionKey(version)); err != nil {
+		return err
+	}
+	if version != oldest {
+		return nil
+	}
+	next, err := smt.nextVersion(version)
+	if err != nil {
+		return err
+	}
+	return smt.meta.Set(oldestVersionKey, encodeUint64(next))
+}
+
+// Commit records the root of the tree as its next version. See
+// SparseMerkleTree.Commit.
+func (smst *SparseMerkleSumTree) Commit() (uint64, []byte, error) {
+	return smst.smt.Commit()
+}
+
+// LoadVersion returns a read-only tree at the root of a retained version of
+// the tree. See SparseMerkleTree.LoadVersion.
+func (smst *SparseMerkleSumTree) LoadVersion(version uint64) (*SparseMerkleSumTree, error) {
+	tree, err := smst.smt.LoadVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	return &SparseMerkleSumTree{smt: tree}, nil
+}
+
+// VersionRoots returns the roots of the retained versions of the tree, by
+// version.
+func (smst *SparseMerkleSumTree) VersionRoots() (map[uint64][]byte, error) {
+	return smst.smt.VersionRoots()
+}
+
+// DeleteVersion deletes a version of the tree. See
+// SparseMerkleTree.DeleteVersion.
+func (smst *SparseMerkleSumTree) DeleteVersion(version uint64) error {
+	return smst.smt.DeleteVersion(version)
+}
+
+// commitOrphans sorts out the nodes orphaned since the last commit, given the
+// new root and the root of the latest version. Nodes that the latest version
+// uses are orphaned after it, and nodes that no version uses were never
+// committed, and are deleted.
+func (smt *SparseMerkleTree) commitOrphans(root []byte, latestRoot []byte) error {
+	var orphans []byte
+	for node, path := range smt.orphans {
+		// The node may have been set again.
+		used, err := smt.hasNode(root, []byte(node), path)
+		if err != nil {
+			return err
+		}
+		if used {
+			continue
+		}
+
+		count, err := smt.orphanCount([]byte(node))
+		if err != nil {
+			return err
+		}
+		used, err = smt.hasNode(latestRoot, []byte(node), path)
+		if err != nil {
+			return err
+		}
+		if used {
+			orphans = append(orphans, node...)
+			orphans = append(orphans, path...)
+			if err := smt.setOrphanCount([]byte(node), count+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if count == 0 {
+			if err := smt.pruneNode([]byte(node)); err != nil {
+				return err
+			}
+		}
+	}
+	if len(orphans) > 0 {
+		if err := smt.appendOrphans(smt.version, orphans); err != nil {
+			return err
+		}
+	}
+
+	for node := range smt.orphans {
+		delete(smt.orphans, node)
+	}
+	return nil
+}
+
+// hasNode returns true if the tree at a root has a node, on a path through
+// it. Nodes commit to the paths beneath them, so a node can only be in one
+// place in a tree.
+func (smt *SparseMerkleTree) hasNode(root []byte, node []byte, path []byte) (bool, error) {
+	if bytes.Equal(root, node) {
+		return true, nil
+	}
+	_, pathNodes, _, _, err := smt.sideNodesForRoot(path, root, false)
+	if err != nil {
+		return false, err
+	}
+	for _, pathNode := range pathNodes {
+		if bytes.Equal(pathNode, node) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pruneNode deletes an orphaned node that no retained version uses, along
+// with the value of the leaf if it is one. The reference of the leaf to a
+// content-addressed value is released.
+func (smt *SparseMerkleTree) pruneNode(node []byte) error {
+	data, err := smt.nodes.Get(node)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			return nil
+		}
+		return err
+	}
+	if smt.th.isLeaf(data) {
+		path, valueHash := smt.th.parseLeaf(data)
+		if smt.contentAddressed {
+			if err := smt.releaseValue(valueHash); err != nil {
+				return err
+			}
+		} else if err := deleteIfExists(smt.values, historyKey(path, valueHash)); err != nil {
+			return err
+		}
+	}
+	return smt.nodes.Delete(node)
+}
+
+// orphanCount returns the number of times that a node is in the nodes
+// orphaned after a version. A node is only deleted once it is in none, as
+// older versions may use it if it was set again after it was orphaned.
+func (smt *SparseMerkleTree) orphanCount(node []byte) (uint64, error) {
+	record, err := smt.meta.Get(orphanedKey(node))
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(record), nil
+}
+
+func (smt *SparseMerkleTree) setOrphanCount(node []byte, count uint64) error {
+	if count == 0 {
+		return deleteIfExists(smt.meta, orphanedKey(node))
+	}
+	return smt.meta.Set(orphanedKey(node), encodeUint64(count))
+}
+
+// getOrphans returns the nodes orphaned after a version, each followed by a
+// path through it.
+func (smt *SparseMerkleTree) getOrphans(version uint64) ([]byte, error) {
+	orphans, err := smt.meta.Get(orphansKey(version))
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return orphans, nil
+}
+
+// appendOrphans adds nodes, each followed by a path through it, to the nodes
+// orphaned after a version.
+func (smt *SparseMerkleTree) appendOrphans(version uint64, orphans []byte) error {
+	existing, err := smt.getOrphans(version)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, 0, len(existing)+len(orphans))
+	record = append(record, existing...)
+	record = append(record, orphans...)
+	return smt.meta.Set(orphansKey(version), record)
+}
+
+// versionRoot returns the root of a retained version of the tree.
+// ErrVersionNotFound is returned if the version is not retained.
+func (smt *SparseMerkleTree) versionRoot(version uint64) ([]byte, error) {
+	if version == 0 {
+		return nil, ErrVersionNotFound
+	}
+	root, err := smt.meta.Get(versionKey(version))
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+	return root, nil
+}
+
+// oldestVersion returns the oldest retained version of the tree, or 0 if it
+// was never committed.
+func (smt *SparseMerkleTree) oldestVersion() (uint64, error) {
+	record, err := smt.meta.Get(oldestVersionKey)
+	if err != nil {
+		var invalidKeyError *InvalidKeyError
+		if errors.As(err, &invalidKeyError) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(record), nil
+}
+
+// previousVersion returns the retained version before a version, down to the
+// oldest retained version, and its root. 0 is returned if there is none.
+func (smt *SparseMerkleTree) previousVersion(version uint64, oldest uint64) (uint64, []byte, error) {
+	for version--; version > 0 && version >= oldest; version-- {
+		root, err := smt.versionRoot(version)
+		if errors.Is(err, ErrVersionNotFound) {
+			continue
+		}
+		return version, root, err
+	}
+	return 0, nil, nil
+}
+
+// nextVersion returns the retained version after a version. The latest version
+// is always retained, so there is one unless the version is the latest.
+func (smt *SparseMerkleTree) nextVersion(version uint64) (uint64, error) {
+	for version++; version < smt.version; version++ {
+		_, err := smt.versionRoot(version)
+		if errors.Is(err, ErrVersionNotFound) {
+			continue
+		}
+		return version, err
+	}
+	return smt.version, nil
+}
+
+func encodeUint64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func versionKey(version uint64) []byte {
+	return append(append([]byte(nil), versionsPrefix...), encodeUint64(version)...)
+}
+
+func orphansKey(version uint64) []byte {
+	return append(append([]byte(nil), orphansPrefix...), encodeUint64(version)...)
+}
+
+func orphanedKey(node []byte) []byte {
+	return append(append([]byte(nil), orphanedPrefix...), node...)
+}
+
+// deleteIfExists deletes a key from a MapStore, if it is there.
+func deleteIfExists(ms MapStore, key []byte) error {
+	err := ms.Delete(key)
+	var invalidKeyError *InvalidKeyError
+	if errors.As(err, &invalidKeyError) {
+		return nil
+	}
+	return err
+}
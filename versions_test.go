@@ -0,0 +1,243 @@
+package smt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// Test that retained versions can be loaded as versions are deleted, and that
+// deleting versions deletes what only they used.
+func TestSparseMerkleTreeVersions(t *testing.T) {
+	for _, options := range [][]Option{nil, {WithExtensionNodes()}} {
+		smn, smv, meta := NewSimpleMap(), NewSimpleMap(), NewSimpleMap()
+		smt, err := OpenSparseMerkleTree(smn, smv, meta, sha256.New(), options...)
+		if err != nil {
+			t.Fatalf("returned error when opening tree: %v", err)
+		}
+
+		// Few keys and values, so that nodes are often set again after
+		// they are orphaned.
+		expected := make(map[uint64]map[string]string)
+		current := make(map[string]string)
+		for version := uint64(1); version <= 20; version++ {
+			tree := smt
+			var tx *Transaction
+			if rand.Intn(2) == 0 {
+				tx = smt.Begin()
+				tree = tx.SparseMerkleTree
+			}
+			for i := 0; i < 5; i++ {
+				key := strconv.Itoa(rand.Intn(10))
+				value := strconv.Itoa(rand.Intn(3))
+				if value == "0" {
+					tree.Delete([]byte(key))
+					delete(current, key)
+				} else {
+					tree.Update([]byte(key), []byte(value))
+					current[key] = value
+				}
+			}
+			if tx != nil {
+				if err := tx.Commit(); err != nil {
+					t.Errorf("returned error when committing transaction: %v", err)
+				}
+			}
+
+			committed, root, err := smt.Commit()
+			if err != nil {
+				t.Errorf("returned error when committing tree: %v", err)
+			}
+			if committed != version || !bytes.Equal(root, smt.Root()) {
+				t.Errorf("expected version %d and root of tree when committing, got version %d", version, committed)
+			}
+			expected[version] = make(map[string]string)
+			for key, value := range current {
+				expected[version][key] = value
+			}
+		}
+
+		for len(expected) > 1 {
+			roots, err := smt.VersionRoots()
+			if err != nil {
+				t.Errorf("returned error when getting version roots: %v", err)
+			}
+			if len(roots) != len(expected) {
+				t.Errorf("expected %d version roots, got %d", len(expected), len(roots))
+			}
+			for version, values := range expected {
+				tree, err := smt.LoadVersion(version)
+				if err != nil {
+					t.Errorf("returned error when loading version %d: %v", version, err)
+					continue
+				}
+				if !bytes.Equal(roots[version], tree.Root()) {
+					t.Errorf("did not get root of version %d when loading it", version)
+				}
+				for i := 0; i < 10; i++ {
+					key := strconv.Itoa(i)
+					value, err := tree.Get([]byte(key))
+					if err != nil {
+						t.Errorf("returned error when getting key from version %d: %v", version, err)
+					}
+					if string(value) != values[key] {
+						t.Errorf("did not get correct value of key %s at version %d", key, version)
+					}
+				}
+			}
+
+			version := uint64(rand.Intn(19) + 1)
+			if _, ok := expected[version]; !ok {
+				continue
+			}
+			if err := smt.DeleteVersion(version); err != nil {
+				t.Errorf("returned error when deleting version %d: %v", version, err)
+			}
+			delete(expected, version)
+		}
+
+		// Only the nodes and values of the latest version are left.
+		if nodes := reachableNodes(t, smt, smt.Root()); nodes != len(smn.m) {
+			t.Errorf("expected %d nodes after deleting versions, got %d", nodes, len(smn.m))
+		}
+		// Values are stored by path, and by path and value hash.
+		if len(smv.m) != 2*len(current) {
+			t.Errorf("expected %d values after deleting versions, got %d", 2*len(current), len(smv.m))
+		}
+	}
+}
+
+// Test errors when loading and deleting versions.
+func TestSparseMerkleTreeVersionsInvalid(t *testing.T) {
+	smt, _ := OpenSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), NewSimpleMap(), sha256.New())
+	smt.Update([]byte("testKey"), []byte("testValue"))
+	smt.Commit()
+	smt.Update([]byte("testKey"), []byte("testValue2"))
+	smt.Commit()
+
+	if err := smt.DeleteVersion(2); !errors.Is(err, ErrLatestVersion) {
+		t.Errorf("expected ErrLatestVersion when deleting latest version, got: %v", err)
+	}
+	if err := smt.DeleteVersion(3); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound when deleting uncommitted version, got: %v", err)
+	}
+	if err := smt.DeleteVersion(1); err != nil {
+		t.Errorf("returned error when deleting version: %v", err)
+	}
+	if _, err := smt.LoadVersion(1); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected ErrVersionNotFound when loading deleted version, got: %v", err)
+	}
+
+	tree, err := smt.LoadVersion(2)
+	if err != nil {
+		t.Errorf("returned error when loading version: %v", err)
+	}
+	if _, err := tree.Update([]byte("testKey"), []byte("testValue3")); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly when updating loaded version, got: %v", err)
+	}
+
+	smt = NewSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), sha256.New())
+	if _, err := smt.LoadVersion(1); !errors.Is(err, ErrNoMetaStore) {
+		t.Errorf("expected ErrNoMetaStore when loading version of tree without metadata store, got: %v", err)
+	}
+}
+
+// Test that the root of every version is a record of its own, so that
+// committing and deleting versions does not rewrite the roots of the others.
+func TestSparseMerkleTreeVersionRecords(t *testing.T) {
+	meta := NewSimpleMap()
+	smt, _ := OpenSparseMerkleTree(NewSimpleMap(), NewSimpleMap(), meta, sha256.New())
+	roots := make(map[uint64][]byte)
+	for i := 0; i < 5; i++ {
+		smt.Update([]byte("testKey"), []byte(strconv.Itoa(i)))
+		version, root, _ := smt.Commit()
+		roots[version] = root
+	}
+	for version, root := range roots {
+		if record, _ := meta.Get(versionKey(version)); !bytes.Equal(root, record) {
+			t.Errorf("did not get root of version %d from its record", version)
+		}
+	}
+
+	for _, version := range []uint64{3, 1, 2} {
+		if err := smt.DeleteVersion(version); err != nil {
+			t.Errorf("returned error when deleting version %d: %v", version, err)
+		}
+		delete(roots, version)
+		if _, err := meta.Get(versionKey(version)); err == nil {
+			t.Errorf("did not delete record of version %d", version)
+		}
+		got, err := smt.VersionRoots()
+		if err != nil {
+			t.Errorf("returned error when getting version roots: %v", err)
+		}
+		if !reflect.DeepEqual(roots, got) {
+			t.Errorf("did not get roots of retained versions after deleting version %d", version)
+		}
+	}
+	if oldest, _ := smt.oldestVersion(); oldest != 4 {
+		t.Errorf("expected oldest version 4 after deleting older versions, got %d", oldest)
+	}
+}
+
+// Test that deleting versions of a tree with content-addressed values deletes
+// the values that only they used.
+func TestSparseMerkleTreeVersionsContentAddressed(t *testing.T) {
+	smn, smv := NewSimpleMap(), NewSimpleMap()
+	smt, _ := OpenSparseMerkleTree(smn, smv, NewSimpleMap(), sha256.New(), WithContentAddressedValues())
+	for i := 0; i < 20; i++ {
+		// Values are set again after they are orphaned, within and across
+		// versions.
+		smt.Update([]byte("testKey"), []byte(strconv.Itoa(i%3)))
+		smt.Update([]byte("testKey"), []byte("value"+strconv.Itoa(i)))
+		smt.Update([]byte("testKey2"), []byte(strconv.Itoa(i%2)))
+		smt.Commit()
+	}
+	for version := uint64(1); version < 20; version++ {
+		if err := smt.DeleteVersion(version); err != nil {
+			t.Errorf("returned error when deleting version %d: %v", version, err)
+		}
+	}
+
+	if nodes := reachableNodes(t, smt, smt.Root()); nodes != len(smn.m) {
+		t.Errorf("expected %d nodes after deleting versions, got %d", nodes, len(smn.m))
+	}
+	if len(smv.m) != 2 {
+		t.Errorf("expected 2 values after deleting versions, got %d", len(smv.m))
+	}
+	for key, value := range map[string]string{"testKey": "value19", "testKey2": "1"} {
+		if got, err := smt.Get([]byte(key)); err != nil || string(got) != value {
+			t.Errorf("did not get value of key %s after deleting versions, got %q and error: %v", key, got, err)
+		}
+	}
+	for _, record := range smv.m {
+		if refs, _ := decodeValueRecord(record); refs != 1 {
+			t.Errorf("expected 1 reference to every value after deleting versions, got %d", refs)
+		}
+	}
+}
+
+// reachableNodes returns the number of nodes of the tree at a root.
+func reachableNodes(t *testing.T, smt *SparseMerkleTree, root []byte) int {
+	if bytes.Equal(root, smt.th.placeholder()) {
+		return 0
+	}
+	data, err := smt.nodes.Get(root)
+	if err != nil {
+		t.Fatalf("returned error when getting node: %v", err)
+	}
+	switch {
+	case smt.th.isLeaf(data):
+		return 1
+	case smt.th.isExtension(data):
+		_, _, _, child := smt.th.parseExtension(data)
+		return 1 + reachableNodes(t, smt, child)
+	default:
+		left, right := smt.th.parseNode(data)
+		return 1 + reachableNodes(t, smt, left) + reachableNodes(t, smt, right)
+	}
+}